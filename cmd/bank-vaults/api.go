@@ -0,0 +1,277 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cfgAPIAddress = "api-address"
+	cfgAPIToken   = "api-token"
+
+	defaultAPIConfigurationName = "api"
+)
+
+type sectionStatus struct {
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+type configurationStatus struct {
+	Name      string                   `json:"name"`
+	Hash      string                   `json:"hash"`
+	AppliedAt time.Time                `json:"appliedAt"`
+	Success   bool                     `json:"success"`
+	Error     string                   `json:"error,omitempty"`
+	Sections  map[string]sectionStatus `json:"sections"`
+}
+
+// configurer applies configurations to Vault one at a time and keeps track of the outcome of the last run of every
+// configuration, so it can be reported through the API
+type configurer struct {
+	vault vault.Vault
+
+	mu             sync.Mutex
+	status         map[string]*configurationStatus
+	configurations map[string]*viper.Viper
+}
+
+func newConfigurer(v vault.Vault) *configurer {
+	return &configurer{
+		vault:          v,
+		status:         map[string]*configurationStatus{},
+		configurations: map[string]*viper.Viper{},
+	}
+}
+
+func (c *configurer) apply(name string, config *viper.Viper) *configurationStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := &configurationStatus{
+		Name:      name,
+		Hash:      configurationHash(config),
+		AppliedAt: time.Now(),
+		Sections:  map[string]sectionStatus{},
+	}
+
+	err := c.vault.Configure(config)
+
+	// Sections are applied in order, so everything before the failed one has been applied
+	failedSection := ""
+	if configErr, ok := err.(*vault.ConfigurationError); ok {
+		failedSection = configErr.Section
+	}
+	applied := err == nil || failedSection != ""
+	for _, section := range vault.ConfigurationSections {
+		if section == failedSection {
+			status.Sections[section] = sectionStatus{Error: err.Error()}
+			applied = false
+			continue
+		}
+		status.Sections[section] = sectionStatus{Applied: applied}
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+		failedConfigurationsCount++
+	} else {
+		status.Success = true
+		successfulConfigurationsCount++
+		configLastSuccess.WithLabelValues(name).SetToCurrentTime()
+	}
+
+	c.status[name] = status
+	c.configurations[name] = config
+
+	return status
+}
+
+func (c *configurer) statuses() []configurationStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]configurationStatus, 0, len(c.status))
+	for _, status := range c.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// appliedConfigurations returns the last applied version of every configuration
+func (c *configurer) appliedConfigurations() map[string]*viper.Viper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	configurations := make(map[string]*viper.Viper, len(c.configurations))
+	for name, config := range c.configurations {
+		configurations[name] = config
+	}
+
+	return configurations
+}
+
+func configurationHash(config *viper.Viper) string {
+	// yaml.Marshal sorts the map keys, so the same configuration always has the same hash
+	content, err := yaml.Marshal(config.AllSettings())
+	if err != nil {
+		logrus.Errorf("error marshaling vault config for hashing: %s", err.Error())
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+type configurerAPI struct {
+	configurer       *configurer
+	token            string
+	vaultConfigFiles []string
+	// isLeader is set with leader election, only the leader serves the API since only it applies configurations
+	isLeader func() bool
+}
+
+func (a *configurerAPI) Run(address string) {
+	logrus.Infof("configurer API enabled: %s", address)
+	server := gin.New()
+	server.Use(gin.Logger(), gin.ErrorLogger(), a.authenticate, a.requireLeader)
+	server.GET("/status", a.getStatus)
+	server.POST("/config", a.postConfig)
+	server.POST("/reapply", a.postReapply)
+	if err := server.Run(address); err != nil {
+		logrus.Fatalf("error running configurer API: %s", err.Error())
+	}
+}
+
+func (a *configurerAPI) authenticate(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing bearer token"})
+		return
+	}
+	c.Next()
+}
+
+func (a *configurerAPI) requireLeader(c *gin.Context) {
+	if a.isLeader != nil && !a.isLeader() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "not the leader, the configurations are applied by the leader replica"})
+		return
+	}
+	c.Next()
+}
+
+func (a *configurerAPI) getStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"configurations": a.configurer.statuses()})
+}
+
+func (a *configurerAPI) postConfig(c *gin.Context) {
+	name := c.DefaultQuery("name", defaultAPIConfigurationName)
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading request body: %s", err.Error())})
+		return
+	}
+
+	configType := "yaml"
+	if strings.Contains(c.ContentType(), "json") {
+		configType = "json"
+	}
+
+	config, err := readConfiguration(configType, body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !a.unsealed(c) {
+		return
+	}
+
+	status := a.configurer.apply(name, config)
+	if !status.Success {
+		c.JSON(http.StatusUnprocessableEntity, status)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (a *configurerAPI) postReapply(c *gin.Context) {
+	// Configuration files are re-read, documents submitted through the API are re-applied as they were submitted
+	configurations := a.configurer.appliedConfigurations()
+
+	for _, vaultConfigFile := range a.vaultConfigFiles {
+		config, err := loadConfiguration(vaultConfigFile)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		configurations[vaultConfigFile] = config
+	}
+
+	if !a.unsealed(c) {
+		return
+	}
+
+	names := make([]string, 0, len(configurations))
+	for name := range configurations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]configurationStatus, 0, len(names))
+	success := true
+	for _, name := range names {
+		status := a.configurer.apply(name, configurations[name])
+		success = success && status.Success
+		statuses = append(statuses, *status)
+	}
+
+	code := http.StatusOK
+	if !success {
+		code = http.StatusUnprocessableEntity
+	}
+	c.JSON(code, gin.H{"configurations": statuses})
+}
+
+// unsealed writes an error response and returns false if the configuration can't be applied because Vault is sealed
+func (a *configurerAPI) unsealed(c *gin.Context) bool {
+	sealed, err := a.configurer.vault.Sealed()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("error checking if vault is sealed: %s", err.Error())})
+		return false
+	}
+	if sealed {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "vault is sealed"})
+		return false
+	}
+	return true
+}
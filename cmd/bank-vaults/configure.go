@@ -15,6 +15,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -22,6 +25,7 @@ import (
 	"time"
 
 	"github.com/banzaicloud/bank-vaults/internal/configuration"
+	"github.com/banzaicloud/bank-vaults/pkg/notify"
 	"github.com/banzaicloud/bank-vaults/pkg/vault"
 
 	"github.com/fsnotify/fsnotify"
@@ -29,11 +33,14 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	cfgVaultConfigFile = "vault-config-file"
 	cfgFatal           = "fatal"
+	cfgRefreshPeriod   = "refresh-period"
+	cfgShowExpanded    = "show-expanded"
 )
 
 var configureCmd = &cobra.Command{
@@ -47,6 +54,12 @@ var configureCmd = &cobra.Command{
 		appConfig.BindPFlag(cfgFatal, cmd.PersistentFlags().Lookup(cfgFatal))
 		appConfig.BindPFlag(cfgUnsealPeriod, cmd.PersistentFlags().Lookup(cfgUnsealPeriod))
 		appConfig.BindPFlag(cfgVaultConfigFile, cmd.PersistentFlags().Lookup(cfgVaultConfigFile))
+		appConfig.BindPFlag(cfgRefreshPeriod, cmd.PersistentFlags().Lookup(cfgRefreshPeriod))
+		appConfig.BindPFlag(cfgKubeconfigWatchPeriod, cmd.PersistentFlags().Lookup(cfgKubeconfigWatchPeriod))
+		appConfig.BindPFlag(cfgShowExpanded, cmd.PersistentFlags().Lookup(cfgShowExpanded))
+		appConfig.BindPFlag(cfgAPIAddress, cmd.PersistentFlags().Lookup(cfgAPIAddress))
+		appConfig.BindPFlag(cfgAPIToken, cmd.PersistentFlags().Lookup(cfgAPIToken))
+		appConfig.BindPFlag(cfgListenAddress, cmd.PersistentFlags().Lookup(cfgListenAddress))
 
 		var unsealConfig unsealCfg
 
@@ -54,111 +67,167 @@ var configureCmd = &cobra.Command{
 		errorFatal := appConfig.GetBool(cfgFatal)
 		unsealConfig.unsealPeriod = appConfig.GetDuration(cfgUnsealPeriod)
 		vaultConfigFiles := appConfig.GetStringSlice(cfgVaultConfigFile)
-
-		store, err := kvStoreForConfig(appConfig)
-
-		if err != nil {
-			logrus.Fatalf("error creating kv store: %s", err.Error())
+		refreshPeriod := appConfig.GetDuration(cfgRefreshPeriod)
+		kubeconfigWatchPeriod := appConfig.GetDuration(cfgKubeconfigWatchPeriod)
+		apiAddress := appConfig.GetString(cfgAPIAddress)
+		apiToken := appConfig.GetString(cfgAPIToken)
+
+		if appConfig.GetBool(cfgShowExpanded) {
+			for _, vaultConfigFile := range vaultConfigFiles {
+				showExpandedConfiguration(vaultConfigFile)
+			}
+			return
 		}
 
-		cl, err := vault.NewRawClient()
-
+		v, _, _, err := vaultForConfig(appConfig)
 		if err != nil {
-			logrus.Fatalf("error connecting to vault: %s", err.Error())
+			logrus.Fatal(err.Error())
 		}
 
-		vaultConfig, err := vaultConfigForConfig(appConfig)
+		metrics := &prometheusExporter{Vault: v, Mode: "configure"}
+		go metrics.Run(appConfig.GetString(cfgListenAddress))
 
-		if err != nil {
-			logrus.Fatalf("error building vault config: %s", err.Error())
-		}
-
-		v, err := vault.New(store, cl, vaultConfig)
-
-		if err != nil {
-			logrus.Fatalf("error creating vault helper: %s", err.Error())
-		}
-
-		metrics := prometheusExporter{Vault: v, Mode: "configure"}
-		go metrics.Run()
+		configurer := newConfigurer(v)
 
 		configurations := make(chan *viper.Viper, len(vaultConfigFiles))
 
 		for i, vaultConfigFile := range vaultConfigFiles {
 			vaultConfigFiles[i] = filepath.Clean(vaultConfigFile)
-			configurations <- parseConfiguration(vaultConfigFile)
+			config, err := loadConfiguration(vaultConfigFile)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+			configurations <- config
+		}
+
+		if apiAddress != "" {
+			if apiToken == "" {
+				logrus.Fatalf("the configurer API requires a token, set it with --%s or BANK_VAULTS_API_TOKEN", cfgAPIToken)
+			}
+			api := configurerAPI{configurer: configurer, token: apiToken, vaultConfigFiles: vaultConfigFiles}
+			go api.Run(apiAddress)
 		}
 
 		if !runOnce {
-			go watchConfigurations(vaultConfigFiles, configurations)
+			go watchConfigurations(vaultConfigFiles, configurations, nil)
+			if refreshPeriod > 0 {
+				go refreshConfigurations(vaultConfigFiles, configurations, refreshPeriod, nil)
+			}
+			if kubeconfigWatchPeriod > 0 {
+				go watchKubeconfigs(vaultConfigFiles, configurations, kubeconfigWatchPeriod)
+			}
 		} else {
 			close(configurations)
 		}
 
-		// Handle backoff for configuration errors
-		b := &backoff.Backoff{
-			Min:    500 * time.Millisecond,
-			Max:    60 * time.Second,
-			Factor: 2,
-			Jitter: false,
+		applyConfigurations(context.Background(), v, configurer, configurations, unsealConfig.unsealPeriod, errorFatal, nil)
+	},
+}
+
+// applyConfigurations applies the configurations received on the channel until it is closed or the context is done,
+// waiting for Vault to be unsealed first. Failed configurations are re-applied with an exponential backoff. The
+// outcome of every configuration (and of reloading the failed ones) is passed to report if it is not nil.
+func applyConfigurations(ctx context.Context, v vault.Vault, configurer *configurer, configurations chan *viper.Viper,
+	unsealPeriod time.Duration, errorFatal bool, report func(error)) {
+	// Handle backoff for configuration errors
+	b := &backoff.Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    60 * time.Second,
+		Factor: 2,
+		Jitter: false,
+	}
+
+	// The configuration files failing to be applied, to notify about their recovery
+	failing := map[string]bool{}
+
+	for {
+		var config *viper.Viper
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-configurations:
+			if !ok {
+				return
+			}
+			config = c
 		}
 
-		for config := range configurations {
-
-			logrus.Infoln("applying config file :", config.ConfigFileUsed())
-
-			func() {
-				for {
-					logrus.Infof("checking if vault is sealed...")
-					sealed, err := v.Sealed()
-					if err != nil {
-						logrus.Errorf("error checking if vault is sealed: %s, waiting %s before trying again...", err.Error(), unsealConfig.unsealPeriod)
-						time.Sleep(unsealConfig.unsealPeriod)
-						continue
-					}
-
-					// If vault is sealed, we stop here and wait another unsealPeriod
-					if sealed {
-						logrus.Infof("vault is sealed, waiting %s before trying again...", unsealConfig.unsealPeriod)
-						time.Sleep(unsealConfig.unsealPeriod)
-						continue
-					}
-
-					logrus.Info("vault is unsealed, configuring...")
-
-					if err = v.Configure(config); err != nil {
-						logrus.Errorf("error configuring vault: %s", err.Error())
-						if errorFatal {
-							os.Exit(1)
-						}
-						failedConfigurationsCount++
-						// Failed configuration handler - Increase the backoff sleep
-						go handleConfigurationError(config.ConfigFileUsed(), configurations, b.Duration())
-						return
-					}
-
-					// On *any* successful configuration reset the backoff
-					b.Reset()
-					successfulConfigurationsCount++
-					logrus.Info("successfully configured vault")
+		logrus.Infoln("applying config file :", config.ConfigFileUsed())
+
+		for {
+			logrus.Infof("checking if vault is sealed...")
+			sealed, err := v.Sealed()
+			if err != nil {
+				logrus.Errorf("error checking if vault is sealed: %s, waiting %s before trying again...", err.Error(), unsealPeriod)
+				if !sleepContext(ctx, unsealPeriod) {
 					return
 				}
-			}()
+				continue
+			}
+
+			// If vault is sealed, we stop here and wait another unsealPeriod
+			if sealed {
+				logrus.Infof("vault is sealed, waiting %s before trying again...", unsealPeriod)
+				if !sleepContext(ctx, unsealPeriod) {
+					return
+				}
+				continue
+			}
+
+			logrus.Info("vault is unsealed, configuring...")
+
+			if status := configurer.apply(config.ConfigFileUsed(), config); !status.Success {
+				logrus.Errorf("error configuring vault: %s", status.Error)
+				if errorFatal {
+					os.Exit(1)
+				}
+				err := fmt.Errorf("error configuring vault with %s: %s", config.ConfigFileUsed(), status.Error)
+				if report != nil {
+					report(err)
+				}
+				failing[config.ConfigFileUsed()] = true
+				notifier.Notify(notify.NewEvent(notify.EventConfigureFailed, config.ConfigFileUsed(), "error configuring vault", errors.New(status.Error)))
+				// Failed configuration handler - Increase the backoff sleep
+				go handleConfigurationError(config.ConfigFileUsed(), configurations, b.Duration(), report)
+				break
+			}
+
+			// On *any* successful configuration reset the backoff
+			b.Reset()
+			logrus.Info("successfully configured vault")
+			if report != nil {
+				report(nil)
+			}
+			if failing[config.ConfigFileUsed()] {
+				delete(failing, config.ConfigFileUsed())
+				notifier.Notify(notify.NewEvent(notify.EventConfigureRecovered, config.ConfigFileUsed(), "vault has been configured successfully again", nil))
+			}
+			break
 		}
-	},
+	}
 }
 
-func handleConfigurationError(vaultConfigFile string, configurations chan *viper.Viper, sleepTime time.Duration) {
+// sleepContext waits for the duration, it returns false if the context is done in the meantime
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func handleConfigurationError(vaultConfigFile string, configurations chan *viper.Viper, sleepTime time.Duration, report func(error)) {
 	// This handler will sleep for a exponential backoff amount of time and re-inject the failed configuration into the
 	// configurations channel to be re-applied to vault
 	// Eventually consistent model - all recovarable errors (5xx and configs that depend on other configs) will be eventually fixed
 	// non recovarable errors will be retried and keep failing every MAX BACKOFF seconds, increasing the error counters ont he vault-configurator pod.
 	logrus.Infof("Failed applying configuration file: %s , sleeping for %s before trying again", vaultConfigFile, sleepTime)
 	time.Sleep(sleepTime)
-	configurations <- parseConfiguration(vaultConfigFile)
+	sendConfiguration(vaultConfigFile, configurations, report)
 }
 
-func watchConfigurations(vaultConfigFiles []string, configurations chan *viper.Viper) {
+func watchConfigurations(vaultConfigFiles []string, configurations chan *viper.Viper, report func(error)) {
 	watcher, err := fsnotify.NewWatcher()
 	// Map used to match on kubernetes ..data to files inside of directory
 	configFileDirs := make(map[string][]string)
@@ -194,11 +263,11 @@ func watchConfigurations(vaultConfigFiles []string, configurations chan *viper.V
 			// For Kubernetes configMaps we need to watch for CREATE on the "..data"
 			if event.Op&fsnotify.Write == fsnotify.Write && stringInSlice(vaultConfigFiles, filepath.Clean(event.Name)) {
 				logrus.Infof("file has changed: %s", event.Name)
-				configurations <- parseConfiguration(filepath.Clean(event.Name))
+				sendConfiguration(filepath.Clean(event.Name), configurations, report)
 			} else if event.Op&fsnotify.Create == fsnotify.Create && filepath.Base(event.Name) == "..data" {
 				for _, fileName := range configFileDirs[filepath.Dir(event.Name)] {
 					logrus.Infof("ConfigMap has changed, reparsing: %s", fileName)
-					configurations <- parseConfiguration(fileName)
+					sendConfiguration(fileName, configurations, report)
 				}
 			}
 		case err := <-watcher.Errors:
@@ -207,28 +276,83 @@ func watchConfigurations(vaultConfigFiles []string, configurations chan *viper.V
 	}
 }
 
-func parseConfiguration(vaultConfigFile string) *viper.Viper {
+func refreshConfigurations(vaultConfigFiles []string, configurations chan *viper.Viper, refreshPeriod time.Duration, report func(error)) {
+	// Periodically re-apply every configuration file, this picks up changes in the external sources
+	// referenced by the configuration which are not watched (the kubeconfigs are watched by watchKubeconfigs)
+	for range time.Tick(refreshPeriod) {
+		for _, vaultConfigFile := range vaultConfigFiles {
+			logrus.Infof("refreshing configuration: %s", vaultConfigFile)
+			sendConfiguration(vaultConfigFile, configurations, report)
+		}
+	}
+}
 
-	config := viper.New()
+// sendConfiguration loads a configuration file and sends it to be applied, a file which can't be loaded
+// (e.g. after a broken edit) is logged and passed to report if it is not nil, it is loaded again when it changes
+func sendConfiguration(vaultConfigFile string, configurations chan *viper.Viper, report func(error)) {
+	config, err := loadConfiguration(vaultConfigFile)
+	if err != nil {
+		err = fmt.Errorf("error loading vault config file %s: %s", vaultConfigFile, err.Error())
+		logrus.Error(err.Error())
+		if report != nil {
+			report(err)
+		}
+		return
+	}
+	configurations <- config
+}
 
+func loadConfiguration(vaultConfigFile string) (*viper.Viper, error) {
 	vaultConfig, err := ioutil.ReadFile(vaultConfigFile)
 	if err != nil {
-		logrus.Fatalf("error reading vault config template: %s", err.Error())
+		return nil, fmt.Errorf("error reading vault config template: %s", err.Error())
 	}
 
-	buffer, err := configuration.EnvTemplate(string(vaultConfig))
+	config, err := readConfiguration(strings.TrimPrefix(filepath.Ext(vaultConfigFile), "."), vaultConfig)
 	if err != nil {
-		logrus.Fatalf("error executing vault config template: %s", err.Error())
+		return nil, err
 	}
 
 	config.SetConfigFile(vaultConfigFile)
 
+	return config, nil
+}
+
+func readConfiguration(configType string, vaultConfig []byte) (*viper.Viper, error) {
+	config := viper.New()
+
+	buffer, err := configuration.EnvTemplate(string(vaultConfig))
+	if err != nil {
+		return nil, fmt.Errorf("error executing vault config template: %s", err.Error())
+	}
+
+	config.SetConfigType(configType)
+
 	err = config.ReadConfig(buffer)
 	if err != nil {
-		logrus.Fatalf("error parsing vault config file: %s", err.Error())
+		return nil, fmt.Errorf("error parsing vault config file: %s", err.Error())
+	}
+
+	err = configuration.ExpandTenants(config)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding tenants in vault config file: %s", err.Error())
+	}
+
+	return config, nil
+}
+
+func showExpandedConfiguration(vaultConfigFile string) {
+	config, err := loadConfiguration(vaultConfigFile)
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
+
+	expanded, err := yaml.Marshal(config.AllSettings())
+	if err != nil {
+		logrus.Fatalf("error marshaling expanded vault config file: %s", err.Error())
 	}
 
-	return config
+	fmt.Printf("# %s\n%s", vaultConfigFile, expanded)
 }
 
 func stringInSlice(list []string, match string) bool {
@@ -244,6 +368,12 @@ func init() {
 	configureCmd.PersistentFlags().Bool(cfgOnce, false, "Run configure only once")
 	configureCmd.PersistentFlags().Bool(cfgFatal, false, "Make configuration errors fatal to the configurator")
 	configureCmd.PersistentFlags().Duration(cfgUnsealPeriod, time.Second*5, "How often to attempt to unseal the Vault instance")
+	configureCmd.PersistentFlags().Duration(cfgRefreshPeriod, 0, "How often to re-apply the configuration files even if they haven't changed (0 means never)")
+	configureCmd.PersistentFlags().Duration(cfgKubeconfigWatchPeriod, 30*time.Second, "How often to check the kubeconfig files and Secrets referenced by the configuration files for changes (0 means never)")
+	configureCmd.PersistentFlags().Bool(cfgShowExpanded, false, "Print the configuration files with the tenants expanded and exit")
+	configureCmd.PersistentFlags().String(cfgAPIAddress, "", "Listen address of the configurer API, e.g. :9092 (disabled if empty)")
+	configureCmd.PersistentFlags().String(cfgAPIToken, "", "Bearer token required to call the configurer API")
+	configureCmd.PersistentFlags().String(cfgListenAddress, ":9091", "Listen address of the metrics endpoint")
 	configureCmd.PersistentFlags().StringSlice(cfgVaultConfigFile, []string{vault.DefaultConfigFile}, "The filename of the YAML/JSON Vault configuration")
 
 	rootCmd.AddCommand(configureCmd)
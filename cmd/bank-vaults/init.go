@@ -23,6 +23,9 @@ import (
 const cfgInitRootToken = "init-root-token"
 const cfgStoreRootToken = "store-root-token"
 const cfgPreFlightChecks = "pre-flight-checks"
+const cfgPGPKeys = "pgp-keys"
+const cfgRootTokenPGPKey = "root-token-pgp-key"
+const cfgPGPKeysOutput = "pgp-keys-output"
 
 var initCmd = &cobra.Command{
 	Use:   "init",
@@ -36,6 +39,9 @@ It will not unseal the Vault instance after initialising.`,
 		appConfig.BindPFlag(cfgInitRootToken, cmd.PersistentFlags().Lookup(cfgInitRootToken))
 		appConfig.BindPFlag(cfgStoreRootToken, cmd.PersistentFlags().Lookup(cfgStoreRootToken))
 		appConfig.BindPFlag(cfgPreFlightChecks, cmd.PersistentFlags().Lookup(cfgPreFlightChecks))
+		appConfig.BindPFlag(cfgPGPKeys, cmd.PersistentFlags().Lookup(cfgPGPKeys))
+		appConfig.BindPFlag(cfgRootTokenPGPKey, cmd.PersistentFlags().Lookup(cfgRootTokenPGPKey))
+		appConfig.BindPFlag(cfgPGPKeysOutput, cmd.PersistentFlags().Lookup(cfgPGPKeysOutput))
 
 		store, err := kvStoreForConfig(appConfig)
 		if err != nil {
@@ -67,6 +73,9 @@ func init() {
 	initCmd.PersistentFlags().String(cfgInitRootToken, "", "root token for the new vault cluster")
 	initCmd.PersistentFlags().Bool(cfgStoreRootToken, true, "should the root token be stored in the key store")
 	initCmd.PersistentFlags().Bool(cfgPreFlightChecks, true, "should the key store be tested first to validate access rights")
+	initCmd.PersistentFlags().StringSlice(cfgPGPKeys, []string{}, "PGP public key files, the last unseal keys are encrypted with them instead of being stored in the key store")
+	initCmd.PersistentFlags().String(cfgRootTokenPGPKey, "", "PGP public key file to encrypt the root token with")
+	initCmd.PersistentFlags().String(cfgPGPKeysOutput, "", "directory to write the PGP encrypted keys to (standard output if empty)")
 
 	rootCmd.AddCommand(initCmd)
 }
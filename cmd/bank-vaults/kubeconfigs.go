@@ -0,0 +1,131 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const cfgKubeconfigWatchPeriod = "kubeconfig-watch-period"
+
+// kubeconfigSource is a kubeconfig referenced by a Kubernetes auth method of a configuration, either a file or a Secret
+type kubeconfigSource struct {
+	file      string
+	namespace string
+	name      string
+}
+
+func (s kubeconfigSource) String() string {
+	if s.file != "" {
+		return s.file
+	}
+	return fmt.Sprintf("secret %s/%s", s.namespace, s.name)
+}
+
+// kubeconfigSources returns the kubeconfigs referenced by the auth methods of the configuration
+func kubeconfigSources(config *viper.Viper) []kubeconfigSource {
+	var sources []kubeconfigSource
+
+	authMethods, err := cast.ToSliceE(config.Get("auth"))
+	if err != nil {
+		return nil
+	}
+
+	for _, authMethod := range authMethods {
+		kubeconfig := cast.ToStringMap(cast.ToStringMap(authMethod)["kubeconfig"])
+		if file := cast.ToString(kubeconfig["file"]); file != "" {
+			sources = append(sources, kubeconfigSource{file: file})
+		} else if secret := cast.ToStringMap(kubeconfig["secret"]); len(secret) > 0 {
+			sources = append(sources, kubeconfigSource{
+				namespace: cast.ToString(secret["namespace"]),
+				name:      cast.ToString(secret["name"]),
+			})
+		}
+	}
+
+	return sources
+}
+
+// kubeconfigVersion returns the resource version of a Secret, or the modification time of a file
+func kubeconfigVersion(client kubernetes.Interface, source kubeconfigSource) (string, error) {
+	if source.file != "" {
+		info, err := os.Stat(source.file)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+	}
+
+	if client == nil {
+		return "", fmt.Errorf("no kubernetes client")
+	}
+
+	secret, err := client.CoreV1().Secrets(source.namespace).Get(source.name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return secret.ResourceVersion, nil
+}
+
+// watchKubeconfigs re-applies a configuration file when a kubeconfig referenced by it changes: the Secrets are
+// checked by their resource version and the files by their modification time every period
+func watchKubeconfigs(vaultConfigFiles []string, configurations chan *viper.Viper, period time.Duration) {
+	client, err := k8sClient()
+	if err != nil {
+		logrus.Warnf("kubeconfig secrets are not watched: %s", err.Error())
+	}
+
+	versions := map[string]string{}
+
+	for {
+		for _, vaultConfigFile := range vaultConfigFiles {
+			config, err := loadConfiguration(vaultConfigFile)
+			if err != nil {
+				logrus.Errorf("error checking kubeconfigs of %s: %s", vaultConfigFile, err.Error())
+				continue
+			}
+
+			changed := false
+			for _, source := range kubeconfigSources(config) {
+				version, err := kubeconfigVersion(client, source)
+				if err != nil {
+					logrus.Errorf("error checking kubeconfig %s of %s: %s", source, vaultConfigFile, err.Error())
+					continue
+				}
+
+				key := vaultConfigFile + "|" + source.String()
+				if previous, ok := versions[key]; ok && previous != version {
+					logrus.Infof("kubeconfig %s has changed, reapplying: %s", source, vaultConfigFile)
+					changed = true
+				}
+				versions[key] = version
+			}
+
+			if changed {
+				configurations <- config
+			}
+		}
+
+		time.Sleep(period)
+	}
+}
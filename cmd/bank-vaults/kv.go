@@ -0,0 +1,293 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgKVFromPrefix = "from-"
+	cfgKVToPrefix   = "to-"
+
+	cfgKVForce        = "force"
+	cfgKVDeleteSource = "delete-source"
+	cfgKVTestUnseal   = "test-unseal"
+)
+
+// kvStoreConfigKeys are the flags which configure the key store in kvStoreForConfig
+var kvStoreConfigKeys = []string{
+	cfgMode,
+	cfgGoogleCloudKMSProject,
+	cfgGoogleCloudKMSLocation,
+	cfgGoogleCloudKMSKeyRing,
+	cfgGoogleCloudKMSCryptoKey,
+	cfgGoogleCloudStorageBucket,
+	cfgGoogleCloudStoragePrefix,
+	cfgAWSKMSRegion,
+	cfgAWSKMSKeyID,
+	cfgAWSS3Bucket,
+	cfgAWSS3Prefix,
+	cfgAWSS3Region,
+	cfgAzureKeyVaultName,
+	cfgAlibabaOSSEndpoint,
+	cfgAlibabaOSSBucket,
+	cfgAlibabaOSSPrefix,
+	cfgAlibabaAccessKeyID,
+	cfgAlibabaAccessKeySecret,
+	cfgAlibabaKMSRegion,
+	cfgAlibabaKMSKeyID,
+	cfgK8SNamespace,
+	cfgK8SSecret,
+	cfgFilePath,
+}
+
+var kvCmd = &cobra.Command{
+	Use:   "kv",
+	Short: "Manages the key stores of the unseal keys and the root token",
+}
+
+var kvMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrates the unseal keys, the recovery keys and the root token from one key store to another",
+	Long: `Copies the unseal keys (vault-unseal-N), the recovery keys (vault-recovery-N) and the root token (vault-root)
+from the source key store to the destination key store, and verifies them by reading them back.
+Every key store flag (e.g. --mode, --k8s-secret-name) is available with a --from- prefix for the source
+and a --to- prefix for the destination key store, e.g.:
+
+  bank-vaults kv migrate --from-mode k8s --from-k8s-secret-name vault-unseal-keys \
+      --to-mode aws-kms-s3 --to-aws-kms-key-id alias/vault --to-aws-s3-bucket vault-keys`,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, key := range kvStoreConfigKeys {
+			appConfig.BindPFlag(cfgKVFromPrefix+key, cmd.Flags().Lookup(cfgKVFromPrefix+key))
+			appConfig.BindPFlag(cfgKVToPrefix+key, cmd.Flags().Lookup(cfgKVToPrefix+key))
+		}
+		appConfig.BindPFlag(cfgKVForce, cmd.Flags().Lookup(cfgKVForce))
+		appConfig.BindPFlag(cfgKVDeleteSource, cmd.Flags().Lookup(cfgKVDeleteSource))
+		appConfig.BindPFlag(cfgKVTestUnseal, cmd.Flags().Lookup(cfgKVTestUnseal))
+
+		force := appConfig.GetBool(cfgKVForce)
+		deleteSource := appConfig.GetBool(cfgKVDeleteSource)
+
+		fromConfig, toConfig := kvStoreConfig(cfgKVFromPrefix), kvStoreConfig(cfgKVToPrefix)
+		if fromConfig.GetString(cfgMode) == "" || toConfig.GetString(cfgMode) == "" {
+			logrus.Fatal("both --from-mode and --to-mode have to be specified")
+		}
+
+		from, err := kvStoreForConfig(fromConfig)
+		if err != nil {
+			logrus.Fatalf("error creating source kv store: %s", err.Error())
+		}
+
+		to, err := kvStoreForConfig(toConfig)
+		if err != nil {
+			logrus.Fatalf("error creating destination kv store: %s", err.Error())
+		}
+
+		deleter, canDelete := from.(kv.Deleter)
+		if deleteSource && !canDelete {
+			logrus.Fatalf("the source kv store (%s) doesn't support deleting keys", fromConfig.GetString(cfgMode))
+		}
+
+		keys, err := kvStoredKeys(from, appConfig.GetInt(cfgSecretShares))
+		if err != nil {
+			logrus.Fatalf("error reading source kv store: %s", err.Error())
+		}
+		if len(keys) == 0 {
+			logrus.Fatal("no unseal keys, recovery keys or root token found in the source kv store")
+		}
+
+		// Check every key first, so nothing is written if any of them would be overwritten
+		if !force {
+			for key := range keys {
+				_, err := to.Get(key)
+				if _, notFound := err.(*kv.NotFoundError); notFound {
+					continue
+				} else if err != nil {
+					logrus.Fatalf("error checking key '%s' in the destination kv store: %s", key, err.Error())
+				}
+				logrus.Fatalf("key '%s' already exists in the destination kv store, use --%s to overwrite it", key, cfgKVForce)
+			}
+		}
+
+		for key, val := range keys {
+			if err := to.Set(key, val); err != nil {
+				logrus.Fatalf("error storing key '%s' in the destination kv store: %s", key, err.Error())
+			}
+
+			stored, err := to.Get(key)
+			if err != nil {
+				logrus.Fatalf("error reading back key '%s' from the destination kv store: %s", key, err.Error())
+			}
+			if !bytes.Equal(stored, val) {
+				logrus.Fatalf("key '%s' read back from the destination kv store differs from the source", key)
+			}
+
+			logrus.WithField("key", key).Info("key migrated")
+		}
+
+		if appConfig.GetBool(cfgKVTestUnseal) {
+			if err := testUnsealProgress(to, keys, appConfig.GetInt(cfgSecretShares)); err != nil {
+				logrus.Fatalf("error testing the migrated unseal key: %s", err.Error())
+			}
+		}
+
+		if deleteSource {
+			for key := range keys {
+				if err := deleter.Delete(key); err != nil {
+					logrus.Fatalf("error deleting key '%s' from the source kv store: %s", key, err.Error())
+				}
+				logrus.WithField("key", key).Info("key deleted from the source kv store")
+			}
+		}
+
+		logrus.Infof("successfully migrated %d keys", len(keys))
+	},
+}
+
+// kvStoreConfig returns the key store configuration given with the prefixed flags, in the form kvStoreForConfig expects
+func kvStoreConfig(prefix string) *viper.Viper {
+	cfg := viper.New()
+	for _, key := range kvStoreConfigKeys {
+		cfg.Set(key, appConfig.GetString(prefix+key))
+	}
+	return cfg
+}
+
+// kvStoredKeys returns the unseal keys, the recovery keys and the root token found in the key store. The keys
+// are looked up at least up to the number of shares, so a missing key (e.g. a PGP encrypted one) doesn't hide
+// the ones after it, and after that until the first missing one.
+func kvStoredKeys(store kv.Service, shares int) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+
+	get := func(key string) (bool, error) {
+		val, err := store.Get(key)
+		if _, notFound := err.(*kv.NotFoundError); notFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		keys[key] = val
+		return true, nil
+	}
+
+	if _, err := get(vault.RootTokenKeyID); err != nil {
+		return nil, err
+	}
+
+	for _, keyForID := range []func(int) string{vault.UnsealKeyID, vault.RecoveryKeyID} {
+		var missing []string
+		for i := 0; ; i++ {
+			found, err := get(keyForID(i))
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				if i >= shares {
+					break
+				}
+				missing = append(missing, keyForID(i))
+			}
+		}
+
+		// the missing keys are reported only if there are keys of this kind at all
+		if len(missing) > 0 && len(missing) < shares {
+			logrus.Warnf("keys %v are missing from the source kv store, the other ones are migrated", missing)
+		}
+	}
+
+	return keys, nil
+}
+
+// testUnsealProgress sends the first migrated unseal key to the sealed Vault, checks that the unseal progress
+// advances, and resets the unseal process afterwards
+func testUnsealProgress(store kv.Service, migrated map[string][]byte, shares int) error {
+	keyID := ""
+	for i := 0; keyID == "" && i < shares+len(migrated); i++ {
+		if _, ok := migrated[vault.UnsealKeyID(i)]; ok {
+			keyID = vault.UnsealKeyID(i)
+		}
+	}
+	if keyID == "" {
+		return fmt.Errorf("no unseal key has been migrated")
+	}
+
+	key, err := store.Get(keyID)
+	if err != nil {
+		return err
+	}
+
+	cl, err := vault.NewRawClient()
+	if err != nil {
+		return err
+	}
+
+	status, err := cl.Sys().SealStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Sealed {
+		logrus.Warn("vault is not sealed, skipping the unseal progress test")
+		return nil
+	}
+
+	resp, err := cl.Sys().Unseal(string(key))
+	if err != nil {
+		return err
+	}
+
+	// With a threshold of 1 the key unseals vault, otherwise the progress is reset
+	if resp.Sealed {
+		if _, err := cl.Sys().ResetUnsealProcess(); err != nil {
+			return err
+		}
+		if resp.Progress <= status.Progress {
+			return fmt.Errorf("the unseal progress of vault didn't advance")
+		}
+	}
+
+	logrus.Info("the migrated unseal key is accepted by vault")
+
+	return nil
+}
+
+// addKVStoreFlags adds every key store flag of the root command with the given prefix, the root flags have
+// to be defined already, so this is called from the init of main.go
+func addKVStoreFlags(cmd *cobra.Command, prefix, name string) {
+	for _, key := range kvStoreConfigKeys {
+		flag := rootCmd.PersistentFlags().Lookup(key)
+		if key == cfgMode {
+			cmd.Flags().String(prefix+key, "", fmt.Sprintf("The mode of the %s key store (see --mode)", name))
+			continue
+		}
+		cmd.Flags().String(prefix+key, flag.DefValue, fmt.Sprintf("%s (%s key store)", flag.Usage, name))
+	}
+}
+
+func init() {
+	kvMigrateCmd.Flags().Bool(cfgKVForce, false, "Overwrite the keys existing in the destination kv store")
+	kvMigrateCmd.Flags().Bool(cfgKVDeleteSource, false, "Delete the keys from the source kv store after the migration")
+	kvMigrateCmd.Flags().Bool(cfgKVTestUnseal, false, "Test the migrated unseal key by checking that it advances the unseal progress of the sealed vault")
+
+	kvCmd.AddCommand(kvMigrateCmd)
+	rootCmd.AddCommand(kvCmd)
+}
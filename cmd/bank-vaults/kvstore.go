@@ -0,0 +1,75 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/banzaicloud/bank-vaults/pkg/notify"
+)
+
+// observedStore measures the latency of the key store operations, and notifies about their errors,
+// except about the missing keys
+type observedStore struct {
+	kv.Service
+	backend string
+}
+
+func (s *observedStore) Get(key string) ([]byte, error) {
+	start := time.Now()
+	val, err := s.Service.Get(key)
+	s.observe("get", key, start, err)
+	return val, err
+}
+
+func (s *observedStore) Set(key string, val []byte) error {
+	start := time.Now()
+	err := s.Service.Set(key, val)
+	s.observe("set", key, start, err)
+	return err
+}
+
+func (s *observedStore) observe(operation, key string, start time.Time, err error) {
+	kvOperationDuration.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+
+	if _, notFound := err.(*kv.NotFoundError); err == nil || notFound {
+		return
+	}
+	kvOperationErrors.WithLabelValues(s.backend, operation).Inc()
+	notifier.Notify(notify.NewEvent(notify.EventKVError, "kv:"+s.backend, fmt.Sprintf("error on %s of key '%s'", operation, key), err))
+}
+
+type observedDeleterStore struct {
+	*observedStore
+	deleter kv.Deleter
+}
+
+func (s *observedDeleterStore) Delete(key string) error {
+	start := time.Now()
+	err := s.deleter.Delete(key)
+	s.observe("delete", key, start, err)
+	return err
+}
+
+// observeKVStore wraps the key store with observedStore, keeping the ability of deleting keys
+func observeKVStore(store kv.Service, backend string) kv.Service {
+	observed := &observedStore{Service: store, backend: backend}
+	if deleter, ok := store.(kv.Deleter); ok {
+		return &observedDeleterStore{observedStore: observed, deleter: deleter}
+	}
+	return observed
+}
@@ -0,0 +1,299 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1beta1client "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaderElector elects a leader among the replicas with client-go's leader election on a coordination.k8s.io
+// Lease: the holder of the Lease renews it every retry period, and the others take it over if it hasn't been
+// renewed for the lease duration
+type leaderElector struct {
+	config leaderelection.LeaderElectionConfig
+	lock   *leaseLock
+	health *loopHealth
+
+	mu     sync.Mutex
+	leader bool
+}
+
+func newLeaderElector(namespace, name string, leaseDuration time.Duration) (*leaderElector, error) {
+	if leaseDuration < time.Second {
+		return nil, fmt.Errorf("the leader election lease duration has to be at least a second")
+	}
+
+	client, err := k8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading namespace of the leader election lease: %s", err.Error())
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %s", err.Error())
+	}
+
+	retryPeriod := leaseDuration / 3
+
+	e := &leaderElector{
+		health: newLoopHealth("leader-election", retryPeriod),
+	}
+	e.lock = &leaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     client.CoordinationV1beta1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		report:     e.health.report,
+	}
+	e.config = leaderelection.LeaderElectionConfig{
+		Lock:          e.lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: leaseDuration * 2 / 3,
+		RetryPeriod:   retryPeriod,
+	}
+
+	return e, nil
+}
+
+func (e *leaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = leader
+}
+
+// run takes part in the election until the context is done, lead is called with a context which is
+// canceled when the leadership is lost, and the Lease is released on return. After losing the leadership
+// the replica takes part in the election again, once lead has returned.
+func (e *leaderElector) run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		leading := make(chan struct{})
+
+		config := e.config
+		config.Callbacks = leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				defer close(leading)
+				e.setLeader(true)
+				logrus.Infof("became the leader (lease %s)", e.lock.Describe())
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				if e.isLeader() {
+					logrus.Warnf("lost the leadership (lease %s)", e.lock.Describe())
+				}
+				e.setLeader(false)
+			},
+		}
+
+		le, err := leaderelection.NewLeaderElector(config)
+		if err != nil {
+			logrus.Fatalf("error configuring leader election: %s", err.Error())
+		}
+
+		// Run returns when the context is done, or the Lease couldn't be renewed, the context of lead is
+		// canceled by then, but lead is called on its own goroutine, so it has to be waited for
+		e.lock.resetAcquired()
+		le.Run(ctx)
+		if e.lock.wasAcquired() {
+			<-leading
+		}
+
+		if ctx.Err() != nil {
+			e.lock.release()
+			return
+		}
+	}
+}
+
+// leaseLock is a resourcelock.Interface on a coordination.k8s.io/v1beta1 Lease, like resourcelock.LeaseLock
+// of newer client-go versions. The outcome of every request is reported to the health of the leader election.
+type leaseLock struct {
+	LeaseMeta  metav1.ObjectMeta
+	Client     coordinationv1beta1client.LeasesGetter
+	LockConfig resourcelock.ResourceLockConfig
+
+	report func(error)
+	lease  *coordinationv1beta1.Lease
+
+	mu       sync.Mutex
+	acquired bool
+}
+
+// Get returns the election record from the Lease spec
+func (l *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	lease, err := l.Client.Leases(l.LeaseMeta.Namespace).Get(l.LeaseMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		l.report(nil)
+		return nil, err
+	}
+	l.report(err)
+	if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	return leaseSpecToLeaderElectionRecord(&lease.Spec), nil
+}
+
+// Create attempts to create the Lease
+func (l *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	lease, err := l.Client.Leases(l.LeaseMeta.Namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.LeaseMeta.Name,
+			Namespace: l.LeaseMeta.Namespace,
+		},
+		Spec: leaderElectionRecordToLeaseSpec(&ler),
+	})
+	return l.updated(lease, ler, err)
+}
+
+// Update updates the spec of the existing Lease
+func (l *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	l.lease.Spec = leaderElectionRecordToLeaseSpec(&ler)
+	lease, err := l.Client.Leases(l.LeaseMeta.Namespace).Update(l.lease)
+	return l.updated(lease, ler, err)
+}
+
+func (l *leaseLock) updated(lease *coordinationv1beta1.Lease, ler resourcelock.LeaderElectionRecord, err error) error {
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		// Someone else has updated the Lease in the meantime, that's how the election works
+		l.report(nil)
+		return err
+	}
+	l.report(err)
+	if err != nil {
+		return err
+	}
+
+	l.lease = lease
+	if ler.HolderIdentity == l.Identity() {
+		l.mu.Lock()
+		l.acquired = true
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// RecordEvent is a no-op, the transitions are logged by the callbacks of the election
+func (l *leaseLock) RecordEvent(string) {}
+
+// Describe returns the namespace and name of the Lease
+func (l *leaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.LeaseMeta.Namespace, l.LeaseMeta.Name)
+}
+
+// Identity returns the identity of this replica
+func (l *leaseLock) Identity() string {
+	return l.LockConfig.Identity
+}
+
+func (l *leaseLock) resetAcquired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acquired = false
+}
+
+// wasAcquired returns true if this replica has held the Lease since the last resetAcquired
+func (l *leaseLock) wasAcquired() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.acquired
+}
+
+// release gives up the Lease if this replica holds it, so another replica can take it over without waiting
+// for it to expire
+func (l *leaseLock) release() {
+	ler, err := l.Get()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logrus.Errorf("error releasing leader election lease: %s", err.Error())
+		}
+		return
+	}
+	if ler.HolderIdentity != l.Identity() {
+		return
+	}
+
+	if err := l.Update(resourcelock.LeaderElectionRecord{LeaderTransitions: ler.LeaderTransitions}); err != nil {
+		logrus.Errorf("error releasing leader election lease: %s", err.Error())
+		return
+	}
+
+	logrus.Infof("released the leadership (lease %s)", l.Describe())
+}
+
+func leaseSpecToLeaderElectionRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	ler := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		ler.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		ler.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		ler.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		ler.AcquireTime = metav1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		ler.RenewTime = metav1.Time{Time: spec.RenewTime.Time}
+	}
+	return ler
+}
+
+func leaderElectionRecordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holderIdentity := ler.HolderIdentity
+	leaseDurationSeconds := int32(ler.LeaseDurationSeconds)
+	leaseTransitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		AcquireTime:          &metav1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &metav1.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &leaseTransitions,
+	}
+}
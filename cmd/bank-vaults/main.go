@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -93,6 +94,21 @@ func configStringVar(key, defaultValue, description string) {
 	appConfig.BindPFlag(key, rootCmd.PersistentFlags().Lookup(key))
 }
 
+func configBoolVar(key string, defaultValue bool, description string) {
+	rootCmd.PersistentFlags().Bool(key, defaultValue, description)
+	appConfig.BindPFlag(key, rootCmd.PersistentFlags().Lookup(key))
+}
+
+func configDurationVar(key string, defaultValue time.Duration, description string) {
+	rootCmd.PersistentFlags().Duration(key, defaultValue, description)
+	appConfig.BindPFlag(key, rootCmd.PersistentFlags().Lookup(key))
+}
+
+func configStringSliceVar(key string, defaultValue []string, description string) {
+	rootCmd.PersistentFlags().StringSlice(key, defaultValue, description)
+	appConfig.BindPFlag(key, rootCmd.PersistentFlags().Lookup(key))
+}
+
 func init() {
 	appConfig = viper.New()
 	appConfig.SetEnvPrefix("bank_vaults")
@@ -167,6 +183,10 @@ func init() {
 
 	// File flags
 	configStringVar(cfgFilePath, "", "The path prefix of the files where to store values in")
+
+	// Key store flags of kv migrate, for the source and the destination
+	addKVStoreFlags(kvMigrateCmd, cfgKVFromPrefix, "source")
+	addKVStoreFlags(kvMigrateCmd, cfgKVToPrefix, "destination")
 }
 
 func main() {
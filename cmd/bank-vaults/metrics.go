@@ -15,6 +15,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
 	"github.com/banzaicloud/bank-vaults/pkg/vault"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +30,8 @@ import (
 
 const prometheusNS = "vault"
 
+const cfgListenAddress = "listen-address"
+
 var (
 	initializedDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(prometheusNS, "sys", "initialized"),
@@ -40,6 +48,21 @@ var (
 		"Is the Vault node the leader.",
 		nil, nil,
 	)
+	targetUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNS, "target", "up"),
+		"Is the unseal target Vault node reachable.",
+		[]string{"target"}, nil,
+	)
+	targetSealedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNS, "target", "sealed"),
+		"Is the unseal target Vault node sealed.",
+		[]string{"target"}, nil,
+	)
+	targetUnsealErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(prometheusNS, "target", "unseal_errors_total"),
+		"Number of failed unseal attempts of the unseal target Vault node.",
+		[]string{"target"}, nil,
+	)
 	successfulConfigurationsCount float64
 	successfulConfigurationsDesc  = prometheus.NewDesc(
 		prometheus.BuildFQName(prometheusNS, "config", "successful"),
@@ -54,17 +77,204 @@ var (
 	)
 )
 
+// The metrics updated directly where the events happen, they are exported in every mode
+var (
+	kvOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNS,
+		Subsystem: "kv",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of the key store operations.",
+	}, []string{"backend", "operation"})
+	kvOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNS,
+		Subsystem: "kv",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed key store operations (except the missing keys).",
+	}, []string{"backend", "operation"})
+	unsealAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNS,
+		Subsystem: "unseal",
+		Name:      "attempts_total",
+		Help:      "Number of attempts to unseal a sealed Vault node.",
+	})
+	unsealFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNS,
+		Subsystem: "unseal",
+		Name:      "failures_total",
+		Help:      "Number of failed attempts to unseal a sealed Vault node by reason.",
+	}, []string{"reason"})
+	configSectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNS,
+		Subsystem: "config",
+		Name:      "section_duration_seconds",
+		Help:      "Time taken to apply the sections of the configuration (auth, policies, secrets...).",
+	}, []string{"section"})
+	configSectionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNS,
+		Subsystem: "config",
+		Name:      "section_errors_total",
+		Help:      "Number of failures to apply the sections of the configuration.",
+	}, []string{"section"})
+	configLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNS,
+		Subsystem: "config",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time of the last successful application of the configuration file.",
+	}, []string{"file"})
+	tlsCertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNS,
+		Subsystem: "tls",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the TLS certificate served by the Vault node.",
+	}, []string{"target"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		kvOperationDuration,
+		kvOperationErrors,
+		unsealAttempts,
+		unsealFailures,
+		configSectionDuration,
+		configSectionErrors,
+		configLastSuccess,
+		tlsCertificateExpiry,
+	)
+}
+
+func observeConfigureSection(section string, duration time.Duration, err error) {
+	configSectionDuration.WithLabelValues(section).Observe(duration.Seconds())
+	if err != nil {
+		configSectionErrors.WithLabelValues(section).Inc()
+	}
+}
+
+// unsealFailureReason classifies the failed unseal attempts for the metrics
+func unsealFailureReason(report *vault.UnsealReport) string {
+	switch {
+	case report == nil:
+		return "status"
+	case len(report.Invalid) > 0:
+		return "invalid_keys"
+	case report.Interrupted > 0:
+		return "interrupted"
+	case len(report.Missing) > 0 || len(report.Duplicate) > 0:
+		return "missing_keys"
+	default:
+		return "error"
+	}
+}
+
+// tlsCertificateCheckInterval is how often the TLS certificate of an address is fetched again, the
+// certificates are valid for weeks, so a handshake on every unseal period would be a waste
+const tlsCertificateCheckInterval = time.Hour
+
+var (
+	tlsCertificateChecksMu sync.Mutex
+	tlsCertificateChecks   = map[string]time.Time{}
+)
+
+// observeTLSCertificateExpiry records the expiry of the TLS certificate served at the Vault address,
+// if it hasn't been fetched in the last tlsCertificateCheckInterval
+func observeTLSCertificateExpiry(address string) {
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme != "https" {
+		return
+	}
+
+	tlsCertificateChecksMu.Lock()
+	if time.Since(tlsCertificateChecks[address]) < tlsCertificateCheckInterval {
+		tlsCertificateChecksMu.Unlock()
+		return
+	}
+	tlsCertificateChecks[address] = time.Now()
+	tlsCertificateChecksMu.Unlock()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	// The certificate is only inspected here, it is verified by the Vault client
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.Host, &tls.Config{InsecureSkipVerify: true}) // nolint:gosec
+	if err != nil {
+		logrus.Debugf("error getting the TLS certificate of %s: %s", address, err.Error())
+
+		// retried on the next call, so the expiry of a node is recorded as soon as it is up
+		tlsCertificateChecksMu.Lock()
+		delete(tlsCertificateChecks, address)
+		tlsCertificateChecksMu.Unlock()
+		return
+	}
+	defer conn.Close()
+
+	if certificates := conn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+		tlsCertificateExpiry.WithLabelValues(address).Set(float64(certificates[0].NotAfter.Unix()))
+	}
+}
+
+// vaultState is the state of the Vault node cached by the unseal loop, so the scrapes don't hit Vault
+type vaultState struct {
+	initialized bool
+	sealed      bool
+	leader      bool
+}
+
 type prometheusExporter struct {
-	Vault vault.Vault
-	Mode  string
+	Vault   vault.Vault
+	Mode    string
+	Targets *unsealTargets
+
+	mu    sync.Mutex
+	state *vaultState
+}
+
+// update refreshes the cached state of the Vault node, it is called by the unseal loop
+func (e *prometheusExporter) update() {
+	initialized, err := e.Vault.Initialized()
+	if err != nil {
+		logrus.Errorf("error checking if vault is initialized: %s", err.Error())
+		return
+	}
+
+	sealed, err := e.Vault.Sealed()
+	if err != nil {
+		logrus.Errorf("error checking if vault is sealed: %s", err.Error())
+		return
+	}
+
+	leader := false
+	if !sealed {
+		leader, err = e.Vault.Leader()
+		if err != nil {
+			logrus.Errorf("error checking if vault is leader: %s", err.Error())
+			return
+		}
+	}
+
+	observeTLSCertificateExpiry(vaultAddress())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = &vaultState{initialized: initialized, sealed: sealed, leader: leader}
+}
+
+// unseal and configure tell which metrics are exported, the serve mode exports both
+func (e *prometheusExporter) unseal() bool {
+	return e.Mode == "unseal" || e.Mode == "serve"
+}
+
+func (e *prometheusExporter) configure() bool {
+	return e.Mode == "configure" || e.Mode == "serve"
 }
 
 func (e *prometheusExporter) Describe(ch chan<- *prometheus.Desc) {
-	if e.Mode == "unseal" {
+	if e.unseal() && e.Targets != nil {
+		ch <- targetUpDesc
+		ch <- targetSealedDesc
+		ch <- targetUnsealErrorsDesc
+	} else if e.unseal() {
 		ch <- initializedDesc
 		ch <- sealedDesc
 		ch <- leaderDesc
-	} else if e.Mode == "configure" {
+	}
+	if e.configure() {
 		ch <- successfulConfigurationsDesc
 		ch <- failedConfigurationsDesc
 	}
@@ -79,29 +289,22 @@ func bToF(b bool) float64 {
 
 func (e *prometheusExporter) Collect(ch chan<- prometheus.Metric) {
 
-	if e.Mode == "unseal" {
-		sealed, err := e.Vault.Sealed()
-		if err != nil {
-			logrus.Errorf("error checking if vault is sealed: %s", err.Error())
-			return
+	if e.unseal() && e.Targets != nil {
+		for target, status := range e.Targets.statuses() {
+			ch <- prometheus.MustNewConstMetric(
+				targetUpDesc, prometheus.GaugeValue, bToF(status.Up), target,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				targetSealedDesc, prometheus.GaugeValue, bToF(status.Sealed), target,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				targetUnsealErrorsDesc, prometheus.CounterValue, status.UnsealErrors, target,
+			)
 		}
-
-		leader, err := e.Vault.Leader()
-		if err != nil {
-			logrus.Errorf("error checking if vault is leader: %s", err.Error())
-			return
-		}
-
-		ch <- prometheus.MustNewConstMetric(
-			initializedDesc, prometheus.GaugeValue, bToF(true),
-		)
-		ch <- prometheus.MustNewConstMetric(
-			sealedDesc, prometheus.GaugeValue, bToF(sealed),
-		)
-		ch <- prometheus.MustNewConstMetric(
-			leaderDesc, prometheus.GaugeValue, bToF(leader),
-		)
-	} else if e.Mode == "configure" {
+	} else if e.unseal() {
+		e.collectVault(ch)
+	}
+	if e.configure() {
 		ch <- prometheus.MustNewConstMetric(
 			successfulConfigurationsDesc, prometheus.GaugeValue, successfulConfigurationsCount,
 		)
@@ -111,13 +314,33 @@ func (e *prometheusExporter) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
-func (e prometheusExporter) Run() {
+func (e *prometheusExporter) collectVault(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	state := e.state
+	e.mu.Unlock()
+
+	// Nothing is known until the first update
+	if state == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		initializedDesc, prometheus.GaugeValue, bToF(state.initialized),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		sealedDesc, prometheus.GaugeValue, bToF(state.sealed),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		leaderDesc, prometheus.GaugeValue, bToF(state.leader),
+	)
+}
+
+func (e *prometheusExporter) Run(address string) {
 	var defaultMetricsPath = "/metrics"
-	var defaultMetricsPort = ":9091"
-	logrus.Infof("vault metrics exporter enabled: %s%s", defaultMetricsPort, defaultMetricsPath)
-	prometheus.MustRegister(&e)
+	logrus.Infof("vault metrics exporter enabled: %s%s", address, defaultMetricsPath)
+	prometheus.MustRegister(e)
 	server := gin.New()
 	server.Use(gin.Logger(), gin.ErrorLogger())
 	server.GET(defaultMetricsPath, gin.WrapH(promhttp.Handler()))
-	server.Run(defaultMetricsPort)
+	server.Run(address)
 }
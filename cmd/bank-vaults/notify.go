@@ -0,0 +1,118 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/notify"
+	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgNotifyWebhookURL   = "notify-webhook-url"
+	cfgNotifyK8SEvents    = "notify-k8s-events"
+	cfgNotifySMTPAddress  = "notify-smtp-address"
+	cfgNotifySMTPUsername = "notify-smtp-username"
+	cfgNotifySMTPPassword = "notify-smtp-password"
+	cfgNotifySMTPFrom     = "notify-smtp-from"
+	cfgNotifySMTPTo       = "notify-smtp-to"
+	cfgNotifyTemplate     = "notify-template"
+	cfgNotifyDedupWindow  = "notify-dedup-window"
+	cfgNotifyRateLimit    = "notify-rate-limit"
+)
+
+// notifier sends the notifications of every command, it is nil (and sends nothing) if no sink is configured
+var notifier *notify.Notifier
+
+func notifierForConfig(cfg *viper.Viper) (*notify.Notifier, error) {
+	sinks := []notify.Sink{}
+
+	if url := cfg.GetString(cfgNotifyWebhookURL); url != "" {
+		sinks = append(sinks, notify.NewWebhookSink(url))
+	}
+
+	if cfg.GetBool(cfgNotifyK8SEvents) {
+		sink, err := notify.NewKubernetesSink()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if address := cfg.GetString(cfgNotifySMTPAddress); address != "" {
+		sink, err := notify.NewSMTPSink(notify.SMTPConfig{
+			Address:  address,
+			Username: cfg.GetString(cfgNotifySMTPUsername),
+			Password: cfg.GetString(cfgNotifySMTPPassword),
+			From:     cfg.GetString(cfgNotifySMTPFrom),
+			To:       cfg.GetStringSlice(cfgNotifySMTPTo),
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	var template []byte
+	if templateFile := cfg.GetString(cfgNotifyTemplate); templateFile != "" {
+		var err error
+		template, err = ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading notification template: %s", err.Error())
+		}
+	}
+
+	return notify.New(sinks, notify.Config{
+		Template:    string(template),
+		DedupWindow: cfg.GetDuration(cfgNotifyDedupWindow),
+		RateLimit:   cfg.GetInt(cfgNotifyRateLimit),
+	})
+}
+
+// vaultAddress returns the address of the Vault instance at VAULT_ADDR, the source of its notifications
+func vaultAddress() string {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return ""
+	}
+	return config.Address
+}
+
+func init() {
+	configStringVar(cfgNotifyWebhookURL, "", "Send notifications (e.g. Vault is sealed) as JSON to this webhook URL")
+	configBoolVar(cfgNotifyK8SEvents, false, "Send notifications as Kubernetes Events on the Vault custom resource (or the Pod)")
+	configStringVar(cfgNotifySMTPAddress, "", "Send notifications in e-mails through this SMTP server (host:port)")
+	configStringVar(cfgNotifySMTPUsername, "", "The username of the SMTP server")
+	configStringVar(cfgNotifySMTPPassword, "", "The password of the SMTP server")
+	configStringVar(cfgNotifySMTPFrom, "", "The sender of the notification e-mails")
+	configStringSliceVar(cfgNotifySMTPTo, []string{}, "The recipients of the notification e-mails")
+	configStringVar(cfgNotifyTemplate, "", "File of the text/template of the notification messages")
+	configDurationVar(cfgNotifyDedupWindow, 10*time.Minute, "How long the same notification is not sent again")
+	configIntVar(cfgNotifyRateLimit, 10, "The maximum number of notifications sent per minute (0 means no limit)")
+
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		var err error
+		notifier, err = notifierForConfig(appConfig)
+		if err != nil {
+			logrus.Fatalf("error creating notifier: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgLeaderElection          = "leader-election"
+	cfgLeaderElectionNamespace = "leader-election-namespace"
+	cfgLeaderElectionName      = "leader-election-name"
+	cfgLeaderElectionDuration  = "leader-election-lease-duration"
+)
+
+var errVaultSealed = errors.New("vault is sealed")
+
+// loopHealth tracks the state of a loop of the serve command for the health endpoints: a loop is live if
+// it has run within three periods (or it is not periodic), and ready if its last run succeeded
+type loopHealth struct {
+	name   string
+	period time.Duration
+
+	mu        sync.Mutex
+	started   time.Time
+	lastRun   time.Time
+	ready     bool
+	lastError string
+}
+
+type loopStatus struct {
+	Live    bool      `json:"live"`
+	Ready   bool      `json:"ready"`
+	LastRun time.Time `json:"lastRun,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newLoopHealth(name string, period time.Duration) *loopHealth {
+	return &loopHealth{name: name, period: period, started: time.Now()}
+}
+
+func (l *loopHealth) report(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastRun = time.Now()
+	l.ready = err == nil
+	l.lastError = ""
+	if err != nil {
+		l.lastError = err.Error()
+	}
+}
+
+func (l *loopHealth) status() loopStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last := l.lastRun
+	if last.IsZero() {
+		last = l.started
+	}
+
+	return loopStatus{
+		Live:    l.period == 0 || time.Since(last) < 3*l.period,
+		Ready:   l.ready,
+		LastRun: l.lastRun,
+		Error:   l.lastError,
+	}
+}
+
+// healthHandler responds with the status of every loop, and 503 if any of them is not live (or ready)
+func healthHandler(loops []*loopHealth, readiness bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		healthy := true
+		statuses := map[string]loopStatus{}
+		for _, loop := range loops {
+			status := loop.status()
+			statuses[loop.name] = status
+			if !status.Live || (readiness && !status.Ready) {
+				healthy = false
+			}
+		}
+
+		code := http.StatusOK
+		if !healthy {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, statuses)
+	}
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Unseals and configures Vault in one process, with metrics and health endpoints",
+	Long: `Runs the unsealer (like unseal) and the configurer (like configure) in one process, with the metrics on
+/metrics, the liveness of the loops on /healthz and their readiness on /readyz. With --leader-election
+only the replica holding the Kubernetes Lease initializes and configures Vault, every replica unseals.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, key := range []string{
+			cfgUnsealPeriod, cfgInit, cfgInitRootToken, cfgStoreRootToken, cfgPreFlightChecks,
+			cfgPGPKeys, cfgRootTokenPGPKey, cfgPGPKeysOutput, cfgAuto, cfgRaftInitPod, cfgMigrate, cfgTargets,
+			cfgVaultConfigFile, cfgRefreshPeriod, cfgKubeconfigWatchPeriod, cfgAPIAddress, cfgAPIToken, cfgListenAddress,
+			cfgLeaderElection, cfgLeaderElectionNamespace, cfgLeaderElectionName, cfgLeaderElectionDuration,
+		} {
+			appConfig.BindPFlag(key, cmd.PersistentFlags().Lookup(key))
+		}
+
+		unsealConfig := unsealConfigForConfig(appConfig)
+		unsealConfig.runOnce = false
+
+		vaultConfigFiles := appConfig.GetStringSlice(cfgVaultConfigFile)
+		refreshPeriod := appConfig.GetDuration(cfgRefreshPeriod)
+		kubeconfigWatchPeriod := appConfig.GetDuration(cfgKubeconfigWatchPeriod)
+		apiAddress := appConfig.GetString(cfgAPIAddress)
+		apiToken := appConfig.GetString(cfgAPIToken)
+
+		v, store, vaultConfig, err := vaultForConfig(appConfig)
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+
+		var targets *unsealTargets
+		if targetList := appConfig.GetStringSlice(cfgTargets); len(targetList) > 0 {
+			targets = newUnsealTargets(targetList, store, vaultConfig)
+		}
+
+		unsealHealth := newLoopHealth("unseal", unsealConfig.unsealPeriod)
+		configureHealth := newLoopHealth("configure", 0)
+		// Not leading is not a reason to take the replica out of service
+		configureHealth.report(nil)
+		loops := []*loopHealth{unsealHealth, configureHealth}
+
+		var elector *leaderElector
+		if appConfig.GetBool(cfgLeaderElection) {
+			elector, err = newLeaderElector(
+				appConfig.GetString(cfgLeaderElectionNamespace),
+				appConfig.GetString(cfgLeaderElectionName),
+				appConfig.GetDuration(cfgLeaderElectionDuration),
+			)
+			if err != nil {
+				logrus.Fatalf("error creating leader elector: %s", err.Error())
+			}
+			loops = append(loops, elector.health)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logrus.Infof("received %s, shutting down", sig)
+			cancel()
+		}()
+
+		metrics := &prometheusExporter{Vault: v, Mode: "serve", Targets: targets}
+		prometheus.MustRegister(metrics)
+
+		router := gin.New()
+		router.Use(gin.Logger(), gin.ErrorLogger())
+		router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+		router.GET("/healthz", healthHandler(loops, false))
+		router.GET("/readyz", healthHandler(loops, true))
+
+		listenAddress := appConfig.GetString(cfgListenAddress)
+		server := &http.Server{Addr: listenAddress, Handler: router}
+		go func() {
+			logrus.Infof("metrics and health endpoints enabled: %s", listenAddress)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Fatalf("error serving metrics and health endpoints: %s", err.Error())
+			}
+		}()
+
+		configurer := newConfigurer(v)
+		configurations := make(chan *viper.Viper, len(vaultConfigFiles))
+		for i, vaultConfigFile := range vaultConfigFiles {
+			vaultConfigFiles[i] = filepath.Clean(vaultConfigFile)
+		}
+
+		if apiAddress != "" {
+			if apiToken == "" {
+				logrus.Fatalf("the configurer API requires a token, set it with --%s or BANK_VAULTS_API_TOKEN", cfgAPIToken)
+			}
+			api := configurerAPI{configurer: configurer, token: apiToken, vaultConfigFiles: vaultConfigFiles}
+			if elector != nil {
+				api.isLeader = elector.isLeader
+			}
+			go api.Run(apiAddress)
+		}
+
+		go watchConfigurations(vaultConfigFiles, configurations, configureHealth.report)
+		if refreshPeriod > 0 {
+			go refreshConfigurations(vaultConfigFiles, configurations, refreshPeriod, configureHealth.report)
+		}
+		if kubeconfigWatchPeriod > 0 {
+			go watchKubeconfigs(vaultConfigFiles, configurations, kubeconfigWatchPeriod)
+		}
+
+		// lead initializes Vault and applies every configuration when becoming the leader, then the changed ones
+		lead := func(ctx context.Context) {
+			if unsealConfig.proceedInit {
+				if err := initVault(v); err != nil {
+					logrus.Error(err.Error())
+					configureHealth.report(err)
+				}
+			}
+
+			go func() {
+				for _, vaultConfigFile := range vaultConfigFiles {
+					config, err := loadConfiguration(vaultConfigFile)
+					if err != nil {
+						logrus.Errorf("error loading vault config file %s: %s", vaultConfigFile, err.Error())
+						configureHealth.report(err)
+						continue
+					}
+					select {
+					case configurations <- config:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+
+			applyConfigurations(ctx, v, configurer, configurations, unsealConfig.unsealPeriod, false, configureHealth.report)
+
+			configureHealth.report(nil)
+		}
+
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runUnsealLoop(ctx, unsealConfig, v, targets, metrics, unsealHealth)
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if elector != nil {
+				elector.run(ctx, lead)
+			} else {
+				lead(ctx)
+			}
+		}()
+
+		wg.Wait()
+
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelShutdown()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("error shutting down metrics and health endpoints: %s", err.Error())
+		}
+
+		logrus.Info("bank-vaults stopped")
+	},
+}
+
+// runUnsealLoop runs the unsealer every unseal period until the context is done
+func runUnsealLoop(ctx context.Context, unsealConfig unsealCfg, v vault.Vault, targets *unsealTargets, metrics *prometheusExporter, health *loopHealth) {
+	for {
+		err := unsealStep(unsealConfig, v, targets)
+		if targets == nil {
+			metrics.update()
+		}
+		if err != nil {
+			logrus.Error(err.Error())
+		} else if targets == nil {
+			// Vault is ready if it is unsealed, which is the job of Vault itself in auto-unseal mode
+			var sealed bool
+			if sealed, err = v.Sealed(); err == nil && sealed {
+				err = errVaultSealed
+			}
+		}
+		health.report(err)
+
+		if !sleepContext(ctx, unsealConfig.unsealPeriod) {
+			return
+		}
+	}
+}
+
+func init() {
+	serveCmd.PersistentFlags().Duration(cfgUnsealPeriod, time.Second*5, "How often to attempt to unseal the vault instance")
+	serveCmd.PersistentFlags().Bool(cfgInit, false, "Initialize vault instance if not yet initialized")
+	serveCmd.PersistentFlags().String(cfgInitRootToken, "", "Root token for the new vault cluster (only if -init=true)")
+	serveCmd.PersistentFlags().Bool(cfgStoreRootToken, true, "Should the root token be stored in the key store (only if -init=true)")
+	serveCmd.PersistentFlags().Bool(cfgPreFlightChecks, true, "should the key store be tested first to validate access rights")
+	serveCmd.PersistentFlags().StringSlice(cfgPGPKeys, []string{}, "PGP public key files, the last unseal keys are encrypted with them instead of being stored in the key store (only if -init=true)")
+	serveCmd.PersistentFlags().String(cfgRootTokenPGPKey, "", "PGP public key file to encrypt the root token with (only if -init=true)")
+	serveCmd.PersistentFlags().String(cfgPGPKeysOutput, "", "directory to write the PGP encrypted keys to, standard output if empty (only if -init=true)")
+	serveCmd.PersistentFlags().Bool(cfgAuto, false, "Run in auto-unseal mode")
+	serveCmd.PersistentFlags().Bool(cfgMigrate, false, "Migrate the seal of vault (Shamir to auto-unseal or back) with the stored keys, if vault has been started with a seal migration pending")
+	serveCmd.PersistentFlags().StringSlice(cfgTargets, []string{}, "Unseal every Vault instance of these targets (addresses, srv://<name> DNS SRV records or k8s://<namespace>/<vault-name> per instance Services) instead of VAULT_ADDR")
+	serveCmd.PersistentFlags().String(cfgRaftInitPod, "", "With Raft storage only the Pod with this hostname initializes Vault (only if -init=true)")
+	serveCmd.PersistentFlags().StringSlice(cfgVaultConfigFile, []string{vault.DefaultConfigFile}, "The filename of the YAML/JSON Vault configuration")
+	serveCmd.PersistentFlags().Duration(cfgRefreshPeriod, 0, "How often to re-apply the configuration files even if they haven't changed (0 means never)")
+	serveCmd.PersistentFlags().Duration(cfgKubeconfigWatchPeriod, 30*time.Second, "How often to check the kubeconfig files and Secrets referenced by the configuration files for changes (0 means never)")
+	serveCmd.PersistentFlags().String(cfgAPIAddress, "", "Listen address of the configurer API, e.g. :9092 (disabled if empty)")
+	serveCmd.PersistentFlags().String(cfgAPIToken, "", "Bearer token required to call the configurer API")
+	serveCmd.PersistentFlags().String(cfgListenAddress, ":9091", "Listen address of the metrics and health endpoints")
+	serveCmd.PersistentFlags().Bool(cfgLeaderElection, false, "Elect a leader with a Kubernetes Lease, only the leader initializes and configures Vault")
+	serveCmd.PersistentFlags().String(cfgLeaderElectionNamespace, "", "Namespace of the leader election Lease (the namespace of the Pod if empty)")
+	serveCmd.PersistentFlags().String(cfgLeaderElectionName, "bank-vaults", "Name of the leader election Lease")
+	serveCmd.PersistentFlags().Duration(cfgLeaderElectionDuration, 15*time.Second, "How long the leader election Lease is valid without being renewed")
+
+	rootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,304 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/banzaicloud/bank-vaults/pkg/kv/envelope"
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/hashicorp/vault/api"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgSnapshotPrefix     = "snapshot-prefix"
+	cfgSnapshotSchedule   = "schedule"
+	cfgSnapshotKeepDaily  = "keep-daily"
+	cfgSnapshotKeepWeekly = "keep-weekly"
+	cfgSnapshotName       = "snapshot"
+	cfgSnapshotForce      = "force"
+
+	snapshotTimeFormat = "20060102T150405Z"
+)
+
+type snapshotInfo struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Saves and restores snapshots of Vault's Raft storage",
+	Long: `Saves snapshots of Vault's integrated Raft storage into one of the object storage based modes
+(Google Cloud Storage, AWS S3, Alibaba OSS or File), and restores them. With the KMS based modes the snapshots
+are encrypted with a random data key, which is stored encrypted by the KMS next to the snapshot.
+The Vault token is read from the VAULT_TOKEN environment variable.`,
+}
+
+var snapshotSaveCmd = &cobra.Command{
+	Use:   "save",
+	Short: "Saves a snapshot of Vault's Raft storage, once or periodically",
+	Run: func(cmd *cobra.Command, args []string) {
+		appConfig.BindPFlag(cfgSnapshotPrefix, cmd.Flags().Lookup(cfgSnapshotPrefix))
+		appConfig.BindPFlag(cfgSnapshotSchedule, cmd.Flags().Lookup(cfgSnapshotSchedule))
+		appConfig.BindPFlag(cfgSnapshotKeepDaily, cmd.Flags().Lookup(cfgSnapshotKeepDaily))
+		appConfig.BindPFlag(cfgSnapshotKeepWeekly, cmd.Flags().Lookup(cfgSnapshotKeepWeekly))
+
+		prefix := appConfig.GetString(cfgSnapshotPrefix)
+		schedule := appConfig.GetString(cfgSnapshotSchedule)
+		keepDaily := appConfig.GetInt(cfgSnapshotKeepDaily)
+		keepWeekly := appConfig.GetInt(cfgSnapshotKeepWeekly)
+
+		store, err := snapshotStoreForConfig(appConfig)
+		if err != nil {
+			logrus.Fatalf("error creating snapshot store: %s", err.Error())
+		}
+
+		cl, err := vault.NewRawClient()
+		if err != nil {
+			logrus.Fatalf("error connecting to vault: %s", err.Error())
+		}
+
+		if schedule == "" {
+			if err := saveSnapshot(cl, store, prefix, keepDaily, keepWeekly); err != nil {
+				logrus.Fatalf("error saving snapshot: %s", err.Error())
+			}
+			return
+		}
+
+		cronSchedule, err := cron.ParseStandard(schedule)
+		if err != nil {
+			logrus.Fatalf("error parsing schedule: %s", err.Error())
+		}
+
+		for {
+			next := cronSchedule.Next(time.Now())
+			logrus.Infof("next snapshot at %s", next.Format(time.RFC3339))
+			time.Sleep(time.Until(next))
+
+			if err := saveSnapshot(cl, store, prefix, keepDaily, keepWeekly); err != nil {
+				logrus.Errorf("error saving snapshot: %s", err.Error())
+			}
+		}
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restores Vault's Raft storage from a snapshot",
+	Run: func(cmd *cobra.Command, args []string) {
+		appConfig.BindPFlag(cfgSnapshotPrefix, cmd.Flags().Lookup(cfgSnapshotPrefix))
+		appConfig.BindPFlag(cfgSnapshotName, cmd.Flags().Lookup(cfgSnapshotName))
+		appConfig.BindPFlag(cfgSnapshotForce, cmd.Flags().Lookup(cfgSnapshotForce))
+
+		prefix := appConfig.GetString(cfgSnapshotPrefix)
+		key := appConfig.GetString(cfgSnapshotName)
+
+		store, err := snapshotStoreForConfig(appConfig)
+		if err != nil {
+			logrus.Fatalf("error creating snapshot store: %s", err.Error())
+		}
+
+		if key == "" {
+			snapshots, err := snapshotIndex(store, prefix)
+			if err != nil {
+				logrus.Fatalf("error reading snapshot index: %s", err.Error())
+			}
+			if len(snapshots) == 0 {
+				logrus.Fatal("there are no snapshots to restore")
+			}
+			key = snapshots[len(snapshots)-1].Key
+		}
+
+		snapshot, err := store.Get(key)
+		if err != nil {
+			logrus.Fatalf("error reading snapshot: %s", err.Error())
+		}
+
+		cl, err := vault.NewRawClient()
+		if err != nil {
+			logrus.Fatalf("error connecting to vault: %s", err.Error())
+		}
+
+		logrus.Infof("restoring snapshot %s", key)
+		if err := vault.RaftSnapshotRestore(cl, bytes.NewReader(snapshot), appConfig.GetBool(cfgSnapshotForce)); err != nil {
+			logrus.Fatalf("error restoring snapshot: %s", err.Error())
+		}
+
+		logrus.Info("successfully restored snapshot")
+	},
+}
+
+// snapshotStoreForConfig returns the store of the snapshots, the KMS services can encrypt only small values,
+// so the snapshots are envelope encrypted with the KMS based modes
+func snapshotStoreForConfig(cfg *viper.Viper) (kv.Service, error) {
+	store, err := objectStoreForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.GetString(cfgMode) == cfgModeValueFile {
+		return store, nil
+	}
+
+	kms, err := kmsStoreForConfig(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.New(store, kms), nil
+}
+
+func saveSnapshot(cl *api.Client, store kv.Service, prefix string, keepDaily, keepWeekly int) error {
+	now := time.Now().UTC()
+	key := prefix + now.Format(snapshotTimeFormat)
+
+	// the snapshot is streamed into the store, without holding it in memory
+	err := kv.SetStream(store, key, func(w io.Writer) error {
+		return vault.RaftSnapshot(cl, w)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing snapshot: %s", err.Error())
+	}
+
+	logrus.Infof("snapshot saved: %s", key)
+
+	snapshots, err := snapshotIndex(store, prefix)
+	if err != nil {
+		return err
+	}
+
+	snapshots = append(snapshots, snapshotInfo{Key: key, Time: now})
+	retained := retainSnapshots(snapshots, keepDaily, keepWeekly)
+
+	deleter, canDelete := store.(kv.Deleter)
+	for _, snapshot := range snapshots {
+		if retained[snapshot.Key] {
+			continue
+		}
+		if !canDelete {
+			logrus.Warnf("the snapshot store doesn't support deleting, keeping expired snapshot %s", snapshot.Key)
+			retained[snapshot.Key] = true
+			continue
+		}
+		if err := deleter.Delete(snapshot.Key); err != nil {
+			logrus.Errorf("error deleting expired snapshot %s: %s", snapshot.Key, err.Error())
+			retained[snapshot.Key] = true
+			continue
+		}
+		logrus.Infof("expired snapshot deleted: %s", snapshot.Key)
+	}
+
+	index := []snapshotInfo{}
+	for _, snapshot := range snapshots {
+		if retained[snapshot.Key] {
+			index = append(index, snapshot)
+		}
+	}
+
+	return setSnapshotIndex(store, prefix, index)
+}
+
+// retainSnapshots returns the snapshots to keep: the last one of each of the last keepDaily days and of each
+// of the last keepWeekly weeks, every snapshot is kept if neither is set
+func retainSnapshots(snapshots []snapshotInfo, keepDaily, keepWeekly int) map[string]bool {
+	retained := map[string]bool{}
+
+	sorted := append([]snapshotInfo{}, snapshots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for _, snapshot := range sorted {
+		if keepDaily == 0 && keepWeekly == 0 {
+			retained[snapshot.Key] = true
+			continue
+		}
+
+		t := snapshot.Time.UTC()
+		day := t.Format("2006-01-02")
+		year, week := t.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			retained[snapshot.Key] = true
+		}
+		if !weeks[weekKey] && len(weeks) < keepWeekly {
+			weeks[weekKey] = true
+			retained[snapshot.Key] = true
+		}
+	}
+
+	return retained
+}
+
+// The snapshots are tracked in an index, since the kv stores can't list their keys
+func snapshotIndex(store kv.Service, prefix string) ([]snapshotInfo, error) {
+	snapshots := []snapshotInfo{}
+
+	index, err := store.Get(prefix + "index")
+	if _, notFound := err.(*kv.NotFoundError); notFound {
+		return snapshots, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading snapshot index: %s", err.Error())
+	}
+
+	if err := json.Unmarshal(index, &snapshots); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot index: %s", err.Error())
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+
+	return snapshots, nil
+}
+
+func setSnapshotIndex(store kv.Service, prefix string, snapshots []snapshotInfo) error {
+	index, err := json.Marshal(snapshots)
+	if err != nil {
+		return fmt.Errorf("error marshaling snapshot index: %s", err.Error())
+	}
+
+	if err := store.Set(prefix+"index", index); err != nil {
+		return fmt.Errorf("error storing snapshot index: %s", err.Error())
+	}
+
+	return nil
+}
+
+func init() {
+	snapshotSaveCmd.Flags().String(cfgSnapshotPrefix, "vault-raft-snapshot-", "The prefix of the snapshot keys in the store")
+	snapshotSaveCmd.Flags().String(cfgSnapshotSchedule, "", "Cron schedule of the snapshots, e.g. '0 2 * * *' (if empty a single snapshot is saved)")
+	snapshotSaveCmd.Flags().Int(cfgSnapshotKeepDaily, 0, "Keep the last snapshot of this many days (0 and no --keep-weekly keeps every snapshot)")
+	snapshotSaveCmd.Flags().Int(cfgSnapshotKeepWeekly, 0, "Keep the last snapshot of this many weeks")
+
+	snapshotRestoreCmd.Flags().String(cfgSnapshotPrefix, "vault-raft-snapshot-", "The prefix of the snapshot keys in the store")
+	snapshotRestoreCmd.Flags().String(cfgSnapshotName, "", "The key of the snapshot to restore (the latest one if empty)")
+	snapshotRestoreCmd.Flags().Bool(cfgSnapshotForce, false, "Restore a snapshot of a different cluster (with different unseal keys)")
+
+	snapshotCmd.AddCommand(snapshotSaveCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
@@ -0,0 +1,281 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/banzaicloud/bank-vaults/pkg/notify"
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const cfgTargets = "targets"
+
+const (
+	targetSchemeSRV = "srv"
+	targetSchemeK8S = "k8s"
+
+	// The label of the per instance Services created by the operator
+	statefulSetPodNameLabel = "statefulset.kubernetes.io/pod-name"
+)
+
+type targetStatus struct {
+	Up           bool
+	Sealed       bool
+	UnsealErrors float64
+}
+
+// unsealTargets unseals every discovered Vault instance with the same key store, instead of only
+// the one at VAULT_ADDR, and keeps track of their status for the metrics
+type unsealTargets struct {
+	targets     []string
+	store       kv.Service
+	vaultConfig vault.Config
+
+	mu     sync.Mutex
+	status map[string]*targetStatus
+}
+
+func newUnsealTargets(targets []string, store kv.Service, vaultConfig vault.Config) *unsealTargets {
+	return &unsealTargets{
+		targets:     targets,
+		store:       store,
+		vaultConfig: vaultConfig,
+		status:      map[string]*targetStatus{},
+	}
+}
+
+// unseal checks the seal status of every target in parallel, and unseals the sealed ones
+func (u *unsealTargets) unseal(unsealConfig unsealCfg) error {
+	addresses, err := discoverTargets(u.targets)
+	if err != nil {
+		return fmt.Errorf("error discovering vault instances: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	failed := 0
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if err := u.unsealTarget(unsealConfig, address); err != nil {
+				logrus.WithField("target", address).Errorf("error unsealing vault: %s", err.Error())
+				u.mu.Lock()
+				failed++
+				u.mu.Unlock()
+			}
+		}(address)
+	}
+	wg.Wait()
+
+	u.forget(addresses)
+
+	if failed > 0 {
+		return fmt.Errorf("error unsealing %d of the %d vault instances", failed, len(addresses))
+	}
+
+	return nil
+}
+
+func (u *unsealTargets) unsealTarget(unsealConfig unsealCfg, address string) error {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return config.Error
+	}
+	config.Address = address
+
+	cl, err := api.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("error creating vault client: %s", err.Error())
+	}
+
+	v, err := vault.New(u.store, cl, u.vaultConfig)
+	if err != nil {
+		return fmt.Errorf("error creating vault helper: %s", err.Error())
+	}
+
+	status := targetStatus{}
+	defer u.setStatus(address, &status)
+
+	sealed, err := v.Sealed()
+	if err != nil {
+		return err
+	}
+	status.Up = true
+	status.Sealed = sealed
+
+	observeTLSCertificateExpiry(address)
+
+	if sealed && unsealConfig.migrate {
+		migration, err := v.SealMigration()
+		if err != nil {
+			return fmt.Errorf("error checking vault seal migration: %s", err.Error())
+		}
+		if migration {
+			logrus.WithField("target", address).Info("vault seal migration is pending, migrating")
+
+			unsealAttempts.Inc()
+			if err := v.MigrateSeal(); err != nil {
+				status.UnsealErrors++
+				unsealFailures.WithLabelValues("migrate").Inc()
+				return fmt.Errorf("error migrating vault seal: %s", err.Error())
+			}
+			status.Sealed = false
+
+			logrus.WithField("target", address).Info("successfully migrated vault seal")
+			return nil
+		}
+	}
+
+	if !sealed || unsealConfig.auto {
+		return nil
+	}
+
+	logrus.WithField("target", address).Info("vault is sealed, unsealing")
+	notifier.Notify(notify.NewEvent(notify.EventSealed, address, "vault is sealed", nil))
+
+	unsealAttempts.Inc()
+	report, err := v.Unseal()
+	if err != nil {
+		status.UnsealErrors++
+		unsealFailures.WithLabelValues(unsealFailureReason(report)).Inc()
+		notifier.Notify(notify.NewEvent(notify.EventUnsealFailed, address, "error unsealing vault", err))
+		return err
+	}
+	status.Sealed = false
+
+	logUnsealReport(logrus.WithField("target", address), report)
+	notifier.Notify(notify.NewEvent(notify.EventUnsealed, address, "vault has been unsealed", nil))
+
+	return nil
+}
+
+func (u *unsealTargets) setStatus(address string, status *targetStatus) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if previous, ok := u.status[address]; ok {
+		status.UnsealErrors += previous.UnsealErrors
+	}
+	u.status[address] = status
+}
+
+// forget drops the status of the targets which are gone, e.g. after a scale down
+func (u *unsealTargets) forget(addresses []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	current := map[string]bool{}
+	for _, address := range addresses {
+		current[address] = true
+	}
+	for address := range u.status {
+		if !current[address] {
+			delete(u.status, address)
+		}
+	}
+}
+
+func (u *unsealTargets) statuses() map[string]targetStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	statuses := make(map[string]targetStatus, len(u.status))
+	for address, status := range u.status {
+		statuses[address] = *status
+	}
+	return statuses
+}
+
+// discoverTargets resolves the targets to Vault addresses, a target can be:
+// - a Vault address, e.g. https://vault-0.vault:8200
+// - srv://<name>, the targets of the DNS SRV record of name
+// - k8s://<namespace>/<vault-name>, the per instance Services of the Vault custom resource
+// The SRV and Kubernetes targets use the scheme of VAULT_ADDR.
+func discoverTargets(targets []string) ([]string, error) {
+	scheme := "https"
+	if vaultAddr, err := url.Parse(os.Getenv(api.EnvVaultAddress)); err == nil && vaultAddr.Scheme != "" {
+		scheme = vaultAddr.Scheme
+	}
+
+	addresses := []string{}
+	for _, target := range targets {
+		switch {
+		case strings.HasPrefix(target, targetSchemeSRV+"://"):
+			_, records, err := net.LookupSRV("", "", strings.TrimPrefix(target, targetSchemeSRV+"://"))
+			if err != nil {
+				return nil, fmt.Errorf("error looking up SRV record of target '%s': %s", target, err.Error())
+			}
+			for _, record := range records {
+				addresses = append(addresses, fmt.Sprintf("%s://%s:%d", scheme, strings.TrimSuffix(record.Target, "."), record.Port))
+			}
+
+		case strings.HasPrefix(target, targetSchemeK8S+"://"):
+			services, err := perInstanceServices(strings.TrimPrefix(target, targetSchemeK8S+"://"))
+			if err != nil {
+				return nil, fmt.Errorf("error listing services of target '%s': %s", target, err.Error())
+			}
+			for _, service := range services {
+				addresses = append(addresses, fmt.Sprintf("%s://%s:8200", scheme, service))
+			}
+
+		default:
+			addresses = append(addresses, target)
+		}
+	}
+
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+// perInstanceServices returns the names (in <name>.<namespace> form) of the per instance Services
+// of a Vault custom resource, target is <namespace>/<vault-name>
+func perInstanceServices(target string) ([]string, error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("kubernetes targets have to be in k8s://<namespace>/<vault-name> form")
+	}
+	namespace, name := parts[0], parts[1]
+
+	client, err := k8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := client.CoreV1().Services(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=vault,vault_cr=%s,%s", name, statefulSetPodNameLabel),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, service := range services.Items {
+		names = append(names, service.Name+"."+service.Namespace)
+	}
+
+	return names, nil
+}
@@ -15,24 +15,30 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/banzaicloud/bank-vaults/pkg/notify"
 	"github.com/banzaicloud/bank-vaults/pkg/vault"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 const cfgUnsealPeriod = "unseal-period"
 const cfgInit = "init"
 const cfgOnce = "once"
 const cfgAuto = "auto"
+const cfgRaftInitPod = "raft-init-pod"
+const cfgMigrate = "migrate"
 
 type unsealCfg struct {
 	unsealPeriod time.Duration
 	proceedInit  bool
 	runOnce      bool
 	auto         bool
+	migrate      bool
 }
 
 var unsealCmd = &cobra.Command{
@@ -52,48 +58,52 @@ from one of the followings:
 		appConfig.BindPFlag(cfgInitRootToken, cmd.PersistentFlags().Lookup(cfgInitRootToken))
 		appConfig.BindPFlag(cfgStoreRootToken, cmd.PersistentFlags().Lookup(cfgStoreRootToken))
 		appConfig.BindPFlag(cfgPreFlightChecks, cmd.PersistentFlags().Lookup(cfgPreFlightChecks))
+		appConfig.BindPFlag(cfgPGPKeys, cmd.PersistentFlags().Lookup(cfgPGPKeys))
+		appConfig.BindPFlag(cfgRootTokenPGPKey, cmd.PersistentFlags().Lookup(cfgRootTokenPGPKey))
+		appConfig.BindPFlag(cfgPGPKeysOutput, cmd.PersistentFlags().Lookup(cfgPGPKeysOutput))
 		appConfig.BindPFlag(cfgAuto, cmd.PersistentFlags().Lookup(cfgAuto))
+		appConfig.BindPFlag(cfgRaftInitPod, cmd.PersistentFlags().Lookup(cfgRaftInitPod))
+		appConfig.BindPFlag(cfgMigrate, cmd.PersistentFlags().Lookup(cfgMigrate))
+		appConfig.BindPFlag(cfgTargets, cmd.PersistentFlags().Lookup(cfgTargets))
+		appConfig.BindPFlag(cfgListenAddress, cmd.PersistentFlags().Lookup(cfgListenAddress))
 
-		var unsealConfig unsealCfg
+		unsealConfig := unsealConfigForConfig(appConfig)
 
-		unsealConfig.unsealPeriod = appConfig.GetDuration(cfgUnsealPeriod)
-		unsealConfig.proceedInit = appConfig.GetBool(cfgInit)
-		unsealConfig.runOnce = appConfig.GetBool(cfgOnce)
-		unsealConfig.auto = appConfig.GetBool(cfgAuto)
-
-		store, err := kvStoreForConfig(appConfig)
-		if err != nil {
-			logrus.Fatalf("error creating kv store: %s", err.Error())
-		}
-
-		cl, err := vault.NewRawClient()
+		v, store, vaultConfig, err := vaultForConfig(appConfig)
 		if err != nil {
-			logrus.Fatalf("error connecting to vault: %s", err.Error())
+			logrus.Fatal(err.Error())
 		}
 
-		vaultConfig, err := vaultConfigForConfig(appConfig)
-		if err != nil {
-			logrus.Fatalf("error building vault config: %s", err.Error())
-		}
+		metrics := &prometheusExporter{Vault: v, Mode: "unseal"}
 
-		v, err := vault.New(store, cl, vaultConfig)
-		if err != nil {
-			logrus.Fatalf("error creating vault helper: %s", err.Error())
+		// With targets every discovered Vault instance is unsealed, not just the one at VAULT_ADDR
+		var targets *unsealTargets
+		if targetList := appConfig.GetStringSlice(cfgTargets); len(targetList) > 0 {
+			targets = newUnsealTargets(targetList, store, vaultConfig)
+			metrics.Targets = targets
 		}
 
-		metrics := prometheusExporter{Vault: v, Mode: "unseal"}
-		go metrics.Run()
+		go metrics.Run(appConfig.GetString(cfgListenAddress))
 
 		if unsealConfig.proceedInit {
-			logrus.Info("initializing vault...")
-			if err := v.Init(); err != nil {
-				logrus.Fatalf("error initializing vault: %s", err.Error())
+			if err := initVault(v); err != nil {
+				logrus.Fatal(err.Error())
 			}
 		}
 
 		for {
-			if !unsealConfig.auto {
-				unseal(unsealConfig, v)
+			if targets != nil || unsealConfig.migrate || !unsealConfig.auto {
+				if err := unsealStep(unsealConfig, v, targets); err != nil {
+					logrus.Error(err.Error())
+					exitIfNecessary(unsealConfig, 1)
+				} else {
+					exitIfNecessary(unsealConfig, 0)
+				}
+			}
+
+			// The metrics are served from the state cached here, so the scrapes don't hit Vault
+			if targets == nil {
+				metrics.update()
 			}
 
 			// wait unsealPeriod before trying again
@@ -102,33 +112,122 @@ from one of the followings:
 	},
 }
 
-func unseal(unsealConfig unsealCfg, v vault.Vault) {
+// unsealConfigForConfig returns the unsealer configuration, with Raft storage only the Pod given
+// with --raft-init-pod may initialize Vault
+func unsealConfigForConfig(cfg *viper.Viper) unsealCfg {
+	unsealConfig := unsealCfg{
+		unsealPeriod: cfg.GetDuration(cfgUnsealPeriod),
+		proceedInit:  cfg.GetBool(cfgInit),
+		runOnce:      cfg.GetBool(cfgOnce),
+		auto:         cfg.GetBool(cfgAuto),
+		migrate:      cfg.GetBool(cfgMigrate),
+	}
+
+	// With Raft storage every Vault instance has its own storage, so only one of them may initialize
+	// Vault, the others join it (see retry_join) and get unsealed with the same keys
+	if raftInitPod := cfg.GetString(cfgRaftInitPod); unsealConfig.proceedInit && raftInitPod != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logrus.Fatalf("error getting hostname: %s", err.Error())
+		}
+		if hostname != raftInitPod {
+			logrus.Infof("vault will be initialized by %s, this instance joins it", raftInitPod)
+			unsealConfig.proceedInit = false
+		}
+	}
+
+	return unsealConfig
+}
+
+// unsealStep runs one round of the unsealer: unseals every target (migrating their seal if it is pending),
+// or migrates the seal of Vault, or unseals Vault, depending on the mode
+func unsealStep(unsealConfig unsealCfg, v vault.Vault, targets *unsealTargets) error {
+	switch {
+	case targets != nil:
+		return targets.unseal(unsealConfig)
+	case unsealConfig.migrate:
+		return migrateSeal(v)
+	case !unsealConfig.auto:
+		return unseal(v)
+	default:
+		return nil
+	}
+}
+
+// initVault initializes Vault if it is not initialized yet
+func initVault(v vault.Vault) error {
+	initialized, err := v.Initialized()
+	if err != nil {
+		return err
+	}
+
+	logrus.Info("initializing vault...")
+	if err := v.Init(); err != nil {
+		return fmt.Errorf("error initializing vault: %s", err.Error())
+	}
+
+	if !initialized {
+		notifier.Notify(notify.NewEvent(notify.EventInitialized, vaultAddress(), "vault has been initialized", nil))
+	}
+
+	return nil
+}
+
+func unseal(v vault.Vault) error {
 	logrus.Debug("checking if vault is sealed...")
 	sealed, err := v.Sealed()
 	if err != nil {
-		logrus.Errorf("error checking if vault is sealed: %s", err.Error())
-		exitIfNecessary(unsealConfig, 1)
-		return
+		return fmt.Errorf("error checking if vault is sealed: %s", err.Error())
 	}
 
 	// If vault is not sealed, we stop here and wait another unsealPeriod
 	if !sealed {
 		logrus.Debug("vault is not sealed")
-		exitIfNecessary(unsealConfig, 0)
-		return
+		return nil
 	}
 
 	logrus.Info("vault is sealed, unsealing")
+	notifier.Notify(notify.NewEvent(notify.EventSealed, vaultAddress(), "vault is sealed", nil))
 
-	if err = v.Unseal(); err != nil {
-		logrus.Errorf("error unsealing vault: %s", err.Error())
-		exitIfNecessary(unsealConfig, 1)
-		return
+	unsealAttempts.Inc()
+	report, err := v.Unseal()
+	if err != nil {
+		unsealFailures.WithLabelValues(unsealFailureReason(report)).Inc()
+		notifier.Notify(notify.NewEvent(notify.EventUnsealFailed, vaultAddress(), "error unsealing vault", err))
+		return fmt.Errorf("error unsealing vault: %s", err.Error())
 	}
 
-	logrus.Info("successfully unsealed vault")
+	logUnsealReport(logrus.NewEntry(logrus.StandardLogger()), report)
+	notifier.Notify(notify.NewEvent(notify.EventUnsealed, vaultAddress(), "vault has been unsealed", nil))
 
-	exitIfNecessary(unsealConfig, 0)
+	return nil
+}
+
+// migrateSeal migrates the seal of Vault if it has been started with a seal migration pending,
+// otherwise it unseals Vault like in the normal mode, since a Vault migrated to Shamir gets sealed
+// again on restart, even if its configuration still has the disabled auto-unseal stanza
+func migrateSeal(v vault.Vault) error {
+	logrus.Debug("checking if vault seal migration is pending...")
+	migration, err := v.SealMigration()
+	if err != nil {
+		return fmt.Errorf("error checking vault seal migration: %s", err.Error())
+	}
+
+	if !migration {
+		return unseal(v)
+	}
+
+	logrus.Info("vault seal migration is pending, migrating")
+
+	unsealAttempts.Inc()
+	if err = v.MigrateSeal(); err != nil {
+		unsealFailures.WithLabelValues("migrate").Inc()
+		return fmt.Errorf("error migrating vault seal: %s", err.Error())
+	}
+
+	logrus.Info("successfully migrated vault seal")
+
+	return nil
 }
 
 func exitIfNecessary(unsealConfig unsealCfg, code int) {
@@ -144,7 +243,33 @@ func init() {
 	unsealCmd.PersistentFlags().String(cfgInitRootToken, "", "Root token for the new vault cluster (only if -init=true)")
 	unsealCmd.PersistentFlags().Bool(cfgStoreRootToken, true, "Should the root token be stored in the key store (only if -init=true)")
 	unsealCmd.PersistentFlags().Bool(cfgPreFlightChecks, true, "should the key store be tested first to validate access rights")
+	unsealCmd.PersistentFlags().StringSlice(cfgPGPKeys, []string{}, "PGP public key files, the last unseal keys are encrypted with them instead of being stored in the key store (only if -init=true)")
+	unsealCmd.PersistentFlags().String(cfgRootTokenPGPKey, "", "PGP public key file to encrypt the root token with (only if -init=true)")
+	unsealCmd.PersistentFlags().String(cfgPGPKeysOutput, "", "directory to write the PGP encrypted keys to, standard output if empty (only if -init=true)")
 	unsealCmd.PersistentFlags().Bool(cfgAuto, false, "Run in auto-unseal mode")
+	unsealCmd.PersistentFlags().Bool(cfgMigrate, false, "Migrate the seal of vault (Shamir to auto-unseal or back) with the stored keys, if vault has been started with a seal migration pending")
+	unsealCmd.PersistentFlags().StringSlice(cfgTargets, []string{}, "Unseal every Vault instance of these targets (addresses, srv://<name> DNS SRV records or k8s://<namespace>/<vault-name> per instance Services) instead of VAULT_ADDR")
+	unsealCmd.PersistentFlags().String(cfgListenAddress, ":9091", "Listen address of the metrics endpoint")
+	unsealCmd.PersistentFlags().String(cfgRaftInitPod, "", "With Raft storage only the Pod with this hostname initializes Vault (only if -init=true)")
 
 	rootCmd.AddCommand(unsealCmd)
 }
+
+// logUnsealReport logs the outcome of a successful unseal, with a warning if some of the stored keys are not usable
+func logUnsealReport(log *logrus.Entry, report *vault.UnsealReport) {
+	log = log.WithFields(logrus.Fields{
+		"threshold": report.Threshold,
+		"shares":    report.Shares,
+		"attempts":  report.Attempts,
+		"used":      report.Used,
+	})
+
+	if len(report.Invalid) > 0 || len(report.Duplicate) > 0 {
+		log.WithFields(logrus.Fields{
+			"invalid":   report.Invalid,
+			"duplicate": report.Duplicate,
+		}).Warn("some of the stored unseal keys are not usable")
+	}
+
+	log.Info("successfully unsealed vault")
+}
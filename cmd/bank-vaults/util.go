@@ -16,6 +16,8 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/banzaicloud/bank-vaults/pkg/kv"
 	"github.com/banzaicloud/bank-vaults/pkg/kv/alibabakms"
@@ -30,10 +32,31 @@ import (
 	"github.com/banzaicloud/bank-vaults/pkg/kv/s3"
 	"github.com/banzaicloud/bank-vaults/pkg/vault"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func vaultConfigForConfig(cfg *viper.Viper) (vault.Config, error) {
 
+	pgpKeys := []string{}
+	for _, pgpKeyFile := range appConfig.GetStringSlice(cfgPGPKeys) {
+		pgpKey, err := ioutil.ReadFile(pgpKeyFile)
+		if err != nil {
+			return vault.Config{}, fmt.Errorf("error reading PGP key: %s", err.Error())
+		}
+		pgpKeys = append(pgpKeys, string(pgpKey))
+	}
+
+	var rootTokenPGPKey []byte
+	if rootTokenPGPKeyFile := appConfig.GetString(cfgRootTokenPGPKey); rootTokenPGPKeyFile != "" {
+		var err error
+		rootTokenPGPKey, err = ioutil.ReadFile(rootTokenPGPKeyFile)
+		if err != nil {
+			return vault.Config{}, fmt.Errorf("error reading root token PGP key: %s", err.Error())
+		}
+	}
+
 	return vault.Config{
 		SecretShares:    appConfig.GetInt(cfgSecretShares),
 		SecretThreshold: appConfig.GetInt(cfgSecretThreshold),
@@ -42,35 +65,126 @@ func vaultConfigForConfig(cfg *viper.Viper) (vault.Config, error) {
 		StoreRootToken: appConfig.GetBool(cfgStoreRootToken),
 
 		PreFlightChecks: appConfig.GetBool(cfgPreFlightChecks),
+
+		PGPKeys:         pgpKeys,
+		RootTokenPGPKey: string(rootTokenPGPKey),
+		PGPKeysOutput:   appConfig.GetString(cfgPGPKeysOutput),
+
+		ConfigureSectionHook: observeConfigureSection,
 	}, nil
 }
 
+// vaultForConfig creates the key store and the Vault helper configured by the flags
+func vaultForConfig(cfg *viper.Viper) (vault.Vault, kv.Service, vault.Config, error) {
+	store, err := kvStoreForConfig(cfg)
+	if err != nil {
+		return nil, nil, vault.Config{}, fmt.Errorf("error creating kv store: %s", err.Error())
+	}
+	store = observeKVStore(store, cfg.GetString(cfgMode))
+
+	cl, err := vault.NewRawClient()
+	if err != nil {
+		return nil, nil, vault.Config{}, fmt.Errorf("error connecting to vault: %s", err.Error())
+	}
+
+	vaultConfig, err := vaultConfigForConfig(cfg)
+	if err != nil {
+		return nil, nil, vault.Config{}, fmt.Errorf("error building vault config: %s", err.Error())
+	}
+
+	v, err := vault.New(store, cl, vaultConfig)
+	if err != nil {
+		return nil, nil, vault.Config{}, fmt.Errorf("error creating vault helper: %s", err.Error())
+	}
+
+	return v, store, vaultConfig, nil
+}
+
+// k8sClient creates a Kubernetes client from KUBECONFIG, or from the in-cluster configuration
+func k8sClient() (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig := os.Getenv(clientcmd.RecommendedConfigPathEnvVar); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating k8s config: %s", err.Error())
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating k8s client: %s", err.Error())
+	}
+
+	return client, nil
+}
+
 func kvStoreForConfig(cfg *viper.Viper) (kv.Service, error) {
 
 	switch mode := cfg.GetString(cfgMode); mode {
 
-	case cfgModeValueGoogleCloudKMSGCS:
-		gcs, err := gcs.New(
-			cfg.GetString(cfgGoogleCloudStorageBucket),
-			cfg.GetString(cfgGoogleCloudStoragePrefix),
+	case cfgModeValueGoogleCloudKMSGCS, cfgModeValueAWSKMS3, cfgModeValueAlibabaKMSOSS:
+		store, err := objectStoreForConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return kmsStoreForConfig(cfg, store)
+
+	case cfgModeValueAzureKeyVault:
+		akv, err := azurekv.New(cfg.GetString(cfgAzureKeyVaultName))
+		if err != nil {
+			return nil, fmt.Errorf("error creating Azure Key Vault kv store: %s", err.Error())
+		}
+
+		return akv, nil
+
+	case cfgModeValueK8S:
+		k8s, err := k8s.New(
+			cfg.GetString(cfgK8SNamespace),
+			cfg.GetString(cfgK8SSecret),
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf("error creating google cloud storage kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating K8S Secret kv store: %s", err.Error())
 		}
 
-		kms, err := gckms.New(gcs,
-			cfg.GetString(cfgGoogleCloudKMSProject),
-			cfg.GetString(cfgGoogleCloudKMSLocation),
-			cfg.GetString(cfgGoogleCloudKMSKeyRing),
-			cfg.GetString(cfgGoogleCloudKMSCryptoKey),
+		return k8s, nil
+
+	case cfgModeValueDev:
+		dev, err := dev.New()
+		if err != nil {
+			return nil, fmt.Errorf("error creating Dev Secret kv store: %s", err.Error())
+		}
+
+		return dev, nil
+
+	case cfgModeValueFile:
+		return objectStoreForConfig(cfg)
+
+	default:
+		return nil, fmt.Errorf("Unsupported backend mode: '%s'", cfg.GetString(cfgMode))
+	}
+}
+
+// objectStoreForConfig returns the plain (not encrypted) object storage of the object storage based modes
+func objectStoreForConfig(cfg *viper.Viper) (kv.Service, error) {
+
+	switch mode := cfg.GetString(cfgMode); mode {
+
+	case cfgModeValueGoogleCloudKMSGCS:
+		gcs, err := gcs.New(
+			cfg.GetString(cfgGoogleCloudStorageBucket),
+			cfg.GetString(cfgGoogleCloudStoragePrefix),
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf("error creating google cloud kms kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating google cloud storage kv store: %s", err.Error())
 		}
 
-		return kms, nil
+		return gcs, nil
 
 	case cfgModeValueAWSKMS3:
 		s3, err := s3.New(
@@ -83,21 +197,7 @@ func kvStoreForConfig(cfg *viper.Viper) (kv.Service, error) {
 			return nil, fmt.Errorf("error creating AWS S3 kv store: %s", err.Error())
 		}
 
-		kms, err := awskms.New(s3, cfg.GetString(cfgAWSKMSRegion), cfg.GetString(cfgAWSKMSKeyID))
-
-		if err != nil {
-			return nil, fmt.Errorf("error creating AWS KMS kv store: %s", err.Error())
-		}
-
-		return kms, nil
-
-	case cfgModeValueAzureKeyVault:
-		akv, err := azurekv.New(cfg.GetString(cfgAzureKeyVaultName))
-		if err != nil {
-			return nil, fmt.Errorf("error creating Azure Key Vault kv store: %s", err.Error())
-		}
-
-		return akv, nil
+		return s3, nil
 
 	case cfgModeValueAlibabaKMSOSS:
 		accessKeyID := cfg.GetString(cfgAlibabaAccessKeyID)
@@ -124,47 +224,66 @@ func kvStoreForConfig(cfg *viper.Viper) (kv.Service, error) {
 			return nil, fmt.Errorf("error creating Alibaba OSS kv store: %s", err.Error())
 		}
 
-		kms, err := alibabakms.New(
-			cfg.GetString(cfgAlibabaKMSRegion),
-			accessKeyID,
-			accessKeySecret,
-			cfg.GetString(cfgAlibabaKMSKeyID),
-			oss)
+		return oss, nil
+
+	case cfgModeValueFile:
+		file, err := file.New(cfg.GetString(cfgFilePath))
 		if err != nil {
-			return nil, fmt.Errorf("error creating Alibaba KMS kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating File kv store: %s", err.Error())
 		}
 
-		return kms, nil
+		return file, nil
 
-	case cfgModeValueK8S:
-		k8s, err := k8s.New(
-			cfg.GetString(cfgK8SNamespace),
-			cfg.GetString(cfgK8SSecret),
+	default:
+		return nil, fmt.Errorf("backend mode '%s' is not object storage based", cfg.GetString(cfgMode))
+	}
+}
+
+// kmsStoreForConfig wraps the object storage of the mode with its KMS encryption, the file mode has no encryption
+func kmsStoreForConfig(cfg *viper.Viper, store kv.Service) (kv.Service, error) {
+
+	switch mode := cfg.GetString(cfgMode); mode {
+
+	case cfgModeValueGoogleCloudKMSGCS:
+		kms, err := gckms.New(store,
+			cfg.GetString(cfgGoogleCloudKMSProject),
+			cfg.GetString(cfgGoogleCloudKMSLocation),
+			cfg.GetString(cfgGoogleCloudKMSKeyRing),
+			cfg.GetString(cfgGoogleCloudKMSCryptoKey),
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf("error creating K8S Secret kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating google cloud kms kv store: %s", err.Error())
 		}
 
-		return k8s, nil
+		return kms, nil
+
+	case cfgModeValueAWSKMS3:
+		kms, err := awskms.New(store, cfg.GetString(cfgAWSKMSRegion), cfg.GetString(cfgAWSKMSKeyID))
 
-	case cfgModeValueDev:
-		dev, err := dev.New()
 		if err != nil {
-			return nil, fmt.Errorf("error creating Dev Secret kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating AWS KMS kv store: %s", err.Error())
 		}
 
-		return dev, nil
+		return kms, nil
 
-	case cfgModeValueFile:
-		file, err := file.New(cfg.GetString(cfgFilePath))
+	case cfgModeValueAlibabaKMSOSS:
+		kms, err := alibabakms.New(
+			cfg.GetString(cfgAlibabaKMSRegion),
+			cfg.GetString(cfgAlibabaAccessKeyID),
+			cfg.GetString(cfgAlibabaAccessKeySecret),
+			cfg.GetString(cfgAlibabaKMSKeyID),
+			store)
 		if err != nil {
-			return nil, fmt.Errorf("error creating File kv store: %s", err.Error())
+			return nil, fmt.Errorf("error creating Alibaba KMS kv store: %s", err.Error())
 		}
 
-		return file, nil
+		return kms, nil
+
+	case cfgModeValueFile:
+		return store, nil
 
 	default:
-		return nil, fmt.Errorf("Unsupported backend mode: '%s'", cfg.GetString(cfgMode))
+		return nil, fmt.Errorf("backend mode '%s' is not object storage based", cfg.GetString(cfgMode))
 	}
 }
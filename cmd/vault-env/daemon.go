@@ -0,0 +1,328 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	vaultapi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long the child has to exit after SIGTERM before it is killed during a restart
+	daemonStopTimeout = 30 * time.Second
+	// how long to wait before fetching the secrets again after a failure
+	daemonRetryPeriod = 10 * time.Second
+)
+
+var daemonSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// daemon is the daemon mode of vault-env: it runs the application as a child process, forwards the signals
+// to it, renews the leases of the secrets and the token, and when a lease can't be renewed anymore, it
+// fetches the secrets again and restarts the child with the new environment (or sends it a signal if the
+// environment hasn't changed, since the environment of a running process can't be changed)
+type daemon struct {
+	client               *vault.Client
+	binary               string
+	args                 []string
+	environ              []string
+	ignoreMissingSecrets bool
+	// the signal sent to the child on rotation if its environment stays the same, the child is restarted if it is 0
+	signal syscall.Signal
+
+	env    sanitizedEnviron
+	cmd    *exec.Cmd
+	exited chan error
+}
+
+func newDaemon(client *vault.Client, binary string, args []string, ignoreMissingSecrets bool) (*daemon, error) {
+	d := &daemon{
+		client:               client,
+		binary:               binary,
+		args:                 args,
+		environ:              syscall.Environ(),
+		ignoreMissingSecrets: ignoreMissingSecrets,
+	}
+
+	if val := os.Getenv("VAULT_ENV_DAEMON_SIGNAL"); val != "" {
+		sig, err := parseSignal(val)
+		if err != nil {
+			return nil, err
+		}
+		d.signal = sig
+	}
+
+	return d, nil
+}
+
+func parseSignal(val string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(val); err == nil {
+		return syscall.Signal(number), nil
+	}
+
+	if sig, ok := daemonSignals[strings.TrimPrefix(strings.ToUpper(val), "SIG")]; ok {
+		return sig, nil
+	}
+
+	return 0, fmt.Errorf("unknown signal: %s", val)
+}
+
+// run starts the child and supervises it until it exits, it returns the exit code of the child
+func (d *daemon) run(env sanitizedEnviron, secrets []*vaultapi.Secret) int {
+	if err := d.client.RenewToken(); err != nil {
+		log.Warnln("failed to start Vault token renewal:", err.Error())
+	}
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	if err := d.start(env); err != nil {
+		log.Errorln("failed to start process", d.binary, d.args, err.Error())
+		return 1
+	}
+
+	expired, stopWatch := d.watchLeases(secrets)
+
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGCHLD || sig == syscall.SIGURG {
+				continue
+			}
+			if err := d.cmd.Process.Signal(sig); err != nil {
+				log.Warnln("failed to forward signal to process:", sig, err.Error())
+			}
+
+		case err := <-d.exited:
+			stopWatch()
+			return exitCode(err)
+
+		case <-expired:
+			expired = nil
+			retry = time.After(0)
+
+		case <-retry:
+			retry = nil
+
+			log.Infoln("secret lease expired, fetching the secrets again")
+
+			newEnv, newSecrets, err := resolveEnviron(d.client, d.environ, d.ignoreMissingSecrets)
+			if err != nil {
+				log.Errorln("failed to fetch the secrets again, retrying:", err.Error())
+				retry = time.After(daemonRetryPeriod)
+				continue
+			}
+
+			stopWatch()
+			expired, stopWatch = d.watchLeases(newSecrets)
+
+			if d.signal != 0 {
+				if sameEnviron(newEnv, d.env) {
+					log.Infoln("sending signal to process:", d.signal)
+					if err := d.cmd.Process.Signal(d.signal); err != nil {
+						log.Warnln("failed to signal process:", err.Error())
+					}
+					continue
+				}
+				log.Infoln("the secrets in the environment have changed, they can't be delivered with a signal")
+			}
+
+			log.Infoln("restarting process with the new secrets")
+			if exited, err := d.stop(); exited {
+				log.Infoln("process has already exited, not restarting it")
+				stopWatch()
+				return exitCode(err)
+			}
+			if err := d.start(newEnv); err != nil {
+				log.Errorln("failed to restart process", d.binary, d.args, err.Error())
+				stopWatch()
+				return 1
+			}
+		}
+	}
+}
+
+func (d *daemon) start(env sanitizedEnviron) error {
+	cmd := exec.Command(d.binary)
+	cmd.Args = d.args
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	d.env = env
+	d.cmd = cmd
+	d.exited = exited
+
+	return nil
+}
+
+// stop terminates the child for a restart, it returns true with the result of the child if it has
+// already exited on its own, a child which has finished (even successfully) is not restarted
+func (d *daemon) stop() (bool, error) {
+	select {
+	case err := <-d.exited:
+		return true, err
+	default:
+	}
+
+	if err := d.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		log.Warnln("failed to terminate process:", err.Error())
+	}
+
+	select {
+	case <-d.exited:
+	case <-time.After(daemonStopTimeout):
+		log.Warnln("process didn't exit in time, killing it")
+		_ = d.cmd.Process.Kill()
+		<-d.exited
+	}
+
+	return false, nil
+}
+
+// watchLeases renews the renewable leases of the secrets, and signals on the returned channel when one of
+// them expires or can't be renewed anymore; the returned function stops the renewals
+func (d *daemon) watchLeases(secrets []*vaultapi.Secret) (<-chan struct{}, func()) {
+	expired := make(chan struct{}, 1)
+	stop := make(chan struct{})
+
+	notify := func() {
+		select {
+		case expired <- struct{}{}:
+		default:
+		}
+	}
+
+	var renewers []*vaultapi.Renewer
+
+	for _, secret := range secrets {
+		// Secrets without a lease (e.g. of the KV engines, which report a lease duration nevertheless)
+		// don't expire, so there is nothing to renew or fetch again
+		if secret.LeaseID == "" && secret.Auth == nil {
+			continue
+		}
+
+		if !secret.Renewable {
+			if secret.LeaseDuration <= 0 {
+				continue
+			}
+
+			// fetch a non-renewable secret again when two thirds of its lease has passed
+			timer := time.NewTimer(time.Duration(secret.LeaseDuration) * time.Second * 2 / 3)
+			go func() {
+				select {
+				case <-timer.C:
+					notify()
+				case <-stop:
+					timer.Stop()
+				}
+			}()
+			continue
+		}
+
+		renewer, err := d.client.RawClient().NewRenewer(&vaultapi.RenewerInput{Secret: secret})
+		if err != nil {
+			log.Errorln("failed to create lease renewer:", secret.LeaseID, err.Error())
+			notify()
+			continue
+		}
+		renewers = append(renewers, renewer)
+
+		go renewer.Renew()
+		go func(leaseID string) {
+			for {
+				select {
+				case err := <-renewer.DoneCh():
+					if err != nil {
+						log.Warnln("failed to renew lease:", leaseID, err.Error())
+					} else {
+						log.Infoln("lease can't be renewed anymore:", leaseID)
+					}
+					notify()
+					return
+				case <-renewer.RenewCh():
+					log.Debugln("renewed lease:", leaseID)
+				case <-stop:
+					return
+				}
+			}
+		}(secret.LeaseID)
+	}
+
+	return expired, func() {
+		close(stop)
+		for _, renewer := range renewers {
+			renewer.Stop()
+		}
+	}
+}
+
+func sameEnviron(a, b sanitizedEnviron) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+
+	log.Errorln("process failed:", err.Error())
+	return 1
+}
@@ -0,0 +1,176 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected syscall.Signal
+		fails    bool
+	}{
+		{value: "SIGHUP", expected: syscall.SIGHUP},
+		{value: "hup", expected: syscall.SIGHUP},
+		{value: "USR1", expected: syscall.SIGUSR1},
+		{value: "sigterm", expected: syscall.SIGTERM},
+		{value: "10", expected: syscall.Signal(10)},
+		{value: "SIGFOO", fails: true},
+		{value: "", fails: true},
+	}
+
+	for _, test := range tests {
+		sig, err := parseSignal(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Parsing %q should fail", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %q failed: %s", test.value, err.Error())
+			continue
+		}
+		if sig != test.expected {
+			t.Errorf("Parsing %q: expected %v, got %v", test.value, test.expected, sig)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected int
+	}{
+		{name: "success", script: "exit 0", expected: 0},
+		{name: "failure", script: "exit 3", expected: 3},
+		{name: "signaled", script: "kill -TERM $$", expected: 128 + int(syscall.SIGTERM)},
+	}
+
+	for _, test := range tests {
+		err := exec.Command("/bin/sh", "-c", test.script).Run()
+		if code := exitCode(err); code != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, code)
+		}
+	}
+
+	if code := exitCode(errors.New("failed to wait")); code != 1 {
+		t.Errorf("Expected exit code 1 for an error other than an exit, got %d", code)
+	}
+}
+
+func TestSameEnviron(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        sanitizedEnviron
+		b        sanitizedEnviron
+		expected bool
+	}{
+		{name: "same", a: sanitizedEnviron{"A=1", "B=2"}, b: sanitizedEnviron{"A=1", "B=2"}, expected: true},
+		{name: "empty", expected: true},
+		{name: "changed value", a: sanitizedEnviron{"A=1", "B=2"}, b: sanitizedEnviron{"A=1", "B=3"}},
+		{name: "added variable", a: sanitizedEnviron{"A=1"}, b: sanitizedEnviron{"A=1", "B=2"}},
+	}
+
+	for _, test := range tests {
+		if same := sameEnviron(test.a, test.b); same != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, same)
+		}
+	}
+}
+
+func TestDaemonStop(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		exited   bool
+		expected int
+	}{
+		{name: "finished", script: "exit 0", exited: true, expected: 0},
+		{name: "failed", script: "exit 3", exited: true, expected: 3},
+		{name: "running", script: "sleep 10"},
+	}
+
+	for _, test := range tests {
+		d := &daemon{binary: "/bin/sh", args: []string{"sh", "-c", test.script}}
+		if err := d.start(nil); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if test.exited {
+			// wait for the child to exit, and hand its result back to stop
+			err := <-d.exited
+			d.exited <- err
+		}
+
+		exited, err := d.stop()
+		if exited != test.exited {
+			t.Errorf("%s: expected the child to be exited %t, got %t", test.name, test.exited, exited)
+		}
+		if exited && exitCode(err) != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, exitCode(err))
+		}
+	}
+}
+
+func TestWatchLeases(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  *vaultapi.Secret
+		expires bool
+	}{
+		{
+			name:    "non-renewable lease",
+			secret:  &vaultapi.Secret{LeaseID: "database/creds/app/1", LeaseDuration: 1},
+			expires: true,
+		},
+		{
+			name:   "kv secret",
+			secret: &vaultapi.Secret{LeaseDuration: 1},
+		},
+		{
+			name:   "non-renewable lease without duration",
+			secret: &vaultapi.Secret{LeaseID: "database/creds/app/2"},
+		},
+	}
+
+	for _, test := range tests {
+		d := &daemon{}
+		expired, stop := d.watchLeases([]*vaultapi.Secret{test.secret})
+
+		// the non-renewable leases are fetched again when two thirds of them have passed
+		select {
+		case <-expired:
+			if !test.expires {
+				t.Errorf("%s: the lease shouldn't expire", test.name)
+			}
+		case <-time.After(1500 * time.Millisecond):
+			if test.expires {
+				t.Errorf("%s: the lease should expire", test.name)
+			}
+		}
+
+		stop()
+	}
+}
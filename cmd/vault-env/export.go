@@ -0,0 +1,238 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+)
+
+// The output formats of the export mode
+const (
+	exportFormatDotenv        = "dotenv"
+	exportFormatJSON          = "json"
+	exportFormatShell         = "shell"
+	exportFormatGitHubActions = "github-actions"
+)
+
+type exportOptions struct {
+	format string
+	file   string
+}
+
+// parseExportFlags parses the arguments of vault-env export
+func parseExportFlags(args []string) (exportOptions, error) {
+	var options exportOptions
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&options.format, "format", exportFormatDotenv, "Output format: dotenv, json, shell or github-actions")
+	flags.StringVar(&options.file, "file", "", "Resolve the variables of this dotenv file instead of the current environment")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vault-env export [--format dotenv|json|shell|github-actions] [--file FILE]")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+
+	switch options.format {
+	case exportFormatDotenv, exportFormatJSON, exportFormatShell, exportFormatGitHubActions:
+	default:
+		return options, fmt.Errorf("unknown format: %s", options.format)
+	}
+
+	return options, nil
+}
+
+// export is the export mode of vault-env: it resolves the Vault references of the current environment or
+// of a dotenv file, and prints the result, the variables of the file or the resolved variables of the environment
+func export(client *vault.Client, options exportOptions, ignoreMissingSecrets bool) error {
+	environ := syscall.Environ()
+	onlyResolved := true
+
+	if options.file != "" {
+		var err error
+		environ, err = readDotenvFile(options.file)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %s", options.file, err.Error())
+		}
+		onlyResolved = false
+	}
+
+	sanitized, _, err := resolveEnviron(client, environ, ignoreMissingSecrets)
+	if err != nil {
+		return err
+	}
+
+	original := map[string]string{}
+	for _, env := range environ {
+		split := strings.SplitN(env, "=", 2)
+		original[split[0]] = split[1]
+	}
+
+	var names []string
+	values := map[string]string{}
+	for _, env := range sanitized {
+		split := strings.SplitN(env, "=", 2)
+		name, value := split[0], split[1]
+
+		if onlyResolved {
+			if originalValue, ok := original[name]; ok && originalValue == value {
+				continue
+			}
+		}
+
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+
+	if options.format == exportFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(values)
+	}
+
+	if options.format == exportFormatGitHubActions {
+		return exportGitHubActions(names, values)
+	}
+
+	for _, name := range names {
+		switch options.format {
+		case exportFormatShell:
+			fmt.Printf("export %s=%s\n", name, shellQuote(values[name]))
+		default:
+			fmt.Print(dotenvLine(name, values[name]))
+		}
+	}
+
+	return nil
+}
+
+// exportGitHubActions masks the values in the log of the workflow, and writes the variables to the
+// file of GITHUB_ENV, so the next steps of the job get them (or prints them if it is not set)
+func exportGitHubActions(names []string, values map[string]string) error {
+	var out io.Writer = os.Stdout
+
+	if envFile := os.Getenv("GITHUB_ENV"); envFile != "" {
+		file, err := os.OpenFile(envFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening GITHUB_ENV: %s", err.Error())
+		}
+		defer file.Close()
+		out = file
+	}
+
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		for _, line := range strings.Split(values[name], "\n") {
+			if strings.TrimSpace(line) != "" {
+				fmt.Printf("::add-mask::%s\n", line)
+			}
+		}
+	}
+
+	for _, name := range names {
+		delimiter, err := randomDelimiter(values[name])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s<<%s\n%s\n%s\n", name, delimiter, values[name], delimiter)
+	}
+
+	return nil
+}
+
+// randomDelimiter returns a heredoc delimiter which is not in the value
+func randomDelimiter(value string) (string, error) {
+	for {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+
+		delimiter := "ghadelimiter_" + hex.EncodeToString(random)
+		if !strings.Contains(value, delimiter) {
+			return delimiter, nil
+		}
+	}
+}
+
+func dotenvLine(name, value string) string {
+	return fmt.Sprintf("%s=%s\n", name, strconv.Quote(value))
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// readDotenvFile reads the NAME=value lines of a dotenv file, the empty lines and the comments are skipped,
+// and the quotes around the values are removed
+func readDotenvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var environ []string
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("invalid line %d", number)
+		}
+
+		name, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in line %d: %s", number, err.Error())
+			}
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+
+		environ = append(environ, name+"="+value)
+	}
+
+	return environ, scanner.Err()
+}
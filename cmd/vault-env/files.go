@@ -0,0 +1,174 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+)
+
+// The formats of the secret files
+const (
+	secretFileFormatRaw      = "raw"
+	secretFileFormatJSON     = "json"
+	secretFileFormatDotenv   = "dotenv"
+	secretFileFormatTemplate = "template"
+)
+
+// secretFile is a file to be written by the file mode, the webhook passes them in VAULT_SECRET_FILES as a JSON list
+type secretFile struct {
+	Path      string `json:"path"`
+	Reference string `json:"reference"`
+	Format    string `json:"format"`
+	Template  string `json:"template,omitempty"`
+}
+
+// writeSecretFiles is the file mode of vault-env: it reads the secrets of the files
+// from Vault, and writes the rendered files instead of executing a command
+func writeSecretFiles(client *vault.Client, files string, ignoreMissingSecrets bool) error {
+	var secretFiles []secretFile
+	if err := json.Unmarshal([]byte(files), &secretFiles); err != nil {
+		return fmt.Errorf("error parsing VAULT_SECRET_FILES: %s", err.Error())
+	}
+
+	mode := os.FileMode(0400)
+	if val := os.Getenv("VAULT_SECRET_FILES_MODE"); val != "" {
+		parsed, err := strconv.ParseUint(val, 8, 32)
+		if err != nil {
+			return fmt.Errorf("error parsing VAULT_SECRET_FILES_MODE: %s", err.Error())
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	for _, file := range secretFiles {
+		path, key, version := vault.ParseReference(file.Reference)
+
+		_, data, err := readSecret(client, path, version, false)
+		if err != nil {
+			return fmt.Errorf("error reading secret from path %s: %s", path, err.Error())
+		}
+
+		var content []byte
+		if data == nil {
+			if !ignoreMissingSecrets {
+				return fmt.Errorf("path not found: %s", path)
+			}
+			// The file is mounted into the containers on its own, so an empty one is written
+			log.Warnln("path not found:", path)
+		} else {
+			content, err = renderSecretFile(file, key, data)
+			if err != nil {
+				return fmt.Errorf("error rendering secret file %s: %s", file.Path, err.Error())
+			}
+		}
+
+		if err := writeFileAtomic(file.Path, content, mode); err != nil {
+			return fmt.Errorf("error writing secret file %s: %s", file.Path, err.Error())
+		}
+
+		log.Infoln("secret file written:", file.Path)
+	}
+
+	return nil
+}
+
+func renderSecretFile(file secretFile, key string, data map[string]interface{}) ([]byte, error) {
+	switch file.Format {
+	case secretFileFormatRaw:
+		value, ok := data[key]
+		if !ok {
+			return nil, fmt.Errorf("key not found: %s", key)
+		}
+		return []byte(cast.ToString(value)), nil
+
+	case secretFileFormatDotenv:
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var buffer bytes.Buffer
+		for _, k := range keys {
+			buffer.WriteString(dotenvLine(k, cast.ToString(data[k])))
+		}
+		return buffer.Bytes(), nil
+
+	case secretFileFormatTemplate:
+		tmpl, err := template.New(filepath.Base(file.Path)).Option("missingkey=error").Parse(file.Template)
+		if err != nil {
+			return nil, err
+		}
+
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, data); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+
+	case secretFileFormatJSON, "":
+		if key != "" {
+			value, ok := data[key]
+			if !ok {
+				return nil, fmt.Errorf("key not found: %s", key)
+			}
+			return json.Marshal(value)
+		}
+		return json.Marshal(data)
+
+	default:
+		return nil, fmt.Errorf("unknown format: %s", file.Format)
+	}
+}
+
+// writeFileAtomic writes the file through a temporary file in the same directory,
+// so the application never sees a partially written file
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+strings.TrimPrefix(filepath.Base(path), ".")+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,97 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRenderSecretFile(t *testing.T) {
+	data := map[string]interface{}{
+		"username": "app",
+		"password": `s3"cr3t`,
+		"port":     5432,
+	}
+
+	tests := []struct {
+		name     string
+		file     secretFile
+		key      string
+		expected string
+		fails    bool
+	}{
+		{
+			name:     "raw",
+			file:     secretFile{Path: "/etc/app/password", Format: "raw"},
+			key:      "password",
+			expected: `s3"cr3t`,
+		},
+		{
+			name:  "raw missing key",
+			file:  secretFile{Path: "/etc/app/password", Format: "raw"},
+			key:   "token",
+			fails: true,
+		},
+		{
+			name:     "dotenv",
+			file:     secretFile{Path: "/etc/app/db.env", Format: "dotenv"},
+			expected: "password=\"s3\\\"cr3t\"\nport=\"5432\"\nusername=\"app\"\n",
+		},
+		{
+			name:     "json",
+			file:     secretFile{Path: "/etc/app/db.json", Format: "json"},
+			expected: `{"password":"s3\"cr3t","port":5432,"username":"app"}`,
+		},
+		{
+			name:     "json key",
+			file:     secretFile{Path: "/etc/app/port.json", Format: "json"},
+			key:      "port",
+			expected: `5432`,
+		},
+		{
+			name:     "template",
+			file:     secretFile{Path: "/etc/app/config.yml", Format: "template", Template: "dsn: {{ .username }}@db:{{ .port }}"},
+			expected: "dsn: app@db:5432",
+		},
+		{
+			name:  "template missing key",
+			file:  secretFile{Path: "/etc/app/config.yml", Format: "template", Template: "token: {{ .token }}"},
+			fails: true,
+		},
+		{
+			name:  "unknown format",
+			file:  secretFile{Path: "/etc/app/db.xml", Format: "xml"},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, err := renderSecretFile(test.file, test.key, data)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+)
+
+// The key of a reference which expands every key of the secret, e.g. DB=vault:secret/data/db#*
+const wildcardKey = "*"
+
+// expandedEnviron holds the variables expanded from whole secrets, a later expansion of
+// the same name overrides an earlier one, and the variables are kept in the order of expansion
+type expandedEnviron struct {
+	names    []string
+	values   map[string]string
+	sources  map[string]string
+	sanitize bool
+}
+
+func newExpandedEnviron() *expandedEnviron {
+	return &expandedEnviron{
+		values:   map[string]string{},
+		sources:  map[string]string{},
+		sanitize: os.Getenv("VAULT_ENV_FROM_PATH_SANITIZE") != "false",
+	}
+}
+
+// expand adds every key of the data of the secret at path as a variable, the keys are processed in sorted order
+func (e *expandedEnviron) expand(prefix, path string, data map[string]interface{}) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := prefix + key
+		if e.sanitize {
+			name = sanitizeEnvName(name)
+		}
+
+		if name == "" || strings.Contains(name, "=") {
+			log.Warnln("skipping key which is not a valid variable name:", key, "path:", path)
+			continue
+		}
+
+		source := path + "#" + key
+		if previous, ok := e.sources[name]; ok {
+			log.Warnln("variable", name, "of", previous, "is overridden by", source)
+		} else {
+			e.names = append(e.names, name)
+		}
+
+		e.values[name] = cast.ToString(data[key])
+		e.sources[name] = source
+	}
+}
+
+// appendTo appends the expanded variables to the environ, except the ones which are defined explicitly
+func (e *expandedEnviron) appendTo(environ *sanitizedEnviron, explicit map[string]bool) {
+	for _, name := range e.names {
+		if explicit[name] {
+			log.Warnln("variable", name, "of", e.sources[name], "is overridden by the explicitly defined variable")
+			continue
+		}
+		environ.append(name, e.values[name])
+	}
+}
+
+// sanitizeEnvName upper cases the name and replaces the characters which are not allowed
+// in variable names with _, and prefixes it with _ if it starts with a digit
+func sanitizeEnvName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	if sanitized != "" && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+
+	return sanitized
+}
+
+// envFromPaths returns the paths of VAULT_ENV_FROM_PATH, every key of them is exposed as a variable
+func envFromPaths() []string {
+	var paths []string
+	for _, path := range strings.Split(os.Getenv("VAULT_ENV_FROM_PATH"), ",") {
+		if trimmed := strings.TrimSpace(path); trimmed != "" {
+			paths = append(paths, trimmed)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,133 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeEnvName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "password", expected: "PASSWORD"},
+		{name: "DB_PASSWORD", expected: "DB_PASSWORD"},
+		{name: "db-password", expected: "DB_PASSWORD"},
+		{name: "db.password", expected: "DB_PASSWORD"},
+		{name: "api key", expected: "API_KEY"},
+		{name: "1st_key", expected: "_1ST_KEY"},
+		{name: "jelszó", expected: "JELSZ_"},
+		{name: "", expected: ""},
+	}
+
+	for _, test := range tests {
+		if sanitized := sanitizeEnvName(test.name); sanitized != test.expected {
+			t.Errorf("expected %q for %q, got %q", test.expected, test.name, sanitized)
+		}
+	}
+}
+
+func TestExpandedEnviron(t *testing.T) {
+	tests := []struct {
+		name     string
+		sanitize bool
+		secrets  []map[string]interface{}
+		prefix   string
+		explicit map[string]bool
+		expected sanitizedEnviron
+	}{
+		{
+			name:     "sorted keys",
+			sanitize: true,
+			secrets: []map[string]interface{}{
+				{"username": "app", "password": "s3cr3t", "port": 5432},
+			},
+			expected: sanitizedEnviron{"PASSWORD=s3cr3t", "PORT=5432", "USERNAME=app"},
+		},
+		{
+			name:     "prefix",
+			sanitize: true,
+			prefix:   "db_",
+			secrets: []map[string]interface{}{
+				{"password": "s3cr3t"},
+			},
+			expected: sanitizedEnviron{"DB_PASSWORD=s3cr3t"},
+		},
+		{
+			name:     "later path overrides",
+			sanitize: true,
+			secrets: []map[string]interface{}{
+				{"password": "first", "username": "app"},
+				{"password": "second"},
+			},
+			expected: sanitizedEnviron{"PASSWORD=second", "USERNAME=app"},
+		},
+		{
+			name:     "explicit variable overrides",
+			sanitize: true,
+			secrets: []map[string]interface{}{
+				{"password": "s3cr3t", "username": "app"},
+			},
+			explicit: map[string]bool{"PASSWORD": true},
+			expected: sanitizedEnviron{"USERNAME=app"},
+		},
+		{
+			name:     "sanitized names collide",
+			sanitize: true,
+			secrets: []map[string]interface{}{
+				{"db-password": "dash", "db.password": "dot"},
+			},
+			expected: sanitizedEnviron{"DB_PASSWORD=dot"},
+		},
+		{
+			name:     "not sanitized",
+			sanitize: false,
+			secrets: []map[string]interface{}{
+				{"db-password": "s3cr3t", "a=b": "skipped"},
+			},
+			expected: sanitizedEnviron{"db-password=s3cr3t"},
+		},
+		{
+			name:     "vault-env variables are not exposed",
+			sanitize: true,
+			secrets: []map[string]interface{}{
+				{"vault_token": "s.token", "password": "s3cr3t"},
+			},
+			expected: sanitizedEnviron{"PASSWORD=s3cr3t"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expanded := &expandedEnviron{
+				values:   map[string]string{},
+				sources:  map[string]string{},
+				sanitize: test.sanitize,
+			}
+			for _, secret := range test.secrets {
+				expanded.expand(test.prefix, "secret/data/app", secret)
+			}
+
+			var environ sanitizedEnviron
+			expanded.appendTo(&environ, test.explicit)
+
+			if !reflect.DeepEqual(environ, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, environ)
+			}
+		})
+	}
+}
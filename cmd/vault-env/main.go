@@ -15,6 +15,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
@@ -54,6 +55,17 @@ var sanitizeEnvmap = map[string]bool{
 	"VAULT_PATH":                   true,
 	"VAULT_IGNORE_MISSING_SECRETS": true,
 	"VAULT_ENV_PASSTHROUGH":        true,
+	"VAULT_SECRET_FILES":           true,
+	"VAULT_SECRET_FILES_MODE":      true,
+	"VAULT_ENV_DAEMON":             true,
+	"VAULT_ENV_DAEMON_SIGNAL":      true,
+	"VAULT_ENV_FROM_PATH":          true,
+	"VAULT_ENV_FROM_PATH_PREFIX":   true,
+	"VAULT_ENV_FROM_PATH_SANITIZE": true,
+	"VAULT_AUTH_METHOD":            true,
+	"VAULT_JWT_PATH":               true,
+	"VAULT_ROLE_ID":                true,
+	"VAULT_SECRET_ID":              true,
 }
 
 // Appends variable an entry (name=value) into the environ list.
@@ -65,42 +77,122 @@ func (environ *sanitizedEnviron) append(iname interface{}, ivalue interface{}) {
 	}
 }
 
-func main() {
-	ignoreMissingSecrets := os.Getenv("VAULT_IGNORE_MISSING_SECRETS") == "true"
+// readSecret reads the path (or writes it if update is set), and returns the secret and its data, the data of
+// the version for KV version 2 paths, or nil if the path is not found. The query-style parameters of the path
+// are the body of the write, or the parameters of the read.
+func readSecret(client *vault.Client, path, version string, update bool) (*vaultapi.Secret, map[string]interface{}, error) {
+	path, params, err := vault.SplitParams(path)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// The login procedure takes the token from a file (if using Vault Agent)
-	// or requests one for itself (Kubernetes Auth), so if we got a VAULT_TOKEN
-	// for the special value with "vault:login"
-	originalVaultTokenEnvVar := os.Getenv("VAULT_TOKEN")
-	if originalVaultTokenEnvVar == vaultLogin {
-		os.Unsetenv("VAULT_TOKEN")
+	var secret *vaultapi.Secret
+
+	if update {
+		body := make(map[string]interface{}, len(params))
+		for name, values := range params {
+			if len(values) == 1 {
+				body[name] = values[0]
+			} else {
+				body[name] = values
+			}
+		}
+		secret, err = client.Vault().Logical().Write(path, body)
+	} else {
+		params.Set("version", version)
+		secret, err = client.Vault().Logical().ReadWithData(path, params)
+	}
+	if err != nil || secret == nil {
+		return nil, nil, err
 	}
 
-	client, err := vault.NewClientWithOptions(
-		vault.ClientRole(os.Getenv("VAULT_ROLE")),
-		vault.ClientAuthPath(os.Getenv("VAULT_PATH")),
-	)
+	v2Data, ok := secret.Data["data"]
+	if !ok {
+		return secret, cast.ToStringMap(secret.Data), nil
+	}
+
+	// Check if a given version of a path is destroyed
+	metadata := secret.Data["metadata"].(map[string]interface{})
+	if metadata["destroyed"].(bool) {
+		log.Warnln("version of secret has been permanently destroyed version:", version, "path:", path)
+	}
+
+	// Check if a given version of a path still exists
+	if deletionTime, ok := metadata["deletion_time"].(string); ok && deletionTime != "" {
+		log.Warnln("cannot find data for path, given version has been deleted",
+			"path:", path, "version:", version,
+			"deletion_time", deletionTime)
+	}
+
+	return secret, cast.ToStringMap(v2Data), nil
+}
+
+// secretCache caches the responses of Vault within one run, so the keys of the same write
+// (e.g. the certificate and the private key of a PKI issue) come from the same response
+type secretCache map[string]cachedSecret
+
+type cachedSecret struct {
+	secret *vaultapi.Secret
+	data   map[string]interface{}
+}
+
+func (cache secretCache) readSecret(client *vault.Client, path, version string, update bool) (*vaultapi.Secret, map[string]interface{}, error) {
+	plainPath, params, err := vault.SplitParams(path)
 	if err != nil {
-		log.Fatal("failed to create vault client", err.Error())
+		return nil, nil, err
 	}
 
-	passthroughEnvVars := strings.Split(os.Getenv("VAULT_ENV_PASSTHROUGH"), ",")
+	cacheKey := fmt.Sprintf("%t|%s?%s#%s", update, plainPath, params.Encode(), version)
+	if cached, ok := cache[cacheKey]; ok {
+		return cached.secret, cached.data, nil
+	}
 
-	if originalVaultTokenEnvVar == vaultLogin {
-		os.Setenv("VAULT_TOKEN", vaultLogin)
-		passthroughEnvVars = append(passthroughEnvVars, "VAULT_TOKEN")
+	secret, data, err := readSecret(client, path, version, update)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// do not sanitize env vars specified in VAULT_ENV_PASSTHROUGH
-	for _, envVar := range passthroughEnvVars {
-		if trimmed := strings.TrimSpace(envVar); trimmed != "" {
-			delete(sanitizeEnvmap, trimmed)
+	cache[cacheKey] = cachedSecret{secret: secret, data: data}
+
+	return secret, data, nil
+}
+
+// resolveEnviron replaces the values referencing Vault in the environ with the secrets, and returns the
+// sanitized environ and the secrets which have leases. The keys of the paths in VAULT_ENV_FROM_PATH and of
+// the wildcard references are expanded in this order, a later expansion overrides an earlier one, and the
+// explicitly defined variables override all of them.
+func resolveEnviron(client *vault.Client, environ []string, ignoreMissingSecrets bool) (sanitizedEnviron, []*vaultapi.Secret, error) {
+	sanitized := make(sanitizedEnviron, 0, len(environ))
+	cache := secretCache{}
+
+	var leased []*vaultapi.Secret
+	leaseIDs := map[string]bool{}
+	addLease := func(secret *vaultapi.Secret) {
+		if secret != nil && secret.LeaseID != "" && !leaseIDs[secret.LeaseID] {
+			leaseIDs[secret.LeaseID] = true
+			leased = append(leased, secret)
 		}
 	}
 
-	// initial and sanitized environs
-	environ := syscall.Environ()
-	sanitized := make(sanitizedEnviron, 0, len(environ))
+	expanded := newExpandedEnviron()
+	explicit := map[string]bool{}
+
+	for _, path := range envFromPaths() {
+		secret, data, err := cache.readSecret(client, path, "-1", false)
+		if err == nil && data == nil {
+			err = fmt.Errorf("path not found")
+		}
+		if err != nil {
+			if !ignoreMissingSecrets {
+				return nil, nil, fmt.Errorf("failed to read secret from path: %s %s", path, err.Error())
+			}
+			log.Errorln("failed to read secret from path:", path, err.Error())
+			continue
+		}
+
+		expanded.expand(os.Getenv("VAULT_ENV_FROM_PATH_PREFIX"), path, data)
+		addLease(secret)
+	}
 
 	for _, env := range environ {
 		split := strings.SplitN(env, "=", 2)
@@ -113,88 +205,139 @@ func main() {
 		} else {
 			update = false
 		}
-		if strings.HasPrefix(value, "vault:") {
+		if vault.IsTemplate(value) {
+			rendered, err := vault.RenderTemplate(value, func(path, version string) (map[string]interface{}, error) {
+				secret, data, err := cache.readSecret(client, path, version, false)
+				addLease(secret)
+				return data, err
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to render template of %s: %s", name, err.Error())
+			}
+			explicit[name] = true
+			sanitized.append(name, rendered)
+		} else if strings.HasPrefix(value, "vault:") {
 			path := strings.TrimPrefix(value, "vault:")
 
 			// handle special case for vault:login env value
 			// namely pass through the the VAULT_TOKEN received from the Vault login procedure
 			if name == "VAULT_TOKEN" && path == "login" {
 				value = client.RawClient().Token()
+				explicit[name] = true
 				sanitized.append(name, value)
 				continue
 			}
 
-			split := strings.SplitN(path, "#", 3)
-			path = split[0]
-
-			var key string
-			if len(split) > 1 {
-				key = split[1]
-			}
-
-			version := "-1"
-			if len(split) == 3 {
-				version = split[2]
-			}
-
-			var secret *vaultapi.Secret
-			var err error
+			path, key, version := vault.ParseReference(path)
 
-			if update {
-				var empty map[string]interface{}
-				secret, err = client.Vault().Logical().Write(path, empty)
-				if err != nil {
-					log.Fatalln("failed to write secret to path:", path, err.Error())
-				}
-			} else {
-				secret, err = client.Vault().Logical().ReadWithData(path, map[string][]string{"version": {version}})
-				if err != nil {
-					if ignoreMissingSecrets {
-						log.Errorln("failed to read secret from path:", path, err.Error())
-					} else {
-						log.Fatalln("failed to read secret from path:", path, err.Error())
-					}
+			secret, data, err := cache.readSecret(client, path, version, update)
+			if err != nil {
+				if update {
+					return nil, nil, fmt.Errorf("failed to write secret to path: %s %s", path, err.Error())
+				} else if ignoreMissingSecrets {
+					log.Errorln("failed to read secret from path:", path, err.Error())
+				} else {
+					return nil, nil, fmt.Errorf("failed to read secret from path: %s %s", path, err.Error())
 				}
 			}
 
-			if secret == nil {
+			if data == nil {
 				if ignoreMissingSecrets {
 					log.Warnln("path not found:", path)
 				} else {
-					log.Fatalln("path not found:", path)
+					return nil, nil, fmt.Errorf("path not found: %s", path)
 				}
+			} else if key == wildcardKey {
+				// expand every key of the secret with the name of the variable as prefix
+				expanded.expand(name+"_", path, data)
 			} else {
-				var data map[string]interface{}
-				v2Data, ok := secret.Data["data"]
-				if ok {
-					data = cast.ToStringMap(v2Data)
-
-					// Check if a given version of a path is destroyed
-					metadata := secret.Data["metadata"].(map[string]interface{})
-					if metadata["destroyed"].(bool) {
-						log.Warnln("version of secret has been permanently destroyed version:", version, "path:", path)
-					}
-
-					// Check if a given version of a path still exists
-					if deletionTime, ok := metadata["deletion_time"].(string); ok && deletionTime != "" {
-						log.Warnln("cannot find data for path, given version has been deleted",
-							"path:", path, "version:", version,
-							"deletion_time", deletionTime)
-					}
-				} else {
-					data = cast.ToStringMap(secret.Data)
-				}
+				explicit[name] = true
 				if value, ok := data[key]; ok {
 					sanitized.append(name, value)
 				} else {
-					log.Fatalln("key not found:", key)
+					return nil, nil, fmt.Errorf("key not found: %s", key)
 				}
 			}
+
+			addLease(secret)
 		} else {
+			explicit[name] = true
 			sanitized.append(name, value)
 		}
 	}
 
+	expanded.appendTo(&sanitized, explicit)
+
+	return sanitized, leased, nil
+}
+
+func main() {
+	ignoreMissingSecrets := os.Getenv("VAULT_IGNORE_MISSING_SECRETS") == "true"
+
+	// export mode: print the resolved variables instead of executing a command (e.g. in CI jobs)
+	exportMode := len(os.Args) > 1 && os.Args[1] == "export"
+	var exportOpts exportOptions
+	if exportMode {
+		var err error
+		exportOpts, err = parseExportFlags(os.Args[2:])
+		if err == flag.ErrHelp {
+			return
+		}
+		if err != nil {
+			log.Fatalln("failed to parse export flags:", err.Error())
+		}
+	}
+
+	// The login procedure takes the token from a file (if using Vault Agent)
+	// or requests one for itself (Kubernetes Auth), so if we got a VAULT_TOKEN
+	// for the special value with "vault:login"
+	originalVaultTokenEnvVar := os.Getenv("VAULT_TOKEN")
+	if originalVaultTokenEnvVar == vaultLogin {
+		os.Unsetenv("VAULT_TOKEN")
+	}
+
+	client, err := vault.NewClientWithOptions(
+		vault.ClientRole(os.Getenv("VAULT_ROLE")),
+		vault.ClientAuthPath(os.Getenv("VAULT_PATH")),
+	)
+	if err != nil {
+		log.Fatal("failed to create vault client", err.Error())
+	}
+
+	// file mode: write the secret files (e.g. in an init container) instead of executing a command
+	if secretFiles := os.Getenv("VAULT_SECRET_FILES"); secretFiles != "" {
+		if err := writeSecretFiles(client, secretFiles, ignoreMissingSecrets); err != nil {
+			log.Fatalln("failed to write secret files:", err.Error())
+		}
+		return
+	}
+
+	passthroughEnvVars := strings.Split(os.Getenv("VAULT_ENV_PASSTHROUGH"), ",")
+
+	if originalVaultTokenEnvVar == vaultLogin {
+		os.Setenv("VAULT_TOKEN", vaultLogin)
+		passthroughEnvVars = append(passthroughEnvVars, "VAULT_TOKEN")
+	}
+
+	// do not sanitize env vars specified in VAULT_ENV_PASSTHROUGH
+	for _, envVar := range passthroughEnvVars {
+		if trimmed := strings.TrimSpace(envVar); trimmed != "" {
+			delete(sanitizeEnvmap, trimmed)
+		}
+	}
+
+	if exportMode {
+		if err := export(client, exportOpts, ignoreMissingSecrets); err != nil {
+			log.Fatalln("failed to export variables:", err.Error())
+		}
+		return
+	}
+
+	sanitized, secrets, err := resolveEnviron(client, syscall.Environ(), ignoreMissingSecrets)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
 	var entrypointCmd []string
 	if len(os.Args) == 1 {
 		log.Fatalln("no command is given, vault-env can't determine the entrypoint (command), please specify it explicitly or let the webhook query it (see documentation)")
@@ -205,6 +348,15 @@ func main() {
 	if err != nil {
 		log.Fatalln("binary not found", entrypointCmd[0])
 	}
+
+	if os.Getenv("VAULT_ENV_DAEMON") == "true" {
+		daemon, err := newDaemon(client, binary, entrypointCmd, ignoreMissingSecrets)
+		if err != nil {
+			log.Fatalln("failed to configure daemon mode:", err.Error())
+		}
+		os.Exit(daemon.run(sanitized, secrets))
+	}
+
 	err = syscall.Exec(binary, entrypointCmd, sanitized)
 	if err != nil {
 		log.Fatalln("failed to exec process", binary, entrypointCmd, err.Error())
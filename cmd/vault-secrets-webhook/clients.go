@@ -0,0 +1,228 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+var (
+	vaultClientCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vault_secrets_webhook_vault_client_cache_requests_total",
+		Help: "Number of Vault client pool lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	secretCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vault_secrets_webhook_secret_cache_requests_total",
+		Help: "Number of Vault secret read cache lookups by result (hit or miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(vaultClientCacheRequests, secretCacheRequests)
+}
+
+// vaultClientPool holds the Vault clients by their identity (address, auth path, role, and the ServiceAccount
+// in namespace auth mode), so the token of a client is reused by the admission requests, instead of logging in
+// every time. The clients which were not used for the idle timeout, or reached their maximum age are closed.
+// The clients are created without holding the lock, so a slow login doesn't block the other keys, and the
+// concurrent requests of a key wait for the one login in progress.
+type vaultClientPool struct {
+	mu       sync.Mutex
+	clients  map[string]*pooledVaultClient
+	creating map[string]*creatingVaultClient
+}
+
+type pooledVaultClient struct {
+	client   *vault.Client
+	lastUsed time.Time
+	// the client is not used after this time, if it is not zero
+	expires time.Time
+}
+
+// creatingVaultClient is a client being created, done is closed when client and err are set
+type creatingVaultClient struct {
+	done   chan struct{}
+	client *vault.Client
+	err    error
+}
+
+// newPooledVaultClient creates a client for the pool, with the maximum age of the client (0 means no limit)
+type newPooledVaultClient func() (*vault.Client, time.Duration, error)
+
+var vaultClients = &vaultClientPool{
+	clients:  map[string]*pooledVaultClient{},
+	creating: map[string]*creatingVaultClient{},
+}
+
+func vaultClientKey(vaultConfig vaultConfig) string {
+	return fmt.Sprintf("%s|%s|%s|%s", vaultConfig.addr, vaultConfig.role, vaultConfig.path, vaultConfig.skipVerify)
+}
+
+// get returns the client of the key from the pool, or creates one
+func (p *vaultClientPool) get(key string, create newPooledVaultClient) (*vault.Client, error) {
+	p.mu.Lock()
+
+	now := time.Now()
+	idleTimeout := viper.GetDuration("vault_client_idle_timeout")
+
+	for key, pooled := range p.clients {
+		if now.Sub(pooled.lastUsed) > idleTimeout || (!pooled.expires.IsZero() && now.After(pooled.expires)) {
+			logger.Debugf("closing idle or expired Vault client %s", key)
+			pooled.client.Close()
+			delete(p.clients, key)
+		}
+	}
+
+	if pooled, ok := p.clients[key]; ok {
+		vaultClientCacheRequests.WithLabelValues("hit").Inc()
+		pooled.lastUsed = now
+		p.mu.Unlock()
+		return pooled.client, nil
+	}
+
+	if creating, ok := p.creating[key]; ok {
+		p.mu.Unlock()
+		<-creating.done
+		if creating.err == nil {
+			vaultClientCacheRequests.WithLabelValues("hit").Inc()
+		}
+		return creating.client, creating.err
+	}
+
+	vaultClientCacheRequests.WithLabelValues("miss").Inc()
+
+	creating := &creatingVaultClient{done: make(chan struct{})}
+	p.creating[key] = creating
+	p.mu.Unlock()
+
+	client, maxAge, err := create()
+
+	p.mu.Lock()
+	delete(p.creating, key)
+	if err == nil {
+		now = time.Now()
+		pooled := &pooledVaultClient{client: client, lastUsed: now}
+		if maxAge > 0 {
+			pooled.expires = now.Add(maxAge)
+		}
+		p.clients[key] = pooled
+	}
+	p.mu.Unlock()
+
+	creating.client, creating.err = client, err
+	close(creating.done)
+
+	return client, err
+}
+
+// release returns the client to the pool, the client is closed and removed from the pool if its token is no
+// longer valid, so the next request logs in again. The other errors, e.g. a permission denied on a path, are
+// specific to the request, and the client stays in the pool for the other requests using it.
+func (p *vaultClientPool) release(key string, client *vault.Client, err error) {
+	if err == nil || !vaultAuthError(err) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pooled, ok := p.clients[key]; ok && pooled.client == client {
+		delete(p.clients, key)
+	}
+
+	client.Close()
+}
+
+// vaultAuthError returns true if the error of a Vault request means that the token of the client is not valid
+func vaultAuthError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "Code: 401") ||
+		strings.Contains(message, "invalid token") ||
+		strings.Contains(message, "missing client token")
+}
+
+// secretCache is the optional read cache of the Secret and ConfigMap mutation, it holds the
+// data of the secrets read by a client for a short time, and it is disabled if the TTL is 0
+type secretCache struct {
+	once  sync.Once
+	cache *lru.Cache
+	ttl   time.Duration
+}
+
+type secretCacheEntry struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+var secretReadCache = &secretCache{}
+
+func (c *secretCache) init() {
+	c.once.Do(func() {
+		c.ttl = viper.GetDuration("vault_read_cache_ttl")
+		if c.ttl <= 0 {
+			return
+		}
+
+		cache, err := lru.New(viper.GetInt("vault_read_cache_size"))
+		if err != nil {
+			logger.Errorf("failed to create Vault read cache, reads are not cached: %s", err.Error())
+			return
+		}
+		c.cache = cache
+	})
+}
+
+// read returns the data of the secret from the cache, or reads it with the client, the entries
+// are separated by the token of the client, so a role never sees the secrets read with another role
+func (c *secretCache) read(vaultClient *vault.Client, path, version string) (map[string]interface{}, error) {
+	c.init()
+
+	if c.cache == nil {
+		return readVaultData(vaultClient, path, version)
+	}
+
+	token := sha256.Sum256([]byte(vaultClient.RawClient().Token()))
+	key := fmt.Sprintf("%x|%s|%s", token, path, version)
+
+	if value, ok := c.cache.Get(key); ok {
+		entry := value.(secretCacheEntry)
+		if time.Now().Before(entry.expires) {
+			secretCacheRequests.WithLabelValues("hit").Inc()
+			return entry.data, nil
+		}
+		c.cache.Remove(key)
+	}
+
+	secretCacheRequests.WithLabelValues("miss").Inc()
+
+	data, err := readVaultData(vaultClient, path, version)
+	if err != nil || data == nil {
+		return data, err
+	}
+
+	c.cache.Add(key, secretCacheEntry{data: data, expires: time.Now().Add(c.ttl)})
+
+	return data, nil
+}
@@ -18,7 +18,6 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/banzaicloud/bank-vaults/pkg/vault"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -31,26 +30,31 @@ func configMapNeedsMutation(configMap *corev1.ConfigMap) bool {
 	return false
 }
 
-func mutateConfigMap(configMap *corev1.ConfigMap, vaultConfig vaultConfig, ns string) error {
+func (mw *mutatingWebhook) mutateConfigMap(configMap *corev1.ConfigMap, vaultConfig vaultConfig, ns string) (err error) {
 
 	// do an early exit and don't construct the Vault client if not needed
 	if !configMapNeedsMutation(configMap) {
 		return nil
 	}
 
-	vaultClient, err := newVaultClient(vaultConfig)
+	vaultReader, release, err := mw.vaultReaderFor(vaultConfig, ns)
 	if err != nil {
 		return fmt.Errorf("failed to create vault client: %v", err)
 	}
 
-	defer vaultClient.Close()
+	defer func() { release(err) }()
 
+	return mutateConfigMapKeys(configMap, vaultReader)
+}
+
+// mutateConfigMapKeys resolves the Vault references of the keys of the ConfigMap with the reader
+func mutateConfigMapKeys(configMap *corev1.ConfigMap, vaultReader *vaultReader) error {
 	for key, value := range configMap.Data {
 		if strings.HasPrefix(value, "vault:") {
 			data := map[string]string{
 				key: string(value),
 			}
-			err := mutateConfigMapData(configMap, data, vaultClient)
+			err := mutateConfigMapData(configMap, data, vaultReader)
 			if err != nil {
 				return err
 			}
@@ -60,8 +64,8 @@ func mutateConfigMap(configMap *corev1.ConfigMap, vaultConfig vaultConfig, ns st
 	return nil
 }
 
-func mutateConfigMapData(configMap *corev1.ConfigMap, data map[string]string, vaultClient *vault.Client) error {
-	mapData, err := getDataFromVault(data, vaultClient)
+func mutateConfigMapData(configMap *corev1.ConfigMap, data map[string]string, vaultReader *vaultReader) error {
+	mapData, err := getDataFromVault(data, vaultReader)
 	if err != nil {
 		return err
 	}
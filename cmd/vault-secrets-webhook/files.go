@@ -0,0 +1,225 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	secretFilesVolumeName    = "vault-secret-files"
+	secretFilesInitMount     = "/vault-secret-files"
+	secretFileTemplatePrefix = "vault.security.banzaicloud.io/vault-secret-file-template-"
+)
+
+// secretFile is a file written by the vault-env file mode, it is passed in VAULT_SECRET_FILES as a JSON list
+type secretFile struct {
+	Path      string `json:"path"`
+	Reference string `json:"reference"`
+	Format    string `json:"format"`
+	Template  string `json:"template,omitempty"`
+}
+
+// parseSecretFiles parses the vault-secret-files annotation, which holds file=reference pairs separated
+// by commas or new lines. The format of a file is template if there is a template annotation for its
+// base name, raw if the reference selects a key, dotenv for .env files, and JSON otherwise.
+func parseSecretFiles(vaultConfig vaultConfig) ([]secretFile, error) {
+	var files []secretFile
+	seen := map[string]bool{}
+
+	entries := strings.FieldsFunc(vaultConfig.secretFiles, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid secret file %q, the format is /path/of/file=vault:path", entry)
+		}
+
+		filePath, reference := path.Clean(strings.TrimSpace(split[0])), strings.TrimSpace(split[1])
+
+		if !path.IsAbs(filePath) || path.Dir(filePath) == "/" {
+			return nil, fmt.Errorf("invalid secret file %q, the path must be absolute and not in the root directory", filePath)
+		}
+		if !strings.HasPrefix(reference, "vault:") {
+			return nil, fmt.Errorf("invalid secret file %q, the reference must start with vault:", filePath)
+		}
+		if seen[filePath] {
+			return nil, fmt.Errorf("duplicate secret file %q", filePath)
+		}
+		seen[filePath] = true
+
+		file := secretFile{Path: filePath, Reference: reference}
+
+		if tmpl, ok := vaultConfig.secretFileTemplates[path.Base(filePath)]; ok {
+			file.Format = "template"
+			file.Template = tmpl
+		} else if strings.Contains(reference, "#") {
+			file.Format = "raw"
+		} else if path.Ext(filePath) == ".env" {
+			file.Format = "dotenv"
+		} else {
+			file.Format = "json"
+		}
+
+		files = append(files, file)
+	}
+
+	if _, err := strconv.ParseUint(vaultConfig.secretFilesMode, 8, 32); err != nil {
+		return nil, fmt.Errorf("invalid secret files mode %q: %v", vaultConfig.secretFilesMode, err)
+	}
+
+	return files, nil
+}
+
+// secretFileSubPath returns the path of a secret file in the secret files volume
+func secretFileSubPath(i int) string {
+	return fmt.Sprintf("file-%d", i)
+}
+
+// addSecretFilesVolToContainers mounts every secret file into the containers on its own, with a sub path of the
+// secret files volume, so the other files of the directory of a secret file (e.g. the config of the application)
+// are not hidden
+func addSecretFilesVolToContainers(containers []corev1.Container, files []secretFile) {
+	for i, container := range containers {
+		logger.Debugf("Add secret files VolumeMounts to container %s", container.Name)
+
+		for j, file := range files {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      secretFilesVolumeName,
+				MountPath: file.Path,
+				SubPath:   secretFileSubPath(j),
+				ReadOnly:  true,
+			})
+		}
+
+		containers[i] = container
+	}
+}
+
+func parseSecretFilesOwner(owner string) (*int64, *int64, error) {
+	if owner == "" {
+		return nil, nil, nil
+	}
+
+	split := strings.SplitN(owner, ":", 2)
+
+	uid, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid secret files owner %q: %v", owner, err)
+	}
+
+	if len(split) == 1 {
+		return &uid, nil, nil
+	}
+
+	gid, err := strconv.ParseInt(split[1], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid secret files owner %q: %v", owner, err)
+	}
+
+	return &uid, &gid, nil
+}
+
+// getSecretFilesInitContainer returns the init container which writes the secret files with vault-env,
+// it runs as the owner of the files if it is set, otherwise with the security context of the Pod
+func getSecretFilesInitContainer(originalContainers []corev1.Container, vaultConfig vaultConfig, files []secretFile, containerEnvVars []corev1.EnvVar, containerVolMounts []corev1.VolumeMount) (corev1.Container, error) {
+	initFiles := make([]secretFile, 0, len(files))
+	for i, file := range files {
+		file.Path = path.Join(secretFilesInitMount, secretFileSubPath(i))
+		initFiles = append(initFiles, file)
+	}
+
+	filesJSON, err := json.Marshal(initFiles)
+	if err != nil {
+		return corev1.Container{}, fmt.Errorf("failed to marshal secret files: %v", err)
+	}
+
+	runAsUser, runAsGroup, err := parseSecretFilesOwner(vaultConfig.secretFilesOwner)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	envVars := append([]corev1.EnvVar{}, containerEnvVars...)
+	envVars = append(envVars, []corev1.EnvVar{
+		{
+			Name:  "VAULT_PATH",
+			Value: vaultConfig.path,
+		},
+		{
+			Name:  "VAULT_ROLE",
+			Value: vaultConfig.role,
+		},
+		{
+			Name:  "VAULT_IGNORE_MISSING_SECRETS",
+			Value: vaultConfig.ignoreMissingSecrets,
+		},
+		{
+			Name:  "VAULT_SECRET_FILES",
+			Value: string(filesJSON),
+		},
+		{
+			Name:  "VAULT_SECRET_FILES_MODE",
+			Value: vaultConfig.secretFilesMode,
+		},
+	}...)
+
+	if vaultConfig.useAgent {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "VAULT_TOKEN_PATH",
+			Value: "/vault/.vault-token",
+		})
+	}
+
+	volumeMounts := append([]corev1.VolumeMount{}, containerVolMounts...)
+	volumeMounts = append(volumeMounts, corev1.VolumeMount{
+		Name:      secretFilesVolumeName,
+		MountPath: secretFilesInitMount,
+	})
+	if serviceAccountMount, ok := findServiceAccountMount(originalContainers); ok {
+		volumeMounts = append(volumeMounts, serviceAccountMount)
+	}
+
+	return corev1.Container{
+		Name:            "vault-secret-files",
+		Image:           viper.GetString("vault_env_image"),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"vault-env"},
+		Env:             envVars,
+		VolumeMounts:    volumeMounts,
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                runAsUser,
+			RunAsGroup:               runAsGroup,
+			AllowPrivilegeEscalation: &vaultConfig.pspAllowPrivilegeEscalation,
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+	}, nil
+}
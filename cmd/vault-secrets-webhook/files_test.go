@@ -0,0 +1,114 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecretFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		secretFiles string
+		templates   map[string]string
+		mode        string
+		expected    []secretFile
+		fails       bool
+	}{
+		{
+			name:        "formats",
+			secretFiles: "/etc/app/password=vault:secret/data/db#password, /etc/app/db.env=vault:secret/data/db\n/etc/app/db.json=vault:secret/data/db",
+			expected: []secretFile{
+				{Path: "/etc/app/password", Reference: "vault:secret/data/db#password", Format: "raw"},
+				{Path: "/etc/app/db.env", Reference: "vault:secret/data/db", Format: "dotenv"},
+				{Path: "/etc/app/db.json", Reference: "vault:secret/data/db", Format: "json"},
+			},
+		},
+		{
+			name:        "template",
+			secretFiles: "/etc/app/config.yml=vault:secret/data/db",
+			templates:   map[string]string{"config.yml": "password: {{ .password }}"},
+			expected: []secretFile{
+				{Path: "/etc/app/config.yml", Reference: "vault:secret/data/db", Format: "template", Template: "password: {{ .password }}"},
+			},
+		},
+		{
+			name:        "cleaned path",
+			secretFiles: "/etc/app/../app/./password=vault:secret/data/db#password",
+			expected: []secretFile{
+				{Path: "/etc/app/password", Reference: "vault:secret/data/db#password", Format: "raw"},
+			},
+		},
+		{
+			name:        "missing reference",
+			secretFiles: "/etc/app/password",
+			fails:       true,
+		},
+		{
+			name:        "relative path",
+			secretFiles: "password=vault:secret/data/db#password",
+			fails:       true,
+		},
+		{
+			name:        "root directory",
+			secretFiles: "/password=vault:secret/data/db#password",
+			fails:       true,
+		},
+		{
+			name:        "not a vault reference",
+			secretFiles: "/etc/app/password=s3cr3t",
+			fails:       true,
+		},
+		{
+			name:        "duplicate file",
+			secretFiles: "/etc/app/password=vault:secret/data/db#password,/etc/app/password=vault:secret/data/cache#password",
+			fails:       true,
+		},
+		{
+			name:        "invalid mode",
+			secretFiles: "/etc/app/password=vault:secret/data/db#password",
+			mode:        "0999",
+			fails:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mode := test.mode
+			if mode == "" {
+				mode = "0400"
+			}
+
+			files, err := parseSecretFiles(vaultConfig{
+				secretFiles:         test.secretFiles,
+				secretFileTemplates: test.templates,
+				secretFilesMode:     mode,
+			})
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(files, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, files)
+			}
+		})
+	}
+}
@@ -29,7 +29,10 @@ import (
 	whhttp "github.com/slok/kubewebhook/pkg/http"
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
 	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -57,7 +60,16 @@ type vaultConfig struct {
 	pspAllowPrivilegeEscalation bool
 	ignoreMissingSecrets        string
 	vaultEnvPassThrough         string
+	vaultEnvDaemon              bool
+	vaultEnvFromPath            string
+	vaultEnvFromPathPrefix      string
 	mutateConfigMap             bool
+	secretFiles                 string
+	secretFilesMode             string
+	secretFilesOwner            string
+	secretFileTemplates         map[string]string
+	roleAnnotated               bool
+	serviceAccount              string
 }
 
 var vaultAgentConfig = `
@@ -94,21 +106,23 @@ func hasTLSVolume(volumes []corev1.Volume) bool {
 	return false
 }
 
+// findServiceAccountMount returns the ServiceAccount token mount of the containers, if there is any
+func findServiceAccountMount(containers []corev1.Container) (corev1.VolumeMount, bool) {
+	for _, container := range containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.MountPath == "/var/run/secrets/kubernetes.io/serviceaccount" {
+				return mount, true
+			}
+		}
+	}
+	return corev1.VolumeMount{}, false
+}
+
 func getInitContainers(originalContainers []corev1.Container, vaultConfig vaultConfig, initContainersMutated bool, containersMutated bool, containerEnvVars []corev1.EnvVar, containerVolMounts []corev1.VolumeMount) []corev1.Container {
 	var containers = []corev1.Container{}
 
 	if vaultConfig.useAgent || vaultConfig.ctConfigMap != "" {
-		var serviceAccountMount corev1.VolumeMount
-
-	mountSearch:
-		for _, container := range originalContainers {
-			for _, mount := range container.VolumeMounts {
-				if mount.MountPath == "/var/run/secrets/kubernetes.io/serviceaccount" {
-					serviceAccountMount = mount
-					break mountSearch
-				}
-			}
-		}
+		serviceAccountMount, _ := findServiceAccountMount(originalContainers)
 
 		containerVolMounts = append(containerVolMounts, serviceAccountMount, corev1.VolumeMount{
 			Name:      "vault-agent-config",
@@ -299,6 +313,19 @@ func getVolumes(existingVolumes []corev1.Volume, agentConfigMapName string, vaul
 			})
 	}
 
+	if vaultConfig.secretFiles != "" {
+		logger.Debugf("Add secret files volume to podspec")
+
+		volumes = append(volumes, corev1.Volume{
+			Name: secretFilesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					Medium: corev1.StorageMediumMemory,
+				},
+			},
+		})
+	}
+
 	return volumes
 }
 
@@ -308,12 +335,26 @@ func (mw *mutatingWebhook) vaultSecretsMutator(ctx context.Context, obj metav1.O
 		return false, mw.mutatePod(v, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace, whcontext.IsAdmissionRequestDryRun(ctx))
 	case *corev1.Secret:
 		if _, ok := obj.GetAnnotations()["vault.security.banzaicloud.io/vault-addr"]; ok {
-			return false, mutateSecret(v, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
+			if viper.GetBool("secret_sync") {
+				old, err := oldSecret(ctx)
+				if err != nil {
+					return false, err
+				}
+				return false, mw.admitSecret(v, old, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
+			}
+			return false, mw.mutateSecret(v, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
 		}
 		return false, nil
 	case *corev1.ConfigMap:
 		if _, ok := obj.GetAnnotations()["vault.security.banzaicloud.io/mutate-configmap"]; ok {
-			return false, mutateConfigMap(v, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
+			if viper.GetBool("secret_sync") {
+				old, err := oldConfigMap(ctx)
+				if err != nil {
+					return false, err
+				}
+				return false, mw.admitConfigMap(v, old, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
+			}
+			return false, mw.mutateConfigMap(v, parseVaultConfig(obj), whcontext.GetAdmissionRequest(ctx).Namespace)
 		}
 		return false, nil
 	default:
@@ -332,6 +373,7 @@ func parseVaultConfig(obj metav1.Object) vaultConfig {
 	}
 
 	vaultConfig.role = annotations["vault.security.banzaicloud.io/vault-role"]
+	vaultConfig.roleAnnotated = vaultConfig.role != ""
 	if vaultConfig.role == "" {
 		switch p := obj.(type) {
 		case *corev1.Pod:
@@ -388,6 +430,15 @@ func parseVaultConfig(obj metav1.Object) vaultConfig {
 		vaultConfig.vaultEnvPassThrough = viper.GetString("vault_env_passthrough")
 	}
 
+	if val, ok := annotations["vault.security.banzaicloud.io/vault-env-daemon"]; ok {
+		vaultConfig.vaultEnvDaemon, _ = strconv.ParseBool(val)
+	} else {
+		vaultConfig.vaultEnvDaemon, _ = strconv.ParseBool(viper.GetString("vault_env_daemon"))
+	}
+
+	vaultConfig.vaultEnvFromPath = annotations["vault.security.banzaicloud.io/vault-env-from-path"]
+	vaultConfig.vaultEnvFromPathPrefix = annotations["vault.security.banzaicloud.io/vault-env-from-path-prefix"]
+
 	if val, ok := annotations["vault.security.banzaicloud.io/vault-ct-pull-policy"]; ok {
 		switch val {
 		case "Never", "never":
@@ -439,6 +490,29 @@ func parseVaultConfig(obj metav1.Object) vaultConfig {
 		vaultConfig.mutateConfigMap, _ = strconv.ParseBool(viper.GetString("mutate_configmap"))
 	}
 
+	if val, ok := annotations["vault.security.banzaicloud.io/vault-serviceaccount"]; ok {
+		vaultConfig.serviceAccount = val
+	} else {
+		vaultConfig.serviceAccount = "default"
+	}
+
+	vaultConfig.secretFiles = annotations["vault.security.banzaicloud.io/vault-secret-files"]
+
+	if val, ok := annotations["vault.security.banzaicloud.io/vault-secret-files-mode"]; ok {
+		vaultConfig.secretFilesMode = val
+	} else {
+		vaultConfig.secretFilesMode = viper.GetString("vault_secret_files_mode")
+	}
+
+	vaultConfig.secretFilesOwner = annotations["vault.security.banzaicloud.io/vault-secret-files-owner"]
+
+	vaultConfig.secretFileTemplates = map[string]string{}
+	for key, val := range annotations {
+		if strings.HasPrefix(key, secretFileTemplatePrefix) {
+			vaultConfig.secretFileTemplates[strings.TrimPrefix(key, secretFileTemplatePrefix)] = val
+		}
+	}
+
 	return vaultConfig
 }
 
@@ -565,7 +639,7 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 		}
 
 		for _, env := range container.Env {
-			if strings.HasPrefix(env.Value, "vault:") {
+			if strings.HasPrefix(env.Value, "vault:") || strings.HasPrefix(env.Value, ">>vault:") {
 				envVars = append(envVars, env)
 			}
 			if env.ValueFrom != nil {
@@ -580,7 +654,7 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 			}
 		}
 
-		if len(envVars) == 0 {
+		if len(envVars) == 0 && vaultConfig.vaultEnvFromPath == "" {
 			continue
 		}
 
@@ -663,6 +737,26 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 			})
 		}
 
+		if vaultConfig.vaultEnvFromPath != "" {
+			container.Env = append(container.Env, []corev1.EnvVar{
+				{
+					Name:  "VAULT_ENV_FROM_PATH",
+					Value: vaultConfig.vaultEnvFromPath,
+				},
+				{
+					Name:  "VAULT_ENV_FROM_PATH_PREFIX",
+					Value: vaultConfig.vaultEnvFromPathPrefix,
+				},
+			}...)
+		}
+
+		if vaultConfig.vaultEnvDaemon {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  "VAULT_ENV_DAEMON",
+				Value: "true",
+			})
+		}
+
 		if vaultConfig.useAgent {
 			container.Env = append(container.Env, corev1.EnvVar{
 				Name:  "VAULT_TOKEN_FILE",
@@ -693,7 +787,7 @@ func addSecretsVolToContainers(containers []corev1.Container, logger *log.Logger
 	}
 }
 
-func newVaultClient(vaultConfig vaultConfig) (*vault.Client, error) {
+func newVaultClientConfig(vaultConfig vaultConfig) (*vaultapi.Config, error) {
 	clientConfig := vaultapi.DefaultConfig()
 	clientConfig.Address = vaultConfig.addr
 
@@ -706,6 +800,15 @@ func newVaultClient(vaultConfig vaultConfig) (*vault.Client, error) {
 
 	clientConfig.ConfigureTLS(&tlsConfig)
 
+	return clientConfig, nil
+}
+
+func newVaultClient(vaultConfig vaultConfig) (*vault.Client, error) {
+	clientConfig, err := newVaultClientConfig(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	return vault.NewClientFromConfig(
 		clientConfig,
 		vault.ClientRole(vaultConfig.role),
@@ -788,7 +891,12 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, vaultConfig vaultConfig, n
 		})
 	}
 
-	if initContainersMutated || containersMutated || vaultConfig.ctConfigMap != "" {
+	secretFiles, err := parseSecretFiles(vaultConfig)
+	if err != nil {
+		return err
+	}
+
+	if initContainersMutated || containersMutated || vaultConfig.ctConfigMap != "" || len(secretFiles) > 0 {
 		var agentConfigMapName string
 
 		if vaultConfig.useAgent || vaultConfig.ctConfigMap != "" {
@@ -811,7 +919,21 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, vaultConfig vaultConfig, n
 
 		}
 
-		pod.Spec.InitContainers = append(getInitContainers(pod.Spec.Containers, vaultConfig, initContainersMutated, containersMutated, containerEnvVars, containerVolMounts), pod.Spec.InitContainers...)
+		initContainers := getInitContainers(pod.Spec.Containers, vaultConfig, initContainersMutated, containersMutated, containerEnvVars, containerVolMounts)
+
+		if len(secretFiles) > 0 {
+			secretFilesContainer, err := getSecretFilesInitContainer(pod.Spec.Containers, vaultConfig, secretFiles, containerEnvVars, containerVolMounts)
+			if err != nil {
+				return err
+			}
+			initContainers = append(initContainers, secretFilesContainer)
+
+			addSecretFilesVolToContainers(pod.Spec.InitContainers, secretFiles)
+			addSecretFilesVolToContainers(pod.Spec.Containers, secretFiles)
+			logger.Debugf("Successfully added secret files to pod spec")
+		}
+
+		pod.Spec.InitContainers = append(initContainers, pod.Spec.InitContainers...)
 		logger.Debugf("Successfully appended pod init containers to spec")
 
 		pod.Spec.Volumes = append(pod.Spec.Volumes, getVolumes(pod.Spec.Volumes, agentConfigMapName, vaultConfig, logger)...)
@@ -862,11 +984,27 @@ func init() {
 	viper.SetDefault("psp_allow_privilege_escalation", "false")
 	viper.SetDefault("vault_ignore_missing_secrets", "false")
 	viper.SetDefault("vault_env_passthrough", "")
+	viper.SetDefault("vault_env_daemon", "false")
 	viper.SetDefault("mutate_configmap", "false")
+	viper.SetDefault("vault_secret_files_mode", "0400")
 	viper.SetDefault("listen_address", ":8443")
 	viper.SetDefault("default_image_pull_secret", "")
 	viper.SetDefault("default_image_pull_secret_namespace", "")
 	viper.SetDefault("registry_skip_verify", "false")
+	viper.SetDefault("image_cache_size", 1000)
+	viper.SetDefault("image_cache_ttl", "1h")
+	viper.SetDefault("vault_client_idle_timeout", "10m")
+	viper.SetDefault("vault_read_cache_ttl", "0")
+	viper.SetDefault("vault_read_cache_size", 1000)
+	viper.SetDefault("vault_secret_auth", secretAuthWebhook)
+	viper.SetDefault("vault_namespace_role", "{namespace}")
+	viper.SetDefault("vault_namespace_token_audience", serviceAccountTokenAudience)
+	viper.SetDefault("vault_path_allowlist", "")
+	viper.SetDefault("secret_sync", "false")
+	viper.SetDefault("secret_sync_period", "5m")
+	viper.SetDefault("secret_sync_rollout", "false")
+	viper.SetDefault("secret_sync_lock_namespace", "")
+	viper.SetDefault("pod_validation_mode", podValidationEnforce)
 	viper.SetDefault("debug", "false")
 	viper.AutomaticEnv()
 
@@ -895,6 +1033,20 @@ func handlerFor(config mutating.WebhookConfig, mutator mutating.MutatorFunc, log
 	return handler
 }
 
+func validatingHandlerFor(config validating.WebhookConfig, validator validating.ValidatorFunc, logger *log.Logger) http.Handler {
+	webhook, err := validating.NewWebhook(config, validator, nil, nil, logger)
+	if err != nil {
+		logger.Fatalf("error creating webhook: %s", err)
+	}
+
+	handler, err := whhttp.HandlerFor(webhook)
+	if err != nil {
+		logger.Fatalf("error creating webhook: %s", err)
+	}
+
+	return handler
+}
+
 var logger *log.Logger
 
 func main() {
@@ -907,14 +1059,30 @@ func main() {
 
 	mutator := mutating.MutatorFunc(mutatingWebhook.vaultSecretsMutator)
 
+	if viper.GetBool("secret_sync") {
+		go runSecretSync(&mutatingWebhook)
+	}
+
 	podHandler := handlerFor(mutating.WebhookConfig{Name: "vault-secrets-pods", Obj: &corev1.Pod{}}, mutator, logger)
 	secretHandler := handlerFor(mutating.WebhookConfig{Name: "vault-secrets-secret", Obj: &corev1.Secret{}}, mutator, logger)
 	configMapHandler := handlerFor(mutating.WebhookConfig{Name: "vault-secrets-configmap", Obj: &corev1.ConfigMap{}}, mutator, logger)
+	validator := validating.ValidatorFunc(mutatingWebhook.vaultSecretsValidator)
+
+	podValidationHandler := validatingHandlerFor(validating.WebhookConfig{Name: "vault-secrets-pods-validation", Obj: &corev1.Pod{}}, validator, logger)
+	deploymentValidationHandler := validatingHandlerFor(validating.WebhookConfig{Name: "vault-secrets-deployments-validation", Obj: &appsv1.Deployment{}}, validator, logger)
+	statefulSetValidationHandler := validatingHandlerFor(validating.WebhookConfig{Name: "vault-secrets-statefulsets-validation", Obj: &appsv1.StatefulSet{}}, validator, logger)
+	daemonSetValidationHandler := validatingHandlerFor(validating.WebhookConfig{Name: "vault-secrets-daemonsets-validation", Obj: &appsv1.DaemonSet{}}, validator, logger)
+	jobValidationHandler := validatingHandlerFor(validating.WebhookConfig{Name: "vault-secrets-jobs-validation", Obj: &batchv1.Job{}}, validator, logger)
 
 	mux := http.NewServeMux()
 	mux.Handle("/pods", podHandler)
 	mux.Handle("/secrets", secretHandler)
 	mux.Handle("/configmaps", configMapHandler)
+	mux.Handle("/validate-pods", podValidationHandler)
+	mux.Handle("/validate-deployments", deploymentValidationHandler)
+	mux.Handle("/validate-statefulsets", statefulSetValidationHandler)
+	mux.Handle("/validate-daemonsets", daemonSetValidationHandler)
+	mux.Handle("/validate-jobs", jobValidationHandler)
 	mux.Handle("/healthz", http.HandlerFunc(healthzHandler))
 	mux.Handle("/metrics", promhttp.Handler())
 
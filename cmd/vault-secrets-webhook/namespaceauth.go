@@ -0,0 +1,224 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// The authentication modes of the Secret and ConfigMap mutation
+const (
+	// secretAuthWebhook authenticates with the Vault role of the webhook
+	secretAuthWebhook = "webhook"
+	// secretAuthNamespace authenticates with a token of a ServiceAccount of the namespace of the object
+	secretAuthNamespace = "namespace"
+)
+
+// the lifetime of the ServiceAccount tokens requested for the login, it is the minimum allowed
+const serviceAccountTokenExpiration = int64(600)
+
+// the default audience of the ServiceAccount tokens requested for the login, the Kubernetes API doesn't accept
+// them, so they are useless for anything but logging in to Vault
+const serviceAccountTokenAudience = "vault"
+
+// vaultReader reads the secrets for the mutation of an object in a namespace, through the read cache
+type vaultReader struct {
+	client    *vault.Client
+	namespace string
+	// err is the last failed read, the mutation resolves the references of the failed reads to empty
+	// values, so the sync controller checks it before storing the result
+	err error
+}
+
+// pathNotAllowedError is returned if the path is not in the allowlist of the namespace
+type pathNotAllowedError struct {
+	namespace string
+	path      string
+}
+
+func (e pathNotAllowedError) Error() string {
+	return fmt.Sprintf("path %s is not allowed in namespace %s", e.path, e.namespace)
+}
+
+func (r *vaultReader) read(path, version string) (map[string]interface{}, error) {
+	plainPath, _, err := vault.SplitParams(path)
+	if err != nil {
+		return nil, err
+	}
+	if !vaultPathAllowed(r.namespace, plainPath) {
+		return nil, pathNotAllowedError{namespace: r.namespace, path: path}
+	}
+	data, err := secretReadCache.read(r.client, path, version)
+	if err != nil {
+		r.err = err
+	}
+	return data, err
+}
+
+// vaultReaderFor returns a reader with a pooled Vault client for mutating an object in the namespace, the client
+// is authenticated with the Vault role of the webhook, or in namespace auth mode with a ServiceAccount of the
+// namespace. The returned function has to be called with the error of the mutation when it is done, the client
+// is released with the last failed read of the reader if the mutation didn't fail.
+func (mw *mutatingWebhook) vaultReaderFor(vaultConfig vaultConfig, ns string) (*vaultReader, func(error), error) {
+	key := vaultClientKey(vaultConfig)
+	create := func() (*vault.Client, time.Duration, error) {
+		client, err := newVaultClient(vaultConfig)
+		return client, 0, err
+	}
+
+	switch mode := viper.GetString("vault_secret_auth"); mode {
+	case secretAuthWebhook, "":
+
+	case secretAuthNamespace:
+		// the token of the ServiceAccount is sent to the configured Vault only, and not to an address or auth
+		// path given by the object, which anybody who can create the object could point to their own server
+		vaultConfig.addr = viper.GetString("vault_addr")
+		vaultConfig.path = viper.GetString("vault_path")
+		if !vaultConfig.roleAnnotated {
+			vaultConfig.role = strings.Replace(viper.GetString("vault_namespace_role"), "{namespace}", ns, -1)
+		}
+		key = fmt.Sprintf("%s|%s|%s", ns, vaultConfig.serviceAccount, vaultClientKey(vaultConfig))
+		create = func() (*vault.Client, time.Duration, error) {
+			return mw.newNamespaceVaultClient(vaultConfig, ns)
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("unknown Vault secret auth mode: %s", mode)
+	}
+
+	client, err := vaultClients.get(key, create)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader := &vaultReader{client: client, namespace: ns}
+
+	release := func(err error) {
+		if err == nil {
+			err = reader.err
+		}
+		vaultClients.release(key, client, err)
+	}
+
+	return reader, release, nil
+}
+
+// newNamespaceVaultClient logs in to Vault with a token requested for the ServiceAccount of the namespace,
+// the client is used for two thirds of the lifetime of the Vault token
+func (mw *mutatingWebhook) newNamespaceVaultClient(vaultConfig vaultConfig, ns string) (*vault.Client, time.Duration, error) {
+	expiration := serviceAccountTokenExpiration
+	tokenRequest, err := mw.k8sClient.CoreV1().ServiceAccounts(ns).CreateToken(vaultConfig.serviceAccount, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{viper.GetString("vault_namespace_token_audience")},
+			ExpirationSeconds: &expiration,
+		},
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to request token for service account %s/%s: %v", ns, vaultConfig.serviceAccount, err)
+	}
+
+	clientConfig, err := newVaultClientConfig(vaultConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rawClient, err := vaultapi.NewClient(clientConfig)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create vault client: %v", err)
+	}
+
+	// the raw client must not use the token of the webhook from the environment
+	rawClient.ClearToken()
+
+	secret, err := rawClient.Logical().Write(fmt.Sprintf("auth/%s/login", vaultConfig.path), map[string]interface{}{
+		"jwt":  tokenRequest.Status.Token,
+		"role": vaultConfig.role,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to log in to vault as service account %s/%s: %v", ns, vaultConfig.serviceAccount, err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, 0, fmt.Errorf("failed to log in to vault as service account %s/%s: empty response", ns, vaultConfig.serviceAccount)
+	}
+
+	rawClient.SetToken(secret.Auth.ClientToken)
+
+	client, err := vault.NewClientFromRawClient(rawClient)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create vault client: %v", err)
+	}
+
+	return client, time.Duration(secret.Auth.LeaseDuration) * time.Second * 2 / 3, nil
+}
+
+var (
+	pathAllowlist     map[string][]string
+	pathAllowlistErr  error
+	pathAllowlistOnce sync.Once
+)
+
+// vaultPathAllowed returns true if the path has a prefix in the allowlist of the namespace, or of every namespace ("*").
+// {namespace} in the prefixes is replaced with the namespace. Every path is allowed if there is no allowlist, and
+// none of them if the allowlist is invalid.
+func vaultPathAllowed(ns, path string) bool {
+	pathAllowlistOnce.Do(func() {
+		if allowlist := viper.GetString("vault_path_allowlist"); allowlist != "" {
+			pathAllowlistErr = json.Unmarshal([]byte(allowlist), &pathAllowlist)
+			if pathAllowlistErr != nil {
+				logger.Errorf("failed to parse Vault path allowlist, every path is denied: %s", pathAllowlistErr.Error())
+			}
+		}
+	})
+
+	if pathAllowlistErr != nil {
+		return false
+	}
+
+	if pathAllowlist == nil {
+		return true
+	}
+
+	return pathInAllowlist(pathAllowlist, ns, path)
+}
+
+// pathInAllowlist returns true if the path is under a prefix of the allowlist of the namespace, the prefixes
+// match whole path segments, so secret/data/app doesn't allow secret/data/app2
+func pathInAllowlist(allowlist map[string][]string, ns, path string) bool {
+	path = strings.TrimPrefix(path, "/")
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." || segment == "." {
+			return false
+		}
+	}
+
+	prefixes := append(append([]string{}, allowlist["*"]...), allowlist[ns]...)
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(strings.Replace(prefix, "{namespace}", ns, -1), "/")
+		if prefix != "" && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestPathInAllowlist(t *testing.T) {
+	allowlist := map[string][]string{
+		"*":          {"secret/data/{namespace}", "/secret/data/shared/"},
+		"monitoring": {"secret/data/grafana/"},
+	}
+
+	tests := []struct {
+		ns      string
+		path    string
+		allowed bool
+	}{
+		{ns: "app", path: "secret/data/app", allowed: true},
+		{ns: "app", path: "secret/data/app/db", allowed: true},
+		{ns: "app", path: "/secret/data/app/db", allowed: true},
+		{ns: "app", path: "secret/data/shared/ca", allowed: true},
+		{ns: "app", path: "secret/data/app2/db"},
+		{ns: "app", path: "secret/data/app-admin/db"},
+		{ns: "app", path: "secret/data/application"},
+		{ns: "app", path: "secret/data/shared", allowed: true},
+		{ns: "app", path: "secret/data/sharedx/ca"},
+		{ns: "app", path: "secret/data/app/../app2/db"},
+		{ns: "app", path: "secret/data/grafana/admin"},
+		{ns: "monitoring", path: "secret/data/grafana/admin", allowed: true},
+		{ns: "monitoring", path: "secret/data/grafana-admin/password"},
+	}
+
+	for _, test := range tests {
+		if allowed := pathInAllowlist(allowlist, test.ns, test.path); allowed != test.allowed {
+			t.Errorf("expected allowed %t for %s in namespace %s, got %t", test.allowed, test.path, test.ns, allowed)
+		}
+	}
+}
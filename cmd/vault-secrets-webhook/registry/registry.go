@@ -20,10 +20,13 @@ import (
 	"io/ioutil"
 	"strings"
 	"sync"
+	"time"
 
 	dockerTypes "github.com/docker/docker/api/types"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/heroku/docker-registry-client/registry"
 	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	corev1 "k8s.io/api/core/v1"
@@ -34,10 +37,30 @@ import (
 var logger log.FieldLogger
 
 var imageCache ImageCache
+var imageCacheOnce sync.Once
+
+var imageCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_secrets_webhook_image_cache_requests_total",
+	Help: "Number of image config cache lookups by result (hit or miss).",
+}, []string{"result"})
 
 func init() {
 	logger = log.New()
-	imageCache = NewInMemoryImageCache()
+	prometheus.MustRegister(imageCacheRequests)
+}
+
+// getImageCache returns the image cache, it is created on first use, so the configuration is read by then
+func getImageCache() ImageCache {
+	imageCacheOnce.Do(func() {
+		cache, err := NewLRUImageCache(viper.GetInt("image_cache_size"), viper.GetDuration("image_cache_ttl"))
+		if err != nil {
+			logger.Errorf("failed to create LRU image cache, falling back to in-memory cache: %s", err.Error())
+			imageCache = NewInMemoryImageCache()
+			return
+		}
+		imageCache = cache
+	})
+	return imageCache
 }
 
 type ImageCache interface {
@@ -69,6 +92,46 @@ func (c *InMemoryImageCache) Put(image string, imageConfig *imagev1.ImageConfig)
 	c.cache[image] = *imageConfig
 }
 
+// LRUImageCache is an ImageCache holding at most a given number of image configs for a given time
+type LRUImageCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+}
+
+type lruImageCacheEntry struct {
+	imageConfig imagev1.ImageConfig
+	expires     time.Time
+}
+
+// NewLRUImageCache creates an ImageCache which evicts the least recently used image config if it is full,
+// and the image configs older than ttl, 0 ttl means that the image configs don't expire
+func NewLRUImageCache(size int, ttl time.Duration) (ImageCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &LRUImageCache{cache: cache, ttl: ttl}, nil
+}
+
+func (c *LRUImageCache) Get(image string) *imagev1.ImageConfig {
+	value, ok := c.cache.Get(image)
+	if !ok {
+		return nil
+	}
+
+	entry := value.(lruImageCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.cache.Remove(image)
+		return nil
+	}
+
+	return &entry.imageConfig
+}
+
+func (c *LRUImageCache) Put(image string, imageConfig *imagev1.ImageConfig) {
+	c.cache.Add(image, lruImageCacheEntry{imageConfig: *imageConfig, expires: time.Now().Add(c.ttl)})
+}
+
 type DockerCreds struct {
 	Auths map[string]dockerTypes.AuthConfig `json:"auths"`
 }
@@ -80,9 +143,15 @@ func GetImageConfig(
 	container *corev1.Container,
 	podSpec *corev1.PodSpec) (*imagev1.ImageConfig, error) {
 
-	if imageConfig := imageCache.Get(container.Image); imageConfig != nil {
-		logger.Infof("found image %s in cache", container.Image)
-		return imageConfig, nil
+	// a tag can be moved to another image, so only the images referenced by digest are cached by their name,
+	// the others are resolved with a manifest request to their config digest first
+	byDigest := isDigestReference(container.Image)
+	if byDigest {
+		if imageConfig := getImageCache().Get(container.Image); imageConfig != nil {
+			logger.Infof("found image %s in cache", container.Image)
+			imageCacheRequests.WithLabelValues("hit").Inc()
+			return imageConfig, nil
+		}
 	}
 
 	containerInfo := ContainerInfo{Namespace: namespace, clientset: clientset}
@@ -95,8 +164,8 @@ func GetImageConfig(
 	logger.Infoln("I'm using registry", containerInfo.RegistryAddress)
 
 	imageConfig, err := getImageBlob(containerInfo)
-	if imageConfig != nil {
-		imageCache.Put(container.Image, imageConfig)
+	if imageConfig != nil && byDigest {
+		getImageCache().Put(container.Image, imageConfig)
 	}
 
 	return imageConfig, err
@@ -125,6 +194,16 @@ func getImageBlob(container ContainerInfo) (*imagev1.ImageConfig, error) {
 		return nil, fmt.Errorf("cannot download manifest for image: %s", err.Error())
 	}
 
+	// the config blobs are immutable, so a moved tag pointing to an already known config needs no download
+	configDigest := manifest.Config.Digest.String()
+	if imageConfig := getImageCache().Get(configDigest); imageConfig != nil {
+		logger.Infof("found image config %s in cache", configDigest)
+		imageCacheRequests.WithLabelValues("hit").Inc()
+		return imageConfig, nil
+	}
+
+	imageCacheRequests.WithLabelValues("miss").Inc()
+
 	reader, err := hub.DownloadBlob(imageName, manifest.Config.Digest)
 	if reader != nil {
 		defer reader.Close()
@@ -144,11 +223,22 @@ func getImageBlob(container ContainerInfo) (*imagev1.ImageConfig, error) {
 		return nil, fmt.Errorf("cannot unmarshal BlobResponse JSON: %s", err.Error())
 	}
 
+	getImageCache().Put(configDigest, &imageMetadata.Config)
+
 	return &imageMetadata.Config, nil
 }
 
-// parseContainerImage returns image and tag
+// isDigestReference returns whether the image is referenced by an immutable digest, e.g. app@sha256:...
+func isDigestReference(image string) bool {
+	return strings.Contains(image, "@sha256:")
+}
+
+// parseContainerImage returns image and tag (or digest)
 func parseContainerImage(image string) (string, string) {
+	if split := strings.SplitN(image, "@", 2); len(split) == 2 {
+		return split[0], split[1]
+	}
+
 	split := strings.SplitN(image, ":", 2)
 
 	imageName := split[0]
@@ -37,20 +37,25 @@ func secretNeedsMutation(secret *corev1.Secret) bool {
 	return false
 }
 
-func mutateSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) error {
+func (mw *mutatingWebhook) mutateSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) (err error) {
 
 	// do an early exit and don't construct the Vault client if not needed
 	if !secretNeedsMutation(secret) {
 		return nil
 	}
 
-	vaultClient, err := newVaultClient(vaultConfig)
+	vaultReader, release, err := mw.vaultReaderFor(vaultConfig, ns)
 	if err != nil {
 		return fmt.Errorf("failed to create vault client: %v", err)
 	}
 
-	defer vaultClient.Close()
+	defer func() { release(err) }()
 
+	return mutateSecretKeys(secret, vaultReader)
+}
+
+// mutateSecretKeys resolves the Vault references of the keys of the Secret with the reader
+func mutateSecretKeys(secret *corev1.Secret, vaultReader *vaultReader) error {
 	for key, value := range secret.Data {
 		if key == corev1.DockerConfigJsonKey {
 			var dc registry.DockerCreds
@@ -58,7 +63,7 @@ func mutateSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) err
 			if err != nil {
 				return fmt.Errorf("unmarshal dockerconfig json failed: %v", err)
 			}
-			err = mutateDockerCreds(secret, &dc, vaultClient)
+			err = mutateDockerCreds(secret, &dc, vaultReader)
 			if err != nil {
 				return fmt.Errorf("mutate dockerconfig json failed: %v", err)
 			}
@@ -66,7 +71,7 @@ func mutateSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) err
 			sc := map[string]string{
 				key: string(value),
 			}
-			err := mutateSecretData(secret, sc, vaultClient)
+			err := mutateSecretData(secret, sc, vaultReader)
 			if err != nil {
 				return fmt.Errorf("mutate generic secret failed: %v", err)
 			}
@@ -76,7 +81,7 @@ func mutateSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) err
 	return nil
 }
 
-func mutateDockerCreds(secret *corev1.Secret, dc *registry.DockerCreds, vaultClient *vault.Client) error {
+func mutateDockerCreds(secret *corev1.Secret, dc *registry.DockerCreds, vaultReader *vaultReader) error {
 
 	assembled := registry.DockerCreds{Auths: map[string]dockerTypes.AuthConfig{}}
 
@@ -99,7 +104,7 @@ func mutateDockerCreds(secret *corev1.Secret, dc *registry.DockerCreds, vaultCli
 				"password": password,
 			}
 
-			dcCreds, err := getDataFromVault(credPath, vaultClient)
+			dcCreds, err := getDataFromVault(credPath, vaultReader)
 			if err != nil {
 				return err
 			}
@@ -126,8 +131,8 @@ func mutateDockerCreds(secret *corev1.Secret, dc *registry.DockerCreds, vaultCli
 	return nil
 }
 
-func mutateSecretData(secret *corev1.Secret, sc map[string]string, vaultClient *vault.Client) error {
-	secCreds, err := getDataFromVault(sc, vaultClient)
+func mutateSecretData(secret *corev1.Secret, sc map[string]string, vaultReader *vaultReader) error {
+	secCreds, err := getDataFromVault(sc, vaultReader)
 	if err != nil {
 		return err
 	}
@@ -137,7 +142,27 @@ func mutateSecretData(secret *corev1.Secret, sc map[string]string, vaultClient *
 	return nil
 }
 
-func getDataFromVault(data map[string]string, vaultClient *vault.Client) (map[string]string, error) {
+// readVaultData reads the data of the version of a path, for KV version 2 paths it is the data of the version
+func readVaultData(vaultClient *vault.Client, path, version string) (map[string]interface{}, error) {
+	path, params, err := vault.SplitParams(path)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Set("version", version)
+	secret, err := vaultClient.Vault().Logical().ReadWithData(path, params)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	if v2Data, ok := secret.Data["data"]; ok {
+		return cast.ToStringMap(v2Data), nil
+	}
+
+	return cast.ToStringMap(secret.Data), nil
+}
+
+func getDataFromVault(data map[string]string, vaultReader *vaultReader) (map[string]string, error) {
 	var vaultData = make(map[string]string)
 
 	removePunctuation := func(r rune) rune {
@@ -148,36 +173,28 @@ func getDataFromVault(data map[string]string, vaultClient *vault.Client) (map[st
 	}
 
 	for key, value := range data {
+		if vault.IsTemplate(value) {
+			rendered, err := vault.RenderTemplate(value, vaultReader.read)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render template of %s: %v", key, err)
+			}
+			vaultData[key] = rendered
+			continue
+		}
+
 		for _, val := range strings.Fields(value) {
 			val = strings.Map(removePunctuation, val)
 			if strings.HasPrefix(val, "vault:") {
-				path := strings.TrimPrefix(val, "vault:")
-				split := strings.SplitN(path, "#", 3)
-				path = split[0]
-				var vaultKey string
-				if len(split) > 1 {
-					vaultKey = split[1]
-				}
-				version := "-1"
-				if len(split) == 3 {
-					version = split[2]
-				}
-
-				var vaultSecret map[string]interface{}
+				path, vaultKey, version := vault.ParseReference(val)
 
-				secret, err := vaultClient.Vault().Logical().ReadWithData(path, map[string][]string{"version": {version}})
+				vaultSecret, err := vaultReader.read(path, version)
+				if _, ok := err.(pathNotAllowedError); ok {
+					return nil, err
+				}
 				if err != nil {
 					logger.Errorf("Failed to read secret path: %s error: %s", path, err.Error())
-				}
-				if secret == nil {
+				} else if vaultSecret == nil {
 					logger.Errorf("Path not found path: %s", path)
-				} else {
-					v2Data, ok := secret.Data["data"]
-					if ok {
-						vaultSecret = cast.ToStringMap(v2Data)
-					} else {
-						vaultSecret = cast.ToStringMap(secret.Data)
-					}
 				}
 				value = strings.ReplaceAll(value, val, cast.ToString(vaultSecret[vaultKey]))
 			}
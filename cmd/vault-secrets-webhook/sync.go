@@ -0,0 +1,694 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/cmd/vault-secrets-webhook/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// vaultSourceAnnotation holds the original Vault references of the keys of a synced Secret or ConfigMap as JSON
+	vaultSourceAnnotation = "vault.security.banzaicloud.io/source"
+	// vaultSyncRolloutAnnotation enables the rollout of the Deployments referencing a synced Secret or ConfigMap
+	vaultSyncRolloutAnnotation = "vault.security.banzaicloud.io/vault-sync-rollout"
+	// vaultSyncedAtAnnotation is bumped on the synced objects, and on the pod template of the Deployments to roll them
+	vaultSyncedAtAnnotation = "vault.security.banzaicloud.io/synced-at"
+)
+
+var secretSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_secrets_webhook_secret_sync_total",
+	Help: "Number of Secret and ConfigMap syncs by kind and result (updated, unchanged or failed).",
+}, []string{"kind", "result"})
+
+func init() {
+	prometheus.MustRegister(secretSyncs)
+}
+
+// vaultUnavailableError is returned if Vault could not be logged in to or read, the sync mode admits the
+// objects with their references in this case, and the controller resolves them later
+type vaultUnavailableError struct {
+	err error
+}
+
+func (e vaultUnavailableError) Error() string {
+	return fmt.Sprintf("failed to read vault: %v", e.err)
+}
+
+// secretSources returns the keys of the Secret which hold Vault references, with their original values
+func secretSources(secret *corev1.Secret) map[string]string {
+	sources := map[string]string{}
+	for key, value := range secret.Data {
+		if (key == corev1.DockerConfigJsonKey && dockerConfigHasVaultRefs(value)) || strings.HasPrefix(string(value), "vault:") {
+			sources[key] = string(value)
+		}
+	}
+	return sources
+}
+
+// configMapSources returns the keys of the ConfigMap which hold Vault references, with their original values
+func configMapSources(configMap *corev1.ConfigMap) map[string]string {
+	sources := map[string]string{}
+	for key, value := range configMap.Data {
+		if strings.HasPrefix(value, "vault:") {
+			sources[key] = value
+		}
+	}
+	return sources
+}
+
+func dockerConfigHasVaultRefs(value []byte) bool {
+	var dc registry.DockerCreds
+	if err := json.Unmarshal(value, &dc); err != nil {
+		return false
+	}
+	for _, creds := range dc.Auths {
+		auth, err := base64.StdEncoding.DecodeString(creds.Auth)
+		if err == nil && strings.HasPrefix(string(auth), "vault:") {
+			return true
+		}
+	}
+	return false
+}
+
+// setSourceAnnotation sets the source annotation of the object, or removes it if there are no sources
+func setSourceAnnotation(obj metav1.Object, sources map[string]string) error {
+	annotations := obj.GetAnnotations()
+
+	if len(sources) == 0 {
+		if _, ok := annotations[vaultSourceAnnotation]; ok {
+			delete(annotations, vaultSourceAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return nil
+	}
+
+	source, err := json.Marshal(sources)
+	if err != nil {
+		return fmt.Errorf("failed to marshal vault source annotation: %v", err)
+	}
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[vaultSourceAnnotation] = string(source)
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// previousSources returns the source annotation of the object before an update, or none if it has no annotation
+func previousSources(old metav1.Object) (map[string]string, error) {
+	if _, ok := old.GetAnnotations()[vaultSourceAnnotation]; !ok {
+		return nil, nil
+	}
+	return getSourceAnnotation(old)
+}
+
+// mergeSources returns the sources of an updated object: the keys of the previous sources which still hold
+// their resolved value keep their source, the keys removed or changed to a literal lose it, and the keys with
+// a reference get it as their source
+func mergeSources(previous, sources, oldData, data map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, source := range previous {
+		if value, ok := data[key]; ok && value == oldData[key] {
+			merged[key] = source
+		}
+	}
+	for key, source := range sources {
+		merged[key] = source
+	}
+	return merged
+}
+
+// syncedByController returns true if the update was made by the sync controller, which bumps the synced-at
+// annotation of the objects it updates, these updates keep the source annotation as it is
+func syncedByController(obj, old metav1.Object) bool {
+	syncedAt := obj.GetAnnotations()[vaultSyncedAtAnnotation]
+	return syncedAt != "" && syncedAt != old.GetAnnotations()[vaultSyncedAtAnnotation]
+}
+
+// secretData returns the data of the Secret as strings, for comparing it with the data of a ConfigMap
+func secretData(secret *corev1.Secret) map[string]string {
+	data := map[string]string{}
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data
+}
+
+// oldSecret returns the Secret of an update admission request before the update, or nil for other requests
+func oldSecret(ctx context.Context) (*corev1.Secret, error) {
+	req := whcontext.GetAdmissionRequest(ctx)
+	if req == nil || len(req.OldObject.Raw) == 0 {
+		return nil, nil
+	}
+
+	var secret corev1.Secret
+	if err := json.Unmarshal(req.OldObject.Raw, &secret); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal old secret: %v", err)
+	}
+	return &secret, nil
+}
+
+// oldConfigMap returns the ConfigMap of an update admission request before the update, or nil for other requests
+func oldConfigMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	req := whcontext.GetAdmissionRequest(ctx)
+	if req == nil || len(req.OldObject.Raw) == 0 {
+		return nil, nil
+	}
+
+	var configMap corev1.ConfigMap
+	if err := json.Unmarshal(req.OldObject.Raw, &configMap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal old configmap: %v", err)
+	}
+	return &configMap, nil
+}
+
+func getSourceAnnotation(obj metav1.Object) (map[string]string, error) {
+	var sources map[string]string
+	if err := json.Unmarshal([]byte(obj.GetAnnotations()[vaultSourceAnnotation]), &sources); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vault source annotation: %v", err)
+	}
+	return sources, nil
+}
+
+// resolveSecret resolves the Vault references of the Secret, unlike mutateSecret it fails if a read failed
+func (mw *mutatingWebhook) resolveSecret(secret *corev1.Secret, vaultConfig vaultConfig, ns string) (err error) {
+	vaultReader, release, err := mw.vaultReaderFor(vaultConfig, ns)
+	if err != nil {
+		return vaultUnavailableError{err: err}
+	}
+
+	defer func() { release(err) }()
+
+	if err = mutateSecretKeys(secret, vaultReader); err != nil {
+		return err
+	}
+	if vaultReader.err != nil {
+		return vaultUnavailableError{err: vaultReader.err}
+	}
+
+	return nil
+}
+
+// resolveConfigMap resolves the Vault references of the ConfigMap, unlike mutateConfigMap it fails if a read failed
+func (mw *mutatingWebhook) resolveConfigMap(configMap *corev1.ConfigMap, vaultConfig vaultConfig, ns string) (err error) {
+	vaultReader, release, err := mw.vaultReaderFor(vaultConfig, ns)
+	if err != nil {
+		return vaultUnavailableError{err: err}
+	}
+
+	defer func() { release(err) }()
+
+	if err = mutateConfigMapKeys(configMap, vaultReader); err != nil {
+		return err
+	}
+	if vaultReader.err != nil {
+		return vaultUnavailableError{err: vaultReader.err}
+	}
+
+	return nil
+}
+
+// admitSecret is the mutation of the Secrets in sync mode: the original references are recorded in the source
+// annotation for the sync controller, and if Vault is unavailable the Secret is admitted with its references.
+// On update the references are merged with the previous source annotation, see mergeSources.
+func (mw *mutatingWebhook) admitSecret(secret, old *corev1.Secret, vaultConfig vaultConfig, ns string) error {
+	sources := secretSources(secret)
+
+	if old != nil {
+		if syncedByController(secret, old) {
+			return nil
+		}
+		previous, err := previousSources(old)
+		if err != nil {
+			return err
+		}
+		if err := setSourceAnnotation(secret, mergeSources(previous, sources, secretData(old), secretData(secret))); err != nil {
+			return err
+		}
+	} else if err := setSourceAnnotation(secret, sources); err != nil {
+		return err
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	if err := mw.resolveSecret(secret, vaultConfig, ns); err != nil {
+		if _, ok := err.(vaultUnavailableError); !ok {
+			return err
+		}
+		logger.Warnf("admitting secret %s/%s with vault references, they are resolved by the sync controller: %v", ns, secret.Name, err)
+		for key, value := range sources {
+			secret.Data[key] = []byte(value)
+		}
+	}
+
+	return nil
+}
+
+// admitConfigMap is the mutation of the ConfigMaps in sync mode, see admitSecret
+func (mw *mutatingWebhook) admitConfigMap(configMap, old *corev1.ConfigMap, vaultConfig vaultConfig, ns string) error {
+	sources := configMapSources(configMap)
+
+	if old != nil {
+		if syncedByController(configMap, old) {
+			return nil
+		}
+		previous, err := previousSources(old)
+		if err != nil {
+			return err
+		}
+		if err := setSourceAnnotation(configMap, mergeSources(previous, sources, old.Data, configMap.Data)); err != nil {
+			return err
+		}
+	} else if err := setSourceAnnotation(configMap, sources); err != nil {
+		return err
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	if err := mw.resolveConfigMap(configMap, vaultConfig, ns); err != nil {
+		if _, ok := err.(vaultUnavailableError); !ok {
+			return err
+		}
+		logger.Warnf("admitting configmap %s/%s with vault references, they are resolved by the sync controller: %v", ns, configMap.Name, err)
+		for key, value := range sources {
+			configMap.Data[key] = value
+		}
+	}
+
+	return nil
+}
+
+const (
+	// secretSyncLockName is the name of the ConfigMap holding the leader election lock of the sync controller
+	secretSyncLockName          = "vault-secrets-webhook-secret-sync"
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// syncKey is a Secret or ConfigMap in the work queue of the sync controller
+type syncKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// secretSyncController watches the Secrets and ConfigMaps with a source annotation, resolves their Vault
+// references again when they change and on every resync period, updates their data if it has changed, and
+// optionally rolls the Deployments referencing them
+type secretSyncController struct {
+	mw         *mutatingWebhook
+	period     time.Duration
+	secrets    corelisters.SecretLister
+	configMaps corelisters.ConfigMapLister
+	queue      workqueue.RateLimitingInterface
+}
+
+func newSecretSyncController(mw *mutatingWebhook, period time.Duration) *secretSyncController {
+	return &secretSyncController{
+		mw:     mw,
+		period: period,
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "vault-secret-sync"),
+	}
+}
+
+// runSecretSync runs the sync controller on the leader of the webhook replicas only, so the objects are updated
+// and the Deployments are rolled once. The leadership is held with a ConfigMap lock in secret_sync_lock_namespace,
+// or in the namespace of the webhook if it isn't set.
+func runSecretSync(mw *mutatingWebhook) {
+	namespace := viper.GetString("secret_sync_lock_namespace")
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			logger.Fatalf("error reading namespace of the secret sync lock: %s", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		logger.Fatalf("error getting hostname: %s", err)
+	}
+
+	lock := &resourcelock.ConfigMapLock{
+		ConfigMapMeta: metav1.ObjectMeta{Namespace: namespace, Name: secretSyncLockName},
+		Client:        mw.k8sClient.CoreV1(),
+		LockConfig:    resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	// RunOrDie only returns when the lock was acquired and couldn't be renewed, the context of the controller is
+	// canceled by then, but it runs on its own goroutine, so it has to be waited for before the replica takes
+	// part in the election again
+	for {
+		stopped := make(chan struct{})
+
+		leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					defer close(stopped)
+					logger.Infof("became the leader of the secret sync (lock %s)", lock.Describe())
+					newSecretSyncController(mw, viper.GetDuration("secret_sync_period")).run(ctx.Done())
+				},
+				OnStoppedLeading: func() {
+					logger.Warnf("lost the leadership of the secret sync (lock %s)", lock.Describe())
+				},
+			},
+		})
+
+		<-stopped
+	}
+}
+
+// hasSourceAnnotation returns true if the Secret or ConfigMap is synced from Vault
+func hasSourceAnnotation(obj interface{}) bool {
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return false
+	}
+	_, ok = object.GetAnnotations()[vaultSourceAnnotation]
+	return ok
+}
+
+// eventHandler queues the added and updated objects of the kind which have a source annotation
+func (c *secretSyncController) eventHandler(kind string) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if object, ok := obj.(metav1.Object); ok {
+			c.queue.Add(syncKey{kind: kind, namespace: object.GetNamespace(), name: object.GetName()})
+		}
+	}
+
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: hasSourceAnnotation,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    enqueue,
+			UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		},
+	}
+}
+
+func (c *secretSyncController) run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	// the informers resync every period, so the references are resolved again even if the objects don't change
+	factory := informers.NewSharedInformerFactory(c.mw.k8sClient, c.period)
+	secretInformer := factory.Core().V1().Secrets()
+	configMapInformer := factory.Core().V1().ConfigMaps()
+
+	secretInformer.Informer().AddEventHandler(c.eventHandler("Secret"))
+	configMapInformer.Informer().AddEventHandler(c.eventHandler("ConfigMap"))
+	c.secrets = secretInformer.Lister()
+	c.configMaps = configMapInformer.Lister()
+
+	factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, secretInformer.Informer().HasSynced, configMapInformer.Informer().HasSynced) {
+		logger.Errorf("failed to wait for the secret and configmap caches to sync")
+		return
+	}
+
+	logger.Infof("Syncing Secrets and ConfigMaps from Vault every %s", c.period)
+
+	go wait.Until(c.work, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *secretSyncController) work() {
+	for c.processNext() {
+	}
+}
+
+// processNext syncs the next object of the queue, the failed ones are queued again with a backoff
+func (c *secretSyncController) processNext() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(syncKey)
+
+	updated, err := c.sync(key)
+	switch {
+	case err != nil:
+		secretSyncs.WithLabelValues(key.kind, "failed").Inc()
+		logger.Errorf("failed to sync %s %s/%s: %v", strings.ToLower(key.kind), key.namespace, key.name, err)
+		c.queue.AddRateLimited(key)
+		return true
+	case updated:
+		secretSyncs.WithLabelValues(key.kind, "updated").Inc()
+	default:
+		secretSyncs.WithLabelValues(key.kind, "unchanged").Inc()
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// sync syncs the object of the key from the cache, the objects deleted or not synced anymore are skipped
+func (c *secretSyncController) sync(key syncKey) (bool, error) {
+	if key.kind == "Secret" {
+		secret, err := c.secrets.Secrets(key.namespace).Get(key.name)
+		if errors.IsNotFound(err) || (err == nil && !hasSourceAnnotation(secret)) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return c.syncSecret(secret)
+	}
+
+	configMap, err := c.configMaps.ConfigMaps(key.namespace).Get(key.name)
+	if errors.IsNotFound(err) || (err == nil && !hasSourceAnnotation(configMap)) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return c.syncConfigMap(configMap)
+}
+
+func (c *secretSyncController) syncSecret(secret *corev1.Secret) (bool, error) {
+	sources, err := getSourceAnnotation(secret)
+	if err != nil {
+		return false, err
+	}
+
+	synced := secret.DeepCopy()
+	if synced.Data == nil {
+		synced.Data = map[string][]byte{}
+	}
+	for key, value := range sources {
+		synced.Data[key] = []byte(value)
+	}
+
+	if err := c.mw.resolveSecret(synced, parseVaultConfig(synced), synced.Namespace); err != nil {
+		return false, err
+	}
+
+	if reflect.DeepEqual(synced.Data, secret.Data) {
+		return false, nil
+	}
+
+	synced.Annotations[vaultSyncedAtAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	if _, err := c.mw.k8sClient.CoreV1().Secrets(synced.Namespace).Update(synced); err != nil {
+		return false, fmt.Errorf("failed to update secret: %v", err)
+	}
+
+	logger.Infof("synced secret %s/%s from vault", synced.Namespace, synced.Name)
+
+	if syncRollout(synced) {
+		c.rollout(synced.Namespace, "Secret", synced.Name)
+	}
+
+	return true, nil
+}
+
+func (c *secretSyncController) syncConfigMap(configMap *corev1.ConfigMap) (bool, error) {
+	sources, err := getSourceAnnotation(configMap)
+	if err != nil {
+		return false, err
+	}
+
+	synced := configMap.DeepCopy()
+	if synced.Data == nil {
+		synced.Data = map[string]string{}
+	}
+	for key, value := range sources {
+		synced.Data[key] = value
+	}
+
+	if err := c.mw.resolveConfigMap(synced, parseVaultConfig(synced), synced.Namespace); err != nil {
+		return false, err
+	}
+
+	if reflect.DeepEqual(synced.Data, configMap.Data) {
+		return false, nil
+	}
+
+	synced.Annotations[vaultSyncedAtAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	if _, err := c.mw.k8sClient.CoreV1().ConfigMaps(synced.Namespace).Update(synced); err != nil {
+		return false, fmt.Errorf("failed to update configmap: %v", err)
+	}
+
+	logger.Infof("synced configmap %s/%s from vault", synced.Namespace, synced.Name)
+
+	if syncRollout(synced) {
+		c.rollout(synced.Namespace, "ConfigMap", synced.Name)
+	}
+
+	return true, nil
+}
+
+// syncRollout returns true if the Deployments referencing the object should be rolled after it was synced
+func syncRollout(obj metav1.Object) bool {
+	if val, ok := obj.GetAnnotations()[vaultSyncRolloutAnnotation]; ok {
+		rollout, _ := strconv.ParseBool(val)
+		return rollout
+	}
+	return viper.GetBool("secret_sync_rollout")
+}
+
+// rollout bumps the synced-at annotation of the pod template of the Deployments in the namespace which reference
+// the Secret or ConfigMap, so their pods are replaced with ones using the new data
+func (c *secretSyncController) rollout(ns, kind, name string) {
+	deployments, err := c.mw.k8sClient.AppsV1().Deployments(ns).List(metav1.ListOptions{})
+	if err != nil {
+		logger.Errorf("failed to list deployments in namespace %s: %v", ns, err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						vaultSyncedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		logger.Errorf("failed to marshal deployment patch: %v", err)
+		return
+	}
+
+	for _, deployment := range deployments.Items {
+		if !podSpecReferences(&deployment.Spec.Template.Spec, kind, name) {
+			continue
+		}
+
+		if _, err := c.mw.k8sClient.AppsV1().Deployments(ns).Patch(deployment.Name, types.StrategicMergePatchType, patch); err != nil {
+			logger.Errorf("failed to roll deployment %s/%s: %v", ns, deployment.Name, err)
+			continue
+		}
+
+		logger.Infof("rolling deployment %s/%s after %s %s was synced", ns, deployment.Name, kind, name)
+	}
+}
+
+// podSpecReferences returns true if the pod spec uses the Secret or ConfigMap in a volume, an environment
+// variable, or as an image pull Secret
+func podSpecReferences(podSpec *corev1.PodSpec, kind, name string) bool {
+	secret := func(secretName string) bool { return kind == "Secret" && secretName == name }
+	configMap := func(configMapName string) bool { return kind == "ConfigMap" && configMapName == name }
+
+	for _, volume := range podSpec.Volumes {
+		if volume.Secret != nil && secret(volume.Secret.SecretName) {
+			return true
+		}
+		if volume.ConfigMap != nil && configMap(volume.ConfigMap.Name) {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && secret(source.Secret.Name) {
+					return true
+				}
+				if source.ConfigMap != nil && configMap(source.ConfigMap.Name) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, pullSecret := range podSpec.ImagePullSecrets {
+		if secret(pullSecret.Name) {
+			return true
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...)
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil && secret(envFrom.SecretRef.Name) {
+				return true
+			}
+			if envFrom.ConfigMapRef != nil && configMap(envFrom.ConfigMapRef.Name) {
+				return true
+			}
+		}
+
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.SecretKeyRef != nil && secret(env.ValueFrom.SecretKeyRef.Name) {
+				return true
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil && configMap(env.ValueFrom.ConfigMapKeyRef.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeSources(t *testing.T) {
+	previous := map[string]string{"username": "vault:secret/data/db#username", "password": "vault:secret/data/db#password"}
+	oldData := map[string]string{"username": "app", "password": "s3cr3t", "host": "db"}
+
+	tests := []struct {
+		name     string
+		sources  map[string]string
+		data     map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "unchanged keys keep their source",
+			data:     map[string]string{"username": "app", "password": "s3cr3t", "host": "db.svc"},
+			expected: previous,
+		},
+		{
+			name:     "key changed to a literal",
+			data:     map[string]string{"username": "admin", "password": "s3cr3t", "host": "db"},
+			expected: map[string]string{"password": "vault:secret/data/db#password"},
+		},
+		{
+			name:     "key removed",
+			data:     map[string]string{"password": "s3cr3t", "host": "db"},
+			expected: map[string]string{"password": "vault:secret/data/db#password"},
+		},
+		{
+			name:    "key changed to a new reference",
+			sources: map[string]string{"username": "vault:secret/data/admin#username", "host": "vault:secret/data/db#host"},
+			data:    map[string]string{"username": "vault:secret/data/admin#username", "password": "s3cr3t", "host": "vault:secret/data/db#host"},
+			expected: map[string]string{
+				"username": "vault:secret/data/admin#username",
+				"password": "vault:secret/data/db#password",
+				"host":     "vault:secret/data/db#host",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := mergeSources(previous, test.sources, oldData, test.data)
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, merged)
+			}
+		})
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	synced := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			Annotations: map[string]string{vaultSourceAnnotation: `{"password":"vault:secret/data/db#password"}`},
+		}
+	}
+
+	controller := newSecretSyncController(nil, 0)
+	secrets := controller.eventHandler("Secret")
+	configMaps := controller.eventHandler("ConfigMap")
+
+	secrets.OnAdd(&corev1.Secret{ObjectMeta: synced("db")})
+	secrets.OnAdd(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "plain"}})
+	secrets.OnUpdate(&corev1.Secret{ObjectMeta: synced("db")}, &corev1.Secret{ObjectMeta: synced("db")})
+	configMaps.OnUpdate(&corev1.ConfigMap{}, &corev1.ConfigMap{ObjectMeta: synced("db")})
+	configMaps.OnUpdate(&corev1.ConfigMap{ObjectMeta: synced("plain")}, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "plain"}})
+
+	// the objects without a source annotation are not queued, and the same object is queued once
+	expected := []syncKey{
+		{kind: "Secret", namespace: "default", name: "db"},
+		{kind: "ConfigMap", namespace: "default", name: "db"},
+	}
+
+	if controller.queue.Len() != len(expected) {
+		t.Fatalf("There should be %d objects queued, but there are %d", len(expected), controller.queue.Len())
+	}
+
+	for _, key := range expected {
+		item, _ := controller.queue.Get()
+		if item != key {
+			t.Errorf("Expected %#v to be queued, got %#v", key, item)
+		}
+		controller.queue.Done(item)
+	}
+}
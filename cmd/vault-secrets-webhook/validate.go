@@ -0,0 +1,345 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	"github.com/prometheus/client_golang/prometheus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
+	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The modes of the pod validation
+const (
+	// podValidationEnforce denies the pods referencing secrets which can't be read
+	podValidationEnforce = "enforce"
+	// podValidationAudit admits every pod, and logs the problems
+	podValidationAudit = "audit"
+)
+
+// wildcardKey is the key of the references exposing every key of a secret, e.g. DB=vault:secret/data/db#*
+const wildcardKey = "*"
+
+// vaultLogin is the VAULT_TOKEN value which makes vault-env pass its own Vault token to the application
+const vaultLogin = "vault:login"
+
+var podValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_secrets_webhook_pod_validation_total",
+	Help: "Number of validated pods by result (valid, invalid or unchecked).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(podValidations)
+}
+
+// vaultReference is a Vault reference of a pod, source is where the pod uses it, e.g. container app env DB_PASSWORD
+type vaultReference struct {
+	source string
+	value  string
+}
+
+// uncheckedError is a failed login or request to Vault, which doesn't tell whether a reference can be resolved,
+// so the pod is admitted with a warning instead of being denied
+type uncheckedError struct {
+	err error
+}
+
+func (e uncheckedError) Error() string {
+	return e.err.Error()
+}
+
+// vaultChecker checks the references of a pod with a Vault client logged in as the pod
+type vaultChecker struct {
+	client               *vault.Client
+	ignoreMissingSecrets bool
+	capabilities         map[string][]string
+	// err is the last failed request, the client is released with it
+	err error
+}
+
+// vaultSecretsValidator validates that the Vault references of a pod, or of the pod template of a workload,
+// can be resolved with the role of the pod, so a typo in a path or key is reported at admission, and not by
+// a crashlooping vault-env
+func (mw *mutatingWebhook) vaultSecretsValidator(ctx context.Context, obj metav1.Object) (bool, validating.ValidatorResult, error) {
+	var pod *corev1.Pod
+	var kind string
+
+	switch v := obj.(type) {
+	case *corev1.Pod:
+		pod, kind = v, "pod"
+	case *appsv1.Deployment:
+		pod, kind = podFromTemplate(v.Spec.Template), "deployment"
+	case *appsv1.StatefulSet:
+		pod, kind = podFromTemplate(v.Spec.Template), "statefulset"
+	case *appsv1.DaemonSet:
+		pod, kind = podFromTemplate(v.Spec.Template), "daemonset"
+	case *batchv1.Job:
+		pod, kind = podFromTemplate(v.Spec.Template), "job"
+	default:
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	ns := whcontext.GetAdmissionRequest(ctx).Namespace
+	name := obj.GetName()
+	if name == "" {
+		name = obj.GetGenerateName()
+	}
+
+	problems, warnings := mw.validatePod(pod, parseVaultConfig(pod), ns)
+	if len(problems) == 0 {
+		if len(warnings) > 0 {
+			podValidations.WithLabelValues("unchecked").Inc()
+			logger.Warnf("admitting %s %s/%s, its vault references can't be checked: %s", kind, ns, name, strings.Join(warnings, "; "))
+			return false, validating.ValidatorResult{Valid: true}, nil
+		}
+		podValidations.WithLabelValues("valid").Inc()
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	podValidations.WithLabelValues("invalid").Inc()
+
+	message := fmt.Sprintf("vault references of the %s can't be resolved: %s", kind, strings.Join(problems, "; "))
+
+	if viper.GetString("pod_validation_mode") == podValidationAudit {
+		logger.Warnf("admitting %s %s/%s in audit mode, %s", kind, ns, name, message)
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	logger.Infof("denying %s %s/%s, %s", kind, ns, name, message)
+
+	return false, validating.ValidatorResult{Valid: false, Message: message}, nil
+}
+
+// podFromTemplate returns a pod of the template, with the ServiceAccount the ServiceAccount admission would set
+func podFromTemplate(template corev1.PodTemplateSpec) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	if pod.Spec.ServiceAccountName == "" {
+		pod.Spec.ServiceAccountName = "default"
+	}
+	return pod
+}
+
+// validatePod returns the problems of the Vault references of the pod, the references are checked with the
+// ServiceAccount and Vault role of the pod, the same way as vault-env logs in. The failed logins and requests
+// are returned as warnings, only the definite answers (permission denied, missing path or key, and template
+// errors) are problems.
+func (mw *mutatingWebhook) validatePod(pod *corev1.Pod, vaultConfig vaultConfig, ns string) ([]string, []string) {
+	var warnings []string
+
+	references, problems := mw.podVaultReferences(pod, vaultConfig, ns)
+	if len(references) == 0 {
+		return problems, warnings
+	}
+
+	vaultConfig.serviceAccount = pod.Spec.ServiceAccountName
+	if vaultConfig.serviceAccount == "" {
+		vaultConfig.serviceAccount = "default"
+	}
+
+	key := fmt.Sprintf("%s|%s|%s", ns, vaultConfig.serviceAccount, vaultClientKey(vaultConfig))
+	client, err := vaultClients.get(key, func() (*vault.Client, time.Duration, error) {
+		return mw.newNamespaceVaultClient(vaultConfig, ns)
+	})
+	if err != nil {
+		return problems, append(warnings, fmt.Sprintf("failed to log in to vault with role %s: %v", vaultConfig.role, err))
+	}
+
+	checker := &vaultChecker{
+		client:               client,
+		ignoreMissingSecrets: vaultConfig.ignoreMissingSecrets == "true",
+		capabilities:         map[string][]string{},
+	}
+
+	for _, reference := range references {
+		err := checker.check(reference.value)
+		if _, ok := err.(uncheckedError); ok {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", reference.source, err))
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", reference.source, err))
+		}
+	}
+
+	vaultClients.release(key, client, checker.err)
+
+	return problems, warnings
+}
+
+// podVaultReferences returns the Vault references of the environment variables of the containers, including
+// the ones from ConfigMaps and Secrets, of the secret files and of the vault-env-from-path annotation
+func (mw *mutatingWebhook) podVaultReferences(pod *corev1.Pod, vaultConfig vaultConfig, ns string) ([]vaultReference, []string) {
+	var references []vaultReference
+	var problems []string
+
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		var envVars []corev1.EnvVar
+		if len(container.EnvFrom) > 0 {
+			envFrom, err := mw.lookForEnvFrom(container.EnvFrom, ns)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("container %s: %v", container.Name, err))
+			}
+			envVars = append(envVars, envFrom...)
+		}
+
+		for _, env := range container.Env {
+			// vault-env passes its own token in this case, there is nothing to read
+			if env.Name == "VAULT_TOKEN" && env.Value == vaultLogin {
+				continue
+			}
+			if strings.HasPrefix(env.Value, "vault:") || strings.HasPrefix(env.Value, ">>vault:") {
+				envVars = append(envVars, env)
+			}
+			if env.ValueFrom != nil {
+				valueFrom, err := mw.lookForValueFrom(env, ns)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("container %s env %s: %v", container.Name, env.Name, err))
+					continue
+				}
+				if valueFrom != nil {
+					envVars = append(envVars, *valueFrom)
+				}
+			}
+		}
+
+		for _, env := range envVars {
+			references = append(references, vaultReference{
+				source: fmt.Sprintf("container %s env %s", container.Name, env.Name),
+				value:  env.Value,
+			})
+		}
+	}
+
+	files, err := parseSecretFiles(vaultConfig)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, file := range files {
+		references = append(references, vaultReference{source: fmt.Sprintf("secret file %s", file.Path), value: file.Reference})
+	}
+
+	for _, path := range strings.Split(vaultConfig.vaultEnvFromPath, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			references = append(references, vaultReference{source: "vault-env-from-path", value: "vault:" + path})
+		}
+	}
+
+	return references, problems
+}
+
+// check checks that the reference can be resolved: the path can be read and has the key, or in case of a
+// >>vault: reference the path can be written. A failed request to Vault is returned as an uncheckedError.
+func (c *vaultChecker) check(value string) error {
+	switch {
+	case strings.HasPrefix(value, ">>vault:"):
+		path, _, _ := vault.ParseReference(strings.TrimPrefix(value, ">>"))
+		path, _, err := vault.SplitParams(path)
+		if err != nil {
+			return err
+		}
+		return c.checkCapability(path, "create", "update")
+
+	case vault.IsTemplate(value):
+		// the template wraps the errors of the reads, so a failed request is kept to tell it from the others
+		var unchecked error
+		_, err := vault.RenderTemplate(value, func(path, version string) (map[string]interface{}, error) {
+			data, err := c.read(path, version)
+			if _, ok := err.(uncheckedError); ok {
+				unchecked = err
+			}
+			return data, err
+		})
+		if unchecked != nil {
+			return unchecked
+		}
+		return err
+
+	default:
+		path, key, version := vault.ParseReference(value)
+
+		data, err := c.read(path, version)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			if c.ignoreMissingSecrets {
+				return nil
+			}
+			return fmt.Errorf("path %s not found", path)
+		}
+		if key != "" && key != wildcardKey {
+			if _, ok := data[key]; !ok && !c.ignoreMissingSecrets {
+				return fmt.Errorf("key %q not found in %s", key, path)
+			}
+		}
+
+		return nil
+	}
+}
+
+// read reads the path, which may have query-style parameters, if the token of the pod can read it
+func (c *vaultChecker) read(path, version string) (map[string]interface{}, error) {
+	plainPath, _, err := vault.SplitParams(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkCapability(plainPath, "read"); err != nil {
+		return nil, err
+	}
+
+	data, err := secretReadCache.read(c.client, path, version)
+	if err != nil {
+		c.err = err
+		return nil, uncheckedError{err: fmt.Errorf("failed to read %s: %v", path, err)}
+	}
+
+	return data, nil
+}
+
+// checkCapability checks with sys/capabilities-self that the token of the pod has one of the capabilities on the path
+func (c *vaultChecker) checkCapability(path string, anyOf ...string) error {
+	capabilities, ok := c.capabilities[path]
+	if !ok {
+		var err error
+		capabilities, err = c.client.RawClient().Sys().CapabilitiesSelf(path)
+		if err != nil {
+			c.err = err
+			return uncheckedError{err: fmt.Errorf("failed to check capabilities on %s: %v", path, err)}
+		}
+		c.capabilities[path] = capabilities
+	}
+
+	for _, capability := range capabilities {
+		if capability == "root" {
+			return nil
+		}
+		for _, wanted := range anyOf {
+			if capability == wanted {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("permission denied on %s, the role has %s capabilities, needs %s", path, strings.Join(capabilities, ","), strings.Join(anyOf, " or "))
+}
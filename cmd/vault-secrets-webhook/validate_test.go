@@ -0,0 +1,193 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/banzaicloud/bank-vaults/pkg/vault"
+	vaultapi "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPodVaultReferences(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "init", Env: []corev1.EnvVar{{Name: "TOKEN", Value: "vault:secret/data/init#token"}}},
+			},
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Env: []corev1.EnvVar{
+						{Name: "LOG_LEVEL", Value: "info"},
+						{Name: "VAULT_TOKEN", Value: "vault:login"},
+						{Name: "DB_PASSWORD", Value: "vault:secret/data/db#password"},
+						{Name: "TLS_CERT", Value: ">>vault:pki/issue/web?common_name=app.svc#certificate"},
+					},
+				},
+			},
+		},
+	}
+
+	vaultConfig := vaultConfig{
+		secretFiles:      "/etc/app/password=vault:secret/data/db#password",
+		secretFilesMode:  "0400",
+		vaultEnvFromPath: "secret/data/app, secret/data/common",
+	}
+
+	references, problems := (&mutatingWebhook{}).podVaultReferences(pod, vaultConfig, "default")
+	if len(problems) > 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	expected := []vaultReference{
+		{source: "container init env TOKEN", value: "vault:secret/data/init#token"},
+		{source: "container app env DB_PASSWORD", value: "vault:secret/data/db#password"},
+		{source: "container app env TLS_CERT", value: ">>vault:pki/issue/web?common_name=app.svc#certificate"},
+		{source: "secret file /etc/app/password", value: "vault:secret/data/db#password"},
+		{source: "vault-env-from-path", value: "vault:secret/data/app"},
+		{source: "vault-env-from-path", value: "vault:secret/data/common"},
+	}
+	if !reflect.DeepEqual(references, expected) {
+		t.Errorf("expected %v, got %v", expected, references)
+	}
+}
+
+// fakeVault serves the capabilities of the paths and the secrets, the other paths are not found
+func fakeVault(t *testing.T, capabilities map[string][]string, secrets map[string]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+		if path == "sys/capabilities-self" {
+			var body struct {
+				Path  string   `json:"path"`
+				Paths []string `json:"paths"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("failed to decode capabilities request: %v", err)
+			}
+			if body.Path == "" && len(body.Paths) > 0 {
+				body.Path = body.Paths[0]
+			}
+
+			pathCapabilities, ok := capabilities[body.Path]
+			if !ok {
+				pathCapabilities = []string{"read"}
+			}
+			if pathCapabilities == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"errors":["internal error"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"capabilities": pathCapabilities, body.Path: pathCapabilities},
+			})
+			return
+		}
+
+		data, ok := secrets[path]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		case data == nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["internal error"]}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+		}
+	}))
+}
+
+func TestCheck(t *testing.T) {
+	server := fakeVault(t,
+		map[string][]string{
+			"secret/data/denied":      {"deny"},
+			"secret/data/unreachable": nil,
+			"pki/issue/web":           {"create", "update"},
+			"pki/issue/readonly":      {"read"},
+		},
+		map[string]map[string]interface{}{
+			"secret/data/db":     {"username": "app", "password": "s3cr3t"},
+			"secret/data/broken": nil,
+		},
+	)
+	defer server.Close()
+
+	config := vaultapi.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+
+	rawClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClient.SetToken("token")
+
+	client, err := vault.NewClientFromRawClient(rawClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                 string
+		value                string
+		ignoreMissingSecrets bool
+		valid                bool
+		unchecked            bool
+	}{
+		{name: "key", value: "vault:secret/data/db#password", valid: true},
+		{name: "every key", value: "vault:secret/data/db#*", valid: true},
+		{name: "parameters", value: "vault:secret/data/db?ttl=1h#password", valid: true},
+		{name: "parameters of a missing path", value: "vault:secret/data/dv?ttl=1h#password"},
+		{name: "missing key", value: "vault:secret/data/db#pasword"},
+		{name: "ignored missing key", value: "vault:secret/data/db#pasword", ignoreMissingSecrets: true, valid: true},
+		{name: "missing path", value: "vault:secret/data/dv#password"},
+		{name: "ignored missing path", value: "vault:secret/data/dv#password", ignoreMissingSecrets: true, valid: true},
+		{name: "permission denied", value: "vault:secret/data/denied#password"},
+		{name: "failed read", value: "vault:secret/data/broken#password", unchecked: true},
+		{name: "failed capabilities check", value: "vault:secret/data/unreachable#password", unchecked: true},
+		{name: "write", value: ">>vault:pki/issue/web?common_name=app.svc#certificate", valid: true},
+		{name: "write denied", value: ">>vault:pki/issue/readonly?common_name=app.svc#certificate"},
+		{name: "template", value: "vault:template:db=secret/data/db;{{ .db.username }}:{{ .db.password }}", valid: true},
+		{name: "template with parameters", value: "vault:template:db=secret/data/db?ttl=1h;{{ .db.password }}", valid: true},
+		{name: "template with missing key", value: "vault:template:db=secret/data/db;{{ .db.pasword }}"},
+		{name: "template with failed read", value: "vault:template:db=secret/data/broken;{{ .db.password }}", unchecked: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := &vaultChecker{
+				client:               client,
+				ignoreMissingSecrets: test.ignoreMissingSecrets,
+				capabilities:         map[string][]string{},
+			}
+
+			err := checker.check(test.value)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %t, got error: %v", test.valid, err)
+			}
+			if _, unchecked := err.(uncheckedError); unchecked != test.unchecked {
+				t.Errorf("expected unchecked %t, got error: %v", test.unchecked, err)
+			}
+		})
+	}
+}
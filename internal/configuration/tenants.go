@@ -0,0 +1,210 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+	"github.com/goph/emperror"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const tenantsKey = "tenants"
+
+// The tenant template uses its own delimiters, so Vault's ACL templating ({{identity.entity.id}}) in
+// the rendered policies is left intact
+const (
+	tenantLeftDelim  = "[["
+	tenantRightDelim = "]]"
+)
+
+// Tenant is a tenant descriptor, it is available in the tenant template as .Tenant
+type Tenant struct {
+	Name string
+	Vars map[string]interface{}
+}
+
+// ExpandTenants expands the tenants section of a configuration into regular configuration
+// sections (secrets, policies, auth, etc...) by rendering the tenant template for every tenant
+// in the list and appending the results to the already existing sections.
+func ExpandTenants(config *viper.Viper) error {
+	if !config.IsSet(tenantsKey) {
+		return nil
+	}
+
+	tenantsConfig, err := cast.ToStringMapE(config.Get(tenantsKey))
+	if err != nil {
+		return emperror.Wrap(err, "error converting tenants config")
+	}
+	if len(tenantsConfig) == 0 {
+		return nil
+	}
+
+	tenantList, err := cast.ToSliceE(tenantsConfig["list"])
+	if err != nil {
+		return emperror.Wrap(err, "error converting tenants list")
+	}
+
+	tenantTemplate, err := cast.ToStringMapE(tenantsConfig["template"])
+	if err != nil {
+		return emperror.Wrap(err, "error converting tenants template")
+	}
+
+	tenants := make([]Tenant, 0, len(tenantList))
+	for _, tenantRaw := range tenantList {
+		tenant, err := parseTenant(tenantRaw)
+		if err != nil {
+			return err
+		}
+		tenants = append(tenants, tenant)
+	}
+
+	// Iterate over the sections in a stable order, so the expanded configuration is reproducible
+	sections := make([]string, 0, len(tenantTemplate))
+	for section := range tenantTemplate {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		items, err := cast.ToSliceE(tenantTemplate[section])
+		if err != nil {
+			return emperror.Wrapf(err, "error converting tenants template section %s, it should be a list", section)
+		}
+
+		expanded := []interface{}{}
+		if config.IsSet(section) {
+			expanded, err = cast.ToSliceE(config.Get(section))
+			if err != nil {
+				return emperror.Wrapf(err, "error converting section %s, it should be a list", section)
+			}
+		}
+
+		for _, tenant := range tenants {
+			data := map[string]interface{}{"Tenant": tenant}
+			for _, item := range items {
+				rendered, err := renderTenantTemplate(item, data)
+				if err != nil {
+					return emperror.Wrapf(err, "error rendering %s template for tenant %s", section, tenant.Name)
+				}
+				expanded = append(expanded, rendered)
+			}
+		}
+
+		config.Set(section, expanded)
+	}
+
+	// Mark the tenants as expanded
+	config.Set(tenantsKey, map[string]interface{}{})
+
+	return nil
+}
+
+func parseTenant(tenantRaw interface{}) (Tenant, error) {
+	if name, ok := tenantRaw.(string); ok {
+		return Tenant{Name: name, Vars: map[string]interface{}{}}, nil
+	}
+
+	tenantMap, err := cast.ToStringMapE(tenantRaw)
+	if err != nil {
+		return Tenant{}, emperror.Wrap(err, "error converting tenant, it should be a name or a map")
+	}
+
+	name, err := cast.ToStringE(tenantMap["name"])
+	if err != nil || name == "" {
+		return Tenant{}, emperror.With(errors.New("tenant has no name"), "tenant", tenantRaw)
+	}
+
+	vars := map[string]interface{}{}
+	if varsRaw, ok := tenantMap["vars"]; ok {
+		varsMap, err := cast.ToStringMapE(varsRaw)
+		if err != nil {
+			return Tenant{}, emperror.Wrapf(err, "error converting vars of tenant %s", name)
+		}
+		// The variable names are lowercased the same way as viper lowercases the configuration keys,
+		// whether or not the keys in lists are lowercased by the viper version in use
+		for key, value := range varsMap {
+			vars[strings.ToLower(key)] = value
+		}
+	}
+
+	return Tenant{Name: name, Vars: vars}, nil
+}
+
+// tenantTemplateFuncs returns the sprig functions except the ones reading the environment (env and expandenv),
+// since the environment of bank-vaults holds the root token and the cloud credentials
+func tenantTemplateFuncs() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+	return funcs
+}
+
+// renderTenantTemplate renders every string (including map keys) in a configuration tree as a template,
+// referencing a missing key (for example a variable not set for the tenant) is an error
+func renderTenantTemplate(node interface{}, data interface{}) (interface{}, error) {
+	switch value := node.(type) {
+	case string:
+		tmpl, err := template.New(templateName).
+			Delims(tenantLeftDelim, tenantRightDelim).
+			Funcs(tenantTemplateFuncs()).
+			Option("missingkey=error").
+			Parse(value)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "error parsing template %q", value)
+		}
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, data); err != nil {
+			return nil, emperror.Wrapf(err, "error executing template %q", value)
+		}
+		return buffer.String(), nil
+
+	case []interface{}:
+		rendered := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			renderedItem, err := renderTenantTemplate(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, renderedItem)
+		}
+		return rendered, nil
+
+	case map[interface{}]interface{}, map[string]interface{}:
+		valueMap := cast.ToStringMap(value)
+		rendered := make(map[string]interface{}, len(valueMap))
+		for k, v := range valueMap {
+			renderedKey, err := renderTenantTemplate(k, data)
+			if err != nil {
+				return nil, err
+			}
+			renderedValue, err := renderTenantTemplate(v, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[renderedKey.(string)] = renderedValue
+		}
+		return rendered, nil
+
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const tenantsConfig = `
+policies:
+  - name: admin
+    rules: path "*" { capabilities = ["sudo"] }
+
+tenants:
+  list:
+    - team-a
+    - name: team-b
+      vars:
+        namespace: b-namespace
+  template:
+    policies:
+      - name: "[[ .Tenant.Name ]]"
+        rules: path "[[ .Tenant.Name ]]/*" { capabilities = ["read"] }
+    secrets:
+      - path: "[[ .Tenant.Name ]]"
+        type: kv
+        options:
+          version: 2
+    auth:
+      - type: kubernetes
+        roles:
+          - name: "[[ .Tenant.Name ]]"
+            bound_service_account_namespaces: "[[ index .Tenant.Vars \"namespace\" | default .Tenant.Name ]]"
+            policies: "[[ .Tenant.Name ]]"
+`
+
+func TestExpandTenants(t *testing.T) {
+	config := viper.New()
+	config.SetConfigType("yaml")
+
+	err := config.ReadConfig(bytes.NewBufferString(tenantsConfig))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = ExpandTenants(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	policies := []map[string]interface{}{}
+	err = config.UnmarshalKey("policies", &policies)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(policies) != 3 {
+		t.Fatalf("There should be 3 policies, but there are %d", len(policies))
+	}
+
+	if policies[0]["name"] != "admin" {
+		t.Fatalf("The existing policies should be kept first: %#v", policies[0])
+	}
+
+	if policies[2]["name"] != "team-b" || policies[2]["rules"] != `path "team-b/*" { capabilities = ["read"] }` {
+		t.Fatalf("The policy of team-b is not expanded properly: %#v", policies[2])
+	}
+
+	auths := []map[string]interface{}{}
+	err = config.UnmarshalKey("auth", &auths)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(auths) != 2 {
+		t.Fatalf("There should be 2 auth methods, but there are %d", len(auths))
+	}
+
+	roles := cast.ToSlice(auths[1]["roles"])
+	role := cast.ToStringMap(roles[0])
+	if role["bound_service_account_namespaces"] != "b-namespace" {
+		t.Fatalf("The role of team-b is not expanded properly: %#v", role)
+	}
+
+	// Expanding again shouldn't duplicate the tenants
+	err = ExpandTenants(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = config.UnmarshalKey("policies", &policies)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(policies) != 3 {
+		t.Fatalf("There should be still 3 policies, but there are %d", len(policies))
+	}
+}
+
+func TestExpandTenantsMissingVar(t *testing.T) {
+	config := viper.New()
+	config.SetConfigType("yaml")
+
+	// the variable names are lowercased, so the camelCase variable is only available as .Tenant.Vars.camelcase
+	err := config.ReadConfig(bytes.NewBufferString(`
+tenants:
+  list:
+    - name: team-a
+      vars:
+        camelCase: value
+  template:
+    policies:
+      - name: "[[ .Tenant.Vars.camelCase ]]"
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := ExpandTenants(config); err == nil {
+		t.Fatal("Expanding a missing variable should fail instead of rendering <no value>")
+	}
+}
+
+func TestExpandTenantsVaultTemplating(t *testing.T) {
+	config := viper.New()
+	config.SetConfigType("yaml")
+
+	// Vault's ACL templating has to be kept as it is in the rendered policies
+	err := config.ReadConfig(bytes.NewBufferString(`
+tenants:
+  list:
+    - team-a
+  template:
+    policies:
+      - name: "[[ .Tenant.Name ]]"
+        rules: path "[[ .Tenant.Name ]]/{{identity.entity.id}}/*" { capabilities = ["read"] }
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = ExpandTenants(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	policies := []map[string]interface{}{}
+	err = config.UnmarshalKey("policies", &policies)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(policies) != 1 || policies[0]["rules"] != `path "team-a/{{identity.entity.id}}/*" { capabilities = ["read"] }` {
+		t.Fatalf("The identity templated policy is not expanded properly: %#v", policies)
+	}
+}
+
+func TestExpandTenantsEnv(t *testing.T) {
+	config := viper.New()
+	config.SetConfigType("yaml")
+
+	// the environment of bank-vaults holds credentials, so it can't be read from the tenant template
+	err := config.ReadConfig(bytes.NewBufferString(`
+tenants:
+  list:
+    - team-a
+  template:
+    policies:
+      - name: "[[ env \"VAULT_TOKEN\" ]]"
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := ExpandTenants(config); err == nil {
+		t.Fatal("The env function shouldn't be available in the tenant template")
+	}
+}
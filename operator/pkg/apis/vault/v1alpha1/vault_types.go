@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +29,7 @@ import (
 	"github.com/spf13/cast"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
@@ -169,6 +172,12 @@ type VaultSpec struct {
 	// default:
 	VaultConfigurerPodSpec v1.PodSpec `json:"vaultConfigurerPodSpec"`
 
+	// ConfigurerAPISecret is the name of a Kubernetes Secret holding a bearer token under the "token" key.
+	// If set, the Bank Vaults Configurer exposes its HTTP API (submit configuration, re-apply, status) on port 9092
+	// through the configurer Service, callers have to authenticate with this token.
+	// default:
+	ConfigurerAPISecret string `json:"configurerAPISecret,omitempty"`
+
 	// Config is the Vault Server configuration. See https://www.vaultproject.io/docs/configuration/ for more details.
 	// default:
 	Config VaultConfig `json:"config"`
@@ -298,6 +307,90 @@ type VaultSpec struct {
 	// use ["*"] for all namespaces.
 	// default:
 	CANamespaces []string `json:"caNamespaces,omitempty"`
+
+	// RaftVolumeClaimSpec is the PersistentVolumeClaim specification of the volume holding the Raft data of each
+	// Vault Pod, used only with the raft storage backend.
+	// default: ReadWriteOnce, 1Gi
+	RaftVolumeClaimSpec *v1.PersistentVolumeClaimSpec `json:"raftVolumeClaimSpec,omitempty"`
+
+	// RaftAutopilot is the Autopilot configuration of the Raft cluster, which is written to Vault by the operator
+	// when the raft storage backend is used. See https://www.vaultproject.io/api/system/storage/raftautopilot.html
+	// default:
+	RaftAutopilot *RaftAutopilotConfig `json:"raftAutopilot,omitempty"`
+
+	// Backup, if it is specified the operator creates a CronJob which saves snapshots of the Raft storage
+	// periodically into an object storage, used only with the raft storage backend. See the type for more details.
+	// default:
+	Backup *BackupConfig `json:"backup,omitempty"`
+}
+
+// BackupConfig represents the configuration of the periodic Raft snapshots, exactly one of the storage
+// configurations has to be specified, the snapshots are encrypted with the KMS key of it
+type BackupConfig struct {
+	// Schedule is the schedule of the snapshots in Cron format
+	Schedule   string `json:"schedule"`
+	KeepDaily  int    `json:"keepDaily,omitempty"`
+	KeepWeekly int    `json:"keepWeekly,omitempty"`
+
+	Google  *GoogleUnsealConfig  `json:"google,omitempty"`
+	AWS     *AWSUnsealConfig     `json:"aws,omitempty"`
+	Alibaba *AlibabaUnsealConfig `json:"alibaba,omitempty"`
+
+	// TokenSecret is the Secret key holding the Vault token used for the snapshots, it defaults to the root
+	// token if it is stored in a Kubernetes Secret in the namespace of Vault
+	TokenSecret *v1.SecretKeySelector `json:"tokenSecret,omitempty"`
+}
+
+// HasStorage returns true if a storage is configured for the snapshots
+func (bc *BackupConfig) HasStorage() bool {
+	return bc.Google != nil || bc.AWS != nil || bc.Alibaba != nil
+}
+
+// ToArgs returns the BackupConfig as an argument array for bank-vaults snapshot save
+func (bc *BackupConfig) ToArgs(vault *Vault) []string {
+	args := []string{
+		"--keep-daily",
+		strconv.Itoa(bc.KeepDaily),
+		"--keep-weekly",
+		strconv.Itoa(bc.KeepWeekly),
+	}
+
+	storage := UnsealConfig{Google: bc.Google, AWS: bc.AWS, Alibaba: bc.Alibaba}
+
+	return append(args, storage.ToArgs(vault)...)
+}
+
+// RaftAutopilotConfig represents the Autopilot configuration of Vault's Raft storage
+type RaftAutopilotConfig struct {
+	CleanupDeadServers             bool   `json:"cleanupDeadServers,omitempty"`
+	LastContactThreshold           string `json:"lastContactThreshold,omitempty"`
+	DeadServerLastContactThreshold string `json:"deadServerLastContactThreshold,omitempty"`
+	MaxTrailingLogs                int    `json:"maxTrailingLogs,omitempty"`
+	MinQuorum                      int    `json:"minQuorum,omitempty"`
+	ServerStabilizationTime        string `json:"serverStabilizationTime,omitempty"`
+}
+
+// ToMap returns the Autopilot configuration in the format of Vault's API
+func (c *RaftAutopilotConfig) ToMap() map[string]interface{} {
+	config := map[string]interface{}{
+		"cleanup_dead_servers": c.CleanupDeadServers,
+	}
+	if c.LastContactThreshold != "" {
+		config["last_contact_threshold"] = c.LastContactThreshold
+	}
+	if c.DeadServerLastContactThreshold != "" {
+		config["dead_server_last_contact_threshold"] = c.DeadServerLastContactThreshold
+	}
+	if c.MaxTrailingLogs != 0 {
+		config["max_trailing_logs"] = c.MaxTrailingLogs
+	}
+	if c.MinQuorum != 0 {
+		config["min_quorum"] = c.MinQuorum
+	}
+	if c.ServerStabilizationTime != "" {
+		config["server_stabilization_time"] = c.ServerStabilizationTime
+	}
+	return config
 }
 
 // HAStorageTypes is the set of storage backends supporting High Availability
@@ -307,6 +400,7 @@ var HAStorageTypes = map[string]bool{
 	"etcd":      true,
 	"gcs":       true,
 	"mysql":     true,
+	"raft":      true,
 	"spanner":   true,
 	"zookeeper": true,
 }
@@ -395,8 +489,28 @@ func (spec *VaultSpec) HasStorageHAEnabled() bool {
 	storageType := spec.GetStorageType()
 	storage := spec.getStorage()
 	storageSpecs := cast.ToStringMap(storage[storageType])
-	// In Consul HA is always enabled
-	return storageType == "consul" || cast.ToBool(storageSpecs["ha_enabled"])
+	// In Consul and Raft HA is always enabled
+	return storageType == "consul" || storageType == "raft" || cast.ToBool(storageSpecs["ha_enabled"])
+}
+
+// IsRaftStorage detects if Vault is configured to use the integrated Raft storage
+func (spec *VaultSpec) IsRaftStorage() bool {
+	return spec.GetStorageType() == "raft"
+}
+
+// GetRaftVolumeClaimSpec returns the PersistentVolumeClaim specification of the Raft data volume
+func (spec *VaultSpec) GetRaftVolumeClaimSpec() v1.PersistentVolumeClaimSpec {
+	if spec.RaftVolumeClaimSpec != nil {
+		return *spec.RaftVolumeClaimSpec
+	}
+	return v1.PersistentVolumeClaimSpec{
+		AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse("1Gi"),
+			},
+		},
+	}
 }
 
 // GetTLSDisable returns if Vault's TLS should be disabled
@@ -526,6 +640,43 @@ func (spec *VaultSpec) ExternalConfigJSON() string {
 	return string(config)
 }
 
+// SealShamir is the seal of Vault if no seal stanza is configured
+const SealShamir = "shamir"
+
+// SealJSON returns the seal stanza of the Vault configuration as a JSON string, or "shamir" if it is not set
+func (spec *VaultSpec) SealJSON() string {
+	seal, ok := spec.Config["seal"]
+	if !ok {
+		return SealShamir
+	}
+	config, _ := json.Marshal(seal)
+	return string(config)
+}
+
+// GetSealType returns the type of Vault's seal stanza, or "shamir" if it is not set
+func (spec *VaultSpec) GetSealType() string {
+	seal := cast.ToStringMap(spec.Config["seal"])
+	sealTypes := make([]string, 0, len(seal))
+	for sealType := range seal {
+		sealTypes = append(sealTypes, sealType)
+	}
+	if len(sealTypes) == 0 {
+		return SealShamir
+	}
+	sort.Strings(sealTypes)
+	return sealTypes[0]
+}
+
+// IsSealMigration checks if the seal stanza has been changed since Vault was last migrated
+func (vault *Vault) IsSealMigration() bool {
+	return vault.Status.Seal != "" && vault.Status.Seal != vault.Spec.SealJSON()
+}
+
+// IsUnsealDeployment checks if the Vault instances are unsealed by a single Deployment instead of sidecars
+func (spec *VaultSpec) IsUnsealDeployment() bool {
+	return spec.UnsealConfig.Options.Deployment
+}
+
 // IsAutoUnseal checks if auto-unseal is configured
 func (spec *VaultSpec) IsAutoUnseal() bool {
 	_, ok := spec.Config["seal"]
@@ -573,6 +724,8 @@ type VaultStatus struct {
 	// Important: Run "operator-sdk generate k8s" to regenerate code after modifying this file
 	Nodes  []string `json:"nodes"`
 	Leader string   `json:"leader"`
+	// Seal is the seal stanza (as JSON) Vault has been migrated to, or "shamir"
+	Seal string `json:"seal,omitempty"`
 }
 
 // UnsealConfig represents the UnsealConfig field of a VaultSpec Kubernetes object
@@ -588,6 +741,9 @@ type UnsealConfig struct {
 // UnsealOptions represents the common options to all unsealing backends
 type UnsealOptions struct {
 	PreFlightChecks *bool `json:"preFlightChecks,omitempty"`
+	// Deployment runs a single unsealer Deployment, which unseals every Vault instance through the per instance
+	// Services, instead of an unsealer sidecar container in every Vault Pod
+	Deployment bool `json:"deployment,omitempty"`
 }
 
 func (uso UnsealOptions) ToArgs() []string {
@@ -73,6 +73,42 @@ func (in *AzureUnsealConfig) DeepCopy() *AzureUnsealConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupConfig) DeepCopyInto(out *BackupConfig) {
+	*out = *in
+	if in.Google != nil {
+		in, out := &in.Google, &out.Google
+		*out = new(GoogleUnsealConfig)
+		**out = **in
+	}
+	if in.AWS != nil {
+		in, out := &in.AWS, &out.AWS
+		*out = new(AWSUnsealConfig)
+		**out = **in
+	}
+	if in.Alibaba != nil {
+		in, out := &in.Alibaba, &out.Alibaba
+		*out = new(AlibabaUnsealConfig)
+		**out = **in
+	}
+	if in.TokenSecret != nil {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupConfig.
+func (in *BackupConfig) DeepCopy() *BackupConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CredentialsConfig) DeepCopyInto(out *CredentialsConfig) {
 	*out = *in
@@ -145,6 +181,22 @@ func (in *KubernetesUnsealConfig) DeepCopy() *KubernetesUnsealConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RaftAutopilotConfig) DeepCopyInto(out *RaftAutopilotConfig) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RaftAutopilotConfig.
+func (in *RaftAutopilotConfig) DeepCopy() *RaftAutopilotConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RaftAutopilotConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Resources) DeepCopyInto(out *Resources) {
 	*out = *in
@@ -461,6 +513,21 @@ func (in *VaultSpec) DeepCopyInto(out *VaultSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.RaftVolumeClaimSpec != nil {
+		in, out := &in.RaftVolumeClaimSpec, &out.RaftVolumeClaimSpec
+		*out = new(v1.PersistentVolumeClaimSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RaftAutopilot != nil {
+		in, out := &in.RaftAutopilot, &out.RaftAutopilot
+		*out = new(RaftAutopilotConfig)
+		**out = **in
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(BackupConfig)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
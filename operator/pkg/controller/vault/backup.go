@@ -0,0 +1,132 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"fmt"
+
+	vaultv1alpha1 "github.com/banzaicloud/bank-vaults/operator/pkg/apis/vault/v1alpha1"
+	"github.com/hashicorp/vault/api"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func labelsForVaultBackup(name string) map[string]string {
+	return map[string]string{"app": "vault-backup", "vault_cr": name}
+}
+
+// backupTokenSecret returns the Secret key of the token used for the snapshots, the root token can be used only
+// if it is stored in a Kubernetes Secret in the namespace of Vault, since Pods can't reference other namespaces
+func backupTokenSecret(v *vaultv1alpha1.Vault) (*corev1.SecretKeySelector, error) {
+	if v.Spec.Backup.TokenSecret != nil {
+		return v.Spec.Backup.TokenSecret, nil
+	}
+
+	unsealConfig := v.Spec.UnsealConfig
+	if unsealConfig.Google != nil || unsealConfig.Azure != nil || unsealConfig.AWS != nil || unsealConfig.Alibaba != nil {
+		return nil, fmt.Errorf("backup.tokenSecret has to be specified if the unseal keys are not stored in a Kubernetes Secret")
+	}
+	if unsealConfig.Kubernetes.SecretNamespace != "" && unsealConfig.Kubernetes.SecretNamespace != v.Namespace {
+		return nil, fmt.Errorf("backup.tokenSecret has to be specified if the unseal keys are stored in another namespace")
+	}
+
+	secretName := v.Name + "-unseal-keys"
+	if unsealConfig.Kubernetes.SecretName != "" {
+		secretName = unsealConfig.Kubernetes.SecretName
+	}
+
+	return &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+		Key:                  "vault-root",
+	}, nil
+}
+
+func cronJobForVaultBackup(v *vaultv1alpha1.Vault) (*batchv1beta1.CronJob, error) {
+	if !v.Spec.IsRaftStorage() {
+		return nil, fmt.Errorf("backup is supported only with the raft storage backend")
+	}
+	if !v.Spec.Backup.HasStorage() {
+		return nil, fmt.Errorf("backup storage has to be specified (google, aws or alibaba)")
+	}
+
+	tokenSecret, err := backupTokenSecret(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := labelsForVaultBackup(v.Name)
+
+	env := []corev1.EnvVar{{
+		Name:      api.EnvVaultToken,
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: tokenSecret},
+	}}
+
+	podSpec := corev1.PodSpec{
+		ServiceAccountName: v.Spec.GetServiceAccount(),
+		RestartPolicy:      corev1.RestartPolicyOnFailure,
+		Containers: []corev1.Container{
+			{
+				Image:           v.Spec.GetBankVaultsImage(),
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Name:            "bank-vaults",
+				Command:         []string{"bank-vaults", "snapshot", "save"},
+				Args:            v.Spec.Backup.ToArgs(v),
+				Env:             withSecretEnv(v, withTLSEnv(v, false, withCredentialsEnv(v, env))),
+				VolumeMounts:    withTLSVolumeMount(v, withCredentialsVolumeMount(v, []corev1.VolumeMount{})),
+				Resources:       *getBankVaultsResource(v),
+			},
+		},
+		Volumes:         withTLSVolume(v, withCredentialsVolume(v, []corev1.Volume{})),
+		SecurityContext: withSecurityContext(v),
+		NodeSelector:    v.Spec.NodeSelector,
+		Tolerations:     v.Spec.Tolerations,
+	}
+
+	// Only one snapshot should run at a time, they would race for the snapshot index
+	cronJob := &batchv1beta1.CronJob{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1beta1",
+			Kind:       "CronJob",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        v.Name + "-backup",
+			Namespace:   v.Namespace,
+			Labels:      withVaultLabels(v, ls),
+			Annotations: getCommonAnnotations(v, map[string]string{}),
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:          v.Spec.Backup.Schedule,
+			ConcurrencyPolicy: batchv1beta1.ForbidConcurrent,
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withVaultLabels(v, ls),
+				},
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels:      withVaultLabels(v, ls),
+							Annotations: getCommonAnnotations(v, map[string]string{}),
+						},
+						Spec: podSpec,
+					},
+				},
+			},
+		},
+	}
+
+	return cronJob, nil
+}
@@ -0,0 +1,266 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	vaultv1alpha1 "github.com/banzaicloud/bank-vaults/operator/pkg/apis/vault/v1alpha1"
+	"github.com/hashicorp/vault/api"
+	"github.com/spf13/cast"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	raftVolumeName  = "vault-raft"
+	raftDefaultPath = "/vault/raft"
+	// The group of the vault user in the official Vault image, the Raft volume has to be writable by it
+	raftDefaultFSGroup = int64(1000)
+)
+
+// withRaftStorage fills the storage stanza of the Raft backend with the data path and the retry_join blocks
+// pointing to every Vault instance through the per instance services, unless they are set explicitly
+func withRaftStorage(v *vaultv1alpha1.Vault) string {
+	storage := v.Spec.GetStorage()
+
+	if _, ok := storage["path"]; !ok {
+		storage["path"] = raftDefaultPath
+	}
+
+	if _, ok := storage["retry_join"]; !ok {
+		scheme := strings.ToLower(string(getVaultURIScheme(v)))
+		retryJoin := []interface{}{}
+		for i := 0; i < int(v.Spec.Size); i++ {
+			join := map[string]interface{}{
+				"leader_api_addr": fmt.Sprintf("%s://%s-%d.%s:8200", scheme, v.Name, i, v.Namespace),
+			}
+			if !v.Spec.GetTLSDisable() {
+				join["leader_ca_cert_file"] = "/vault/tls/ca.crt"
+			}
+			retryJoin = append(retryJoin, join)
+		}
+		storage["retry_join"] = retryJoin
+	}
+
+	v.Spec.Config["storage"] = map[string]interface{}{"raft": storage}
+
+	return cast.ToString(storage["path"])
+}
+
+// withRaftEnv sets a stable node ID and per instance addresses for the Vault instances, Raft peers find
+// each other with these, so they have to survive Pod restarts (unlike the Pod IPs)
+func withRaftEnv(v *vaultv1alpha1.Vault, envs []corev1.EnvVar) []corev1.EnvVar {
+	scheme := strings.ToLower(string(getVaultURIScheme(v)))
+	return append(envs, []corev1.EnvVar{
+		{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		},
+		{
+			Name:  "VAULT_RAFT_NODE_ID",
+			Value: "$(POD_NAME)",
+		},
+		{
+			Name:  "VAULT_API_ADDR",
+			Value: fmt.Sprintf("%s://$(POD_NAME).%s:8200", scheme, v.Namespace),
+		},
+		{
+			Name:  "VAULT_CLUSTER_ADDR",
+			Value: fmt.Sprintf("https://$(POD_NAME).%s:8201", v.Namespace),
+		},
+	}...)
+}
+
+func raftVolumeClaimTemplates(v *vaultv1alpha1.Vault) []corev1.PersistentVolumeClaim {
+	return []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   raftVolumeName,
+				Labels: withVaultLabels(v, labelsForVault(v.Name)),
+			},
+			Spec: v.Spec.GetRaftVolumeClaimSpec(),
+		},
+	}
+}
+
+func withRaftSecurityContext(v *vaultv1alpha1.Vault, securityContext *corev1.PodSecurityContext) *corev1.PodSecurityContext {
+	if securityContext == nil {
+		securityContext = &corev1.PodSecurityContext{}
+	} else {
+		securityContext = securityContext.DeepCopy()
+	}
+	if securityContext.FSGroup == nil {
+		fsGroup := raftDefaultFSGroup
+		securityContext.FSGroup = &fsGroup
+	}
+	return securityContext
+}
+
+// vaultClientForRaft returns a Vault client authenticated with the root token, which is needed to manage the
+// Raft peers, this is only possible if the root token is stored in a Kubernetes Secret
+func (r *ReconcileVault) vaultClientForRaft(v *vaultv1alpha1.Vault) (*api.Client, error) {
+	unsealConfig := v.Spec.UnsealConfig
+	if unsealConfig.Google != nil || unsealConfig.Azure != nil || unsealConfig.AWS != nil || unsealConfig.Alibaba != nil {
+		return nil, fmt.Errorf("managing raft peers is supported only with Kubernetes Secret based unsealing")
+	}
+
+	secretNamespace := v.Namespace
+	if unsealConfig.Kubernetes.SecretNamespace != "" {
+		secretNamespace = unsealConfig.Kubernetes.SecretNamespace
+	}
+	secretName := v.Name + "-unseal-keys"
+	if unsealConfig.Kubernetes.SecretName != "" {
+		secretName = unsealConfig.Kubernetes.SecretName
+	}
+
+	secret := corev1.Secret{}
+	err := r.nonNamespacedClient.Get(context.TODO(), types.NamespacedName{Namespace: secretNamespace, Name: secretName}, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unseal keys secret: %v", err)
+	}
+
+	rootToken, ok := secret.Data["vault-root"]
+	if !ok {
+		return nil, fmt.Errorf("root token is not stored in secret %s/%s", secretNamespace, secretName)
+	}
+
+	config := api.DefaultConfig()
+	config.Address = fmt.Sprintf("%s://%s.%s:8200", strings.ToLower(string(getVaultURIScheme(v))), v.Name, v.Namespace)
+	config.HttpClient = r.httpClient
+
+	vaultClient, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	vaultClient.SetToken(string(rootToken))
+
+	return vaultClient, nil
+}
+
+// removeRaftPeers removes the Raft peers of the Vault instances which are going away because the cluster is
+// scaled down, this has to happen before the StatefulSet is scaled down, otherwise the cluster may lose its quorum
+func (r *ReconcileVault) removeRaftPeers(v *vaultv1alpha1.Vault, statefulSet *appsv1.StatefulSet) error {
+	current := appsv1.StatefulSet{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: statefulSet.Namespace, Name: statefulSet.Name}, &current)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get StatefulSet: %v", err)
+	}
+
+	if current.Spec.Replicas == nil || *current.Spec.Replicas <= v.Spec.Size {
+		return nil
+	}
+
+	vaultClient, err := r.vaultClientForRaft(v)
+	if err != nil {
+		return err
+	}
+
+	peers, err := raftPeers(vaultClient)
+	if err != nil {
+		return err
+	}
+
+	for i := v.Spec.Size; i < *current.Spec.Replicas; i++ {
+		nodeID := fmt.Sprintf("%s-%d", v.Name, i)
+		if !peers[nodeID] {
+			continue
+		}
+
+		log.Info("removing raft peer", "node", nodeID)
+		_, err := vaultClient.Logical().Write("sys/storage/raft/remove-peer", map[string]interface{}{"server_id": nodeID})
+		if err != nil {
+			return fmt.Errorf("failed to remove raft peer %s: %v", nodeID, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteRaftVolumeClaims deletes the Raft data of the removed peers, so they don't try to rejoin with
+// stale data if the cluster is scaled up again, the claims are deleted once their Pods are gone
+func (r *ReconcileVault) deleteRaftVolumeClaims(v *vaultv1alpha1.Vault) error {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{
+		Namespace:     v.Namespace,
+		LabelSelector: labels.SelectorFromSet(labelsForVault(v.Name)),
+	}, &pvcs)
+	if err != nil {
+		return fmt.Errorf("failed to list raft volume claims: %v", err)
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		var ordinal int32
+		if _, err := fmt.Sscanf(pvc.Name, raftVolumeName+"-"+v.Name+"-%d", &ordinal); err != nil {
+			continue
+		}
+		if ordinal < v.Spec.Size || pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		log.Info("deleting raft volume claim of removed peer", "pvc", pvc.Name)
+		if err := r.client.Delete(context.TODO(), pvc); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete raft volume claim %s: %v", pvc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// configureRaftAutopilot writes the Autopilot configuration of the Raft cluster
+func (r *ReconcileVault) configureRaftAutopilot(v *vaultv1alpha1.Vault) error {
+	vaultClient, err := r.vaultClientForRaft(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = vaultClient.Logical().Write("sys/storage/raft/autopilot/configuration", v.Spec.RaftAutopilot.ToMap())
+	if err != nil {
+		return fmt.Errorf("failed to configure raft autopilot: %v", err)
+	}
+
+	return nil
+}
+
+func raftPeers(vaultClient *api.Client) (map[string]bool, error) {
+	secret, err := vaultClient.Logical().Read("sys/storage/raft/configuration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raft configuration: %v", err)
+	}
+
+	peers := map[string]bool{}
+	if secret == nil {
+		return peers, nil
+	}
+
+	config := cast.ToStringMap(secret.Data["config"])
+	for _, server := range cast.ToSlice(config["servers"]) {
+		peers[cast.ToString(cast.ToStringMap(server)["node_id"])] = true
+	}
+
+	return peers, nil
+}
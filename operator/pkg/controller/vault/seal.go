@@ -0,0 +1,114 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	vaultv1alpha1 "github.com/banzaicloud/bank-vaults/operator/pkg/apis/vault/v1alpha1"
+	"github.com/spf13/cast"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// withSealMigration configures Vault to migrate from the seal in the status to the one in the spec, the previous
+// seal stanza is kept in the configuration as disabled, a Shamir seal needs no stanza. Both stanzas are listed,
+// since the previous and the current seal may be of the same type (e.g. a different KMS key).
+func withSealMigration(v *vaultv1alpha1.Vault) error {
+	seals := []interface{}{}
+
+	if v.Status.Seal != vaultv1alpha1.SealShamir {
+		previous := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(v.Status.Seal), &previous); err != nil {
+			return fmt.Errorf("failed to parse previous seal stanza: %v", err)
+		}
+		for _, sealType := range sortedKeys(previous) {
+			config := map[string]interface{}{}
+			for key, value := range cast.ToStringMap(previous[sealType]) {
+				config[key] = value
+			}
+			config["disabled"] = "true"
+			seals = append(seals, map[string]interface{}{sealType: config})
+		}
+	}
+
+	current := cast.ToStringMap(v.Spec.Config["seal"])
+	for _, sealType := range sortedKeys(current) {
+		seals = append(seals, map[string]interface{}{sealType: current[sealType]})
+	}
+
+	v.Spec.Config["seal"] = seals
+
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type vaultSealStatus struct {
+	Type      string `json:"type"`
+	Sealed    bool   `json:"sealed"`
+	Migration bool   `json:"migration"`
+}
+
+// sealMigrated returns true if every Vault instance runs the current revision of the StatefulSet
+// and has been unsealed with a seal of the given type, without a migration pending
+func (r *ReconcileVault) sealMigrated(v *vaultv1alpha1.Vault, sealType string, pods []corev1.Pod) (bool, error) {
+	statefulSet := appsv1.StatefulSet{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: v.Namespace, Name: v.Name}, &statefulSet)
+	if err != nil {
+		return false, fmt.Errorf("failed to get StatefulSet: %v", err)
+	}
+
+	if len(pods) != int(v.Spec.Size) {
+		return false, nil
+	}
+
+	for _, pod := range pods {
+		if pod.Labels[appsv1.StatefulSetRevisionLabel] != statefulSet.Status.UpdateRevision {
+			return false, nil
+		}
+
+		url := fmt.Sprintf("%s://%s.%s:8200/v1/sys/seal-status", strings.ToLower(string(getVaultURIScheme(v))), pod.Name, v.Namespace)
+		resp, err := r.httpClient.Get(url)
+		if err != nil {
+			return false, nil
+		}
+
+		status := vaultSealStatus{}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to decode seal status of %s: %v", pod.Name, err)
+		}
+
+		if status.Sealed || status.Migration || status.Type != sealType {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,144 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	vaultv1alpha1 "github.com/banzaicloud/bank-vaults/operator/pkg/apis/vault/v1alpha1"
+	"github.com/banzaicloud/bank-vaults/pkg/kv/k8s"
+	"github.com/hashicorp/vault/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func labelsForVaultUnsealer(name string) map[string]string {
+	return map[string]string{"app": "vault-unsealer", "vault_cr": name}
+}
+
+func unsealCommandForVault(v *vaultv1alpha1.Vault, sealMigration bool) []string {
+	unsealCommand := []string{"bank-vaults", "unseal", "--init"}
+	if v.Spec.IsAutoUnseal() {
+		unsealCommand = append(unsealCommand, "--auto")
+	}
+	// The unsealer sends the stored keys with migrate=true if Vault was started with a seal migration pending
+	if sealMigration {
+		unsealCommand = append(unsealCommand, "--migrate")
+	}
+	return unsealCommand
+}
+
+func unsealerContainer(v *vaultv1alpha1.Vault, unsealCommand []string, env []corev1.EnvVar) corev1.Container {
+	return corev1.Container{
+		Image:           v.Spec.GetBankVaultsImage(),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Name:            "bank-vaults",
+		Command:         unsealCommand,
+		Args:            append(v.Spec.UnsealConfig.Options.ToArgs(), v.Spec.UnsealConfig.ToArgs(v)...),
+		Env:             env,
+		Ports: []corev1.ContainerPort{{
+			Name:          "metrics",
+			ContainerPort: 9091,
+			Protocol:      "TCP",
+		}},
+		VolumeMounts: withTLSVolumeMount(v, withCredentialsVolumeMount(v, []corev1.VolumeMount{})),
+		Resources:    *getBankVaultsResource(v),
+	}
+}
+
+// withUnsealerSidecar adds the unsealer container to the Vault Pods, unless they are unsealed by a Deployment
+func withUnsealerSidecar(v *vaultv1alpha1.Vault, unsealCommand []string, ownerJSON string, containers []corev1.Container) []corev1.Container {
+	if v.Spec.IsUnsealDeployment() {
+		return containers
+	}
+
+	env := withSecretEnv(v, withTLSEnv(v, true, withCredentialsEnv(v, []corev1.EnvVar{
+		{
+			Name:  k8s.EnvK8SOwnerReference,
+			Value: ownerJSON,
+		},
+	})))
+
+	return append(containers, unsealerContainer(v, unsealCommand, env))
+}
+
+// deploymentForUnsealer creates a single unsealer, which discovers the Vault instances through their
+// per instance Services and unseals every sealed one
+func deploymentForUnsealer(v *vaultv1alpha1.Vault, sealMigration bool) (*appsv1.Deployment, error) {
+	ls := labelsForVaultUnsealer(v.Name)
+
+	ownerJSON, err := json.Marshal(asOwner(v))
+	if err != nil {
+		return nil, err
+	}
+
+	unsealCommand := append(unsealCommandForVault(v, sealMigration), "--targets", fmt.Sprintf("k8s://%s/%s", v.Namespace, v.Name))
+
+	env := withTLSEnv(v, false, withCredentialsEnv(v, []corev1.EnvVar{
+		{
+			Name:  k8s.EnvK8SOwnerReference,
+			Value: string(ownerJSON),
+		},
+	}))
+
+	// Vault is initialized through the per instance Service of the first instance: the Vault Service has
+	// no endpoints until an instance is unsealed, and with Raft only the first instance may initialize Vault,
+	// the others join it
+	for i := range env {
+		if env[i].Name == api.EnvVaultAddress {
+			env[i].Value = fmt.Sprintf("%s://%s-0.%s:8200", strings.ToLower(string(getVaultURIScheme(v))), v.Name, v.Namespace)
+		}
+	}
+
+	replicas := int32(1)
+
+	dep := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        v.Name + "-unsealer",
+			Namespace:   v.Namespace,
+			Labels:      withVaultLabels(v, ls),
+			Annotations: getCommonAnnotations(v, map[string]string{}),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      withVaultLabels(v, ls),
+					Annotations: withPrometheusAnnotations("9091", getCommonAnnotations(v, map[string]string{})),
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: v.Spec.GetServiceAccount(),
+					Containers:         []corev1.Container{unsealerContainer(v, unsealCommand, withSecretEnv(v, env))},
+					Volumes:            withTLSVolume(v, withCredentialsVolume(v, []corev1.Volume{})),
+					SecurityContext:    withSecurityContext(v),
+					NodeSelector:       v.Spec.NodeSelector,
+					Tolerations:        v.Spec.Tolerations,
+				},
+			},
+		},
+	}
+
+	return dep, nil
+}
@@ -230,6 +230,11 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		return reconcile.Result{}, err
 	}
 
+	// The configuration is changed below (e.g. during a seal migration), so the target seal is saved first
+	seal := v.Spec.SealJSON()
+	sealType := v.Spec.GetSealType()
+	sealMigration := v.IsSealMigration()
+
 	// check if we need to create an etcd cluster
 	// if etcd size is < 0. Will not create etcd cluster
 	if v.Spec.GetStorageType() == "etcd" && v.Spec.GetEtcdSize() > 0 {
@@ -387,11 +392,44 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		return reconcile.Result{}, err
 	}
 
+	// Remove the Raft peers going away before scaling down, so the cluster doesn't count them in the quorum
+	if v.Spec.IsRaftStorage() {
+		err = r.removeRaftPeers(v, statefulSet)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("failed to remove raft peers: %v", err)
+		}
+	}
+
 	err = r.createOrUpdateObject(statefulSet)
 	if err != nil {
 		return reconcile.Result{}, fmt.Errorf("failed to create/update StatefulSet: %v", err)
 	}
 
+	if v.Spec.IsRaftStorage() {
+		err = r.deleteRaftVolumeClaims(v)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// Create the unsealer Deployment if the instances are not unsealed by sidecars
+	if v.Spec.IsUnsealDeployment() {
+		unsealerDep, err := deploymentForUnsealer(v, sealMigration)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("failed to fabricate unsealer deployment: %v", err)
+		}
+
+		// Set Vault instance as the owner and controller
+		if err := controllerutil.SetControllerReference(v, unsealerDep, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.createOrUpdateObject(unsealerDep)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("failed to create/update unsealer deployment: %v", err)
+		}
+	}
+
 	if v.Spec.ServiceMonitorEnabled {
 		// Create the ServiceMonitor if it doesn't exist
 		serviceMonitor := serviceMonitorForVault(v)
@@ -500,6 +538,24 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		}
 	}
 
+	// Create the backup CronJob if specified
+	if v.Spec.Backup != nil {
+		cronJob, err := cronJobForVaultBackup(v)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("failed to fabricate backup cronjob: %v", err)
+		}
+
+		// Set Vault instance as the owner and controller
+		if err := controllerutil.SetControllerReference(v, cronJob, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.createOrUpdateObject(cronJob)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("failed to create/update backup cronjob: %v", err)
+		}
+	}
+
 	// Update the Vault status with the pod names
 	podList := podList()
 	labelSelector := labels.SelectorFromSet(labelsForVault(v.Name))
@@ -510,6 +566,21 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 	}
 	podNames := getPodNames(podList.Items)
 
+	// The seal of an existing Vault is recorded as it is, changing it later starts a migration
+	sealStatus := v.Status.Seal
+	if sealStatus == "" {
+		sealStatus = seal
+	} else if sealMigration {
+		migrated, err := r.sealMigrated(v, sealType, podList.Items)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if migrated {
+			log.Info("vault seal migrated", "seal", sealType)
+			sealStatus = seal
+		}
+	}
+
 	var leader string
 	for _, podName := range podNames {
 		url := fmt.Sprintf("%s://%s.%s:8200/v1/sys/health", strings.ToLower(string(getVaultURIScheme(v))), podName, v.Namespace)
@@ -523,6 +594,14 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		}
 	}
 
+	// Autopilot can be configured only on an unsealed Raft cluster
+	if v.Spec.IsRaftStorage() && v.Spec.RaftAutopilot != nil && leader != "" {
+		err = r.configureRaftAutopilot(v)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	// Fetch the Vault instance again to minimize the possibility of updating a stale object
 	// see https://github.com/banzaicloud/bank-vaults/issues/364
 	v = &vaultv1alpha1.Vault{}
@@ -538,9 +617,10 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		return reconcile.Result{}, err
 	}
 
-	if !reflect.DeepEqual(podNames, v.Status.Nodes) || !reflect.DeepEqual(leader, v.Status.Leader) {
+	if !reflect.DeepEqual(podNames, v.Status.Nodes) || !reflect.DeepEqual(leader, v.Status.Leader) || sealStatus != v.Status.Seal {
 		v.Status.Nodes = podNames
 		v.Status.Leader = leader
+		v.Status.Seal = sealStatus
 		log.V(1).Info("Updating vault status", "status", v.Status,
 			"resourceVersion", v.ResourceVersion)
 		err := r.client.Update(context.TODO(), v)
@@ -549,6 +629,11 @@ func (r *ReconcileVault) Reconcile(request reconcile.Request) (reconcile.Result,
 		}
 	}
 
+	// Check the progress of the seal migration until it is finished
+	if sealStatus != seal {
+		return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
 	return reconcile.Result{}, nil
 }
 
@@ -793,6 +878,8 @@ func perInstanceServicesForVault(v *vaultv1alpha1.Vault) []*corev1.Service {
 				Type:     corev1.ServiceTypeClusterIP,
 				Selector: ls,
 				Ports:    servicePorts,
+				// Raft peers and the unsealer Deployment have to reach the instances before they are unsealed (and ready)
+				PublishNotReadyAddresses: v.Spec.IsRaftStorage() || v.Spec.IsUnsealDeployment(),
 			},
 		}
 
@@ -807,6 +894,9 @@ func serviceForVaultConfigurer(v *vaultv1alpha1.Vault) *corev1.Service {
 
 	ls := labelsForVaultConfigurer(v.Name)
 	servicePorts = append(servicePorts, corev1.ServicePort{Name: "metrics", Port: 9091})
+	if v.Spec.ConfigurerAPISecret != "" {
+		servicePorts = append(servicePorts, corev1.ServicePort{Name: "api", Port: 9092})
+	}
 
 	serviceName := fmt.Sprintf("%s-configurer", v.Name)
 
@@ -913,6 +1003,31 @@ func deploymentForConfigurer(v *vaultv1alpha1.Vault, configmaps corev1.ConfigMap
 		}
 	}
 
+	containerPorts := []corev1.ContainerPort{{
+		Name:          "metrics",
+		ContainerPort: 9091,
+		Protocol:      "TCP",
+	}}
+	configEnv := []corev1.EnvVar{}
+
+	if v.Spec.ConfigurerAPISecret != "" {
+		configArgs = append(configArgs, "--api-address", ":9092")
+		containerPorts = append(containerPorts, corev1.ContainerPort{
+			Name:          "api",
+			ContainerPort: 9092,
+			Protocol:      "TCP",
+		})
+		configEnv = append(configEnv, corev1.EnvVar{
+			Name: "BANK_VAULTS_API_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: v.Spec.ConfigurerAPISecret},
+					Key:                  "token",
+				},
+			},
+		})
+	}
+
 	podSpec := corev1.PodSpec{
 		ServiceAccountName: v.Spec.GetServiceAccount(),
 		Containers: []corev1.Container{
@@ -922,15 +1037,11 @@ func deploymentForConfigurer(v *vaultv1alpha1.Vault, configmaps corev1.ConfigMap
 				Name:            "bank-vaults",
 				Command:         []string{"bank-vaults", "configure"},
 				Args:            append(v.Spec.UnsealConfig.ToArgs(v), configArgs...),
-				Ports: []corev1.ContainerPort{{
-					Name:          "metrics",
-					ContainerPort: 9091,
-					Protocol:      "TCP",
-				}},
-				Env:          withSecretEnv(v, withTLSEnv(v, false, withCredentialsEnv(v, []corev1.EnvVar{}))),
-				VolumeMounts: withTLSVolumeMount(v, withCredentialsVolumeMount(v, volumeMounts)),
-				WorkingDir:   "/config",
-				Resources:    *getBankVaultsResource(v),
+				Ports:           containerPorts,
+				Env:             withSecretEnv(v, withTLSEnv(v, false, withCredentialsEnv(v, configEnv))),
+				VolumeMounts:    withTLSVolumeMount(v, withCredentialsVolumeMount(v, volumeMounts)),
+				WorkingDir:      "/config",
+				Resources:       *getBankVaultsResource(v),
 			},
 		},
 		Volumes:         withTLSVolume(v, withCredentialsVolume(v, volumes)),
@@ -995,6 +1106,13 @@ func secretForVault(om *vaultv1alpha1.Vault) (*corev1.Secret, time.Time, error)
 		om.Name + "." + om.Namespace + ".svc.cluster.local",
 		"127.0.0.1",
 	}
+	// Raft peers join each other and the unsealer Deployment reaches the instances through the per instance services
+	if om.Spec.IsRaftStorage() || om.Spec.IsUnsealDeployment() {
+		for i := 0; i < int(om.Spec.Size); i++ {
+			podName := fmt.Sprintf("%s-%d", om.Name, i)
+			hostsAndIPs = append(hostsAndIPs, podName, podName+"."+om.Namespace)
+		}
+	}
 	chain, err := bvtls.GenerateTLS(strings.Join(hostsAndIPs, ","), "8760h")
 	if err != nil {
 		return nil, time.Time{}, err
@@ -1103,6 +1221,35 @@ func statefulSetForVault(v *vaultv1alpha1.Vault, externalSecretsToWatchItems []c
 		volumeMounts = append(volumeMounts, etcdVolumeMount)
 	}
 
+	var volumeClaimTemplates []corev1.PersistentVolumeClaim
+	securityContext := withSecurityContext(v)
+	vaultEnv := []corev1.EnvVar{
+		// https://github.com/hashicorp/docker-vault/blob/master/0.X/docker-entrypoint.sh#L12
+		{
+			Name:  "VAULT_CLUSTER_INTERFACE",
+			Value: "eth0",
+		},
+	}
+
+	if v.Spec.IsRaftStorage() {
+		raftPath := withRaftStorage(v)
+		volumeClaimTemplates = raftVolumeClaimTemplates(v)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      raftVolumeName,
+			MountPath: raftPath,
+		})
+		securityContext = withRaftSecurityContext(v, securityContext)
+		// The cluster address is set explicitly, instead of the one derived from the Pod IP
+		vaultEnv = withRaftEnv(v, []corev1.EnvVar{})
+	}
+
+	sealMigration := v.IsSealMigration()
+	if sealMigration {
+		if err := withSealMigration(v); err != nil {
+			return nil, err
+		}
+	}
+
 	configJSON := v.Spec.ConfigJSON()
 	owner := asOwner(v)
 	ownerJSON, err := json.Marshal(owner)
@@ -1110,9 +1257,10 @@ func statefulSetForVault(v *vaultv1alpha1.Vault, externalSecretsToWatchItems []c
 		return nil, err
 	}
 
-	unsealCommand := []string{"bank-vaults", "unseal", "--init"}
-	if v.Spec.IsAutoUnseal() {
-		unsealCommand = append(unsealCommand, "--auto")
+	unsealCommand := unsealCommandForVault(v, sealMigration)
+	// With Raft every instance has its own storage, only the first one initializes Vault, the others join it
+	if v.Spec.IsRaftStorage() {
+		unsealCommand = append(unsealCommand, "--raft-init-pod", v.Name+"-0")
 	}
 	_, containerPorts := getServicePorts(v)
 
@@ -1138,20 +1286,14 @@ func statefulSetForVault(v *vaultv1alpha1.Vault, externalSecretsToWatchItems []c
 				Resources:    *getVaultResource(v),
 			},
 		},
-		Containers: withStatsDContainer(v, string(ownerJSON), withAuditLogContainer(v, string(ownerJSON), []corev1.Container{
+		Containers: withStatsDContainer(v, string(ownerJSON), withAuditLogContainer(v, string(ownerJSON), withUnsealerSidecar(v, unsealCommand, string(ownerJSON), []corev1.Container{
 			{
 				Image:           v.Spec.GetVaultImage(),
 				ImagePullPolicy: corev1.PullIfNotPresent,
 				Name:            "vault",
 				Args:            []string{"server"},
 				Ports:           containerPorts,
-				Env: withTLSEnv(v, true, withCredentialsEnv(v, withVaultEnv(v, []corev1.EnvVar{
-					// https://github.com/hashicorp/docker-vault/blob/master/0.X/docker-entrypoint.sh#L12
-					{
-						Name:  "VAULT_CLUSTER_INTERFACE",
-						Value: "eth0",
-					},
-				}))),
+				Env:             withTLSEnv(v, true, withCredentialsEnv(v, withVaultEnv(v, vaultEnv))),
 				SecurityContext: &corev1.SecurityContext{
 					Capabilities: &corev1.Capabilities{
 						Add: []corev1.Capability{"IPC_LOCK"},
@@ -1182,29 +1324,9 @@ func statefulSetForVault(v *vaultv1alpha1.Vault, externalSecretsToWatchItems []c
 				VolumeMounts: withVaultVolumeMounts(v, volumeMounts),
 				Resources:    *getVaultResource(v),
 			},
-			{
-				Image:           v.Spec.GetBankVaultsImage(),
-				ImagePullPolicy: corev1.PullIfNotPresent,
-				Name:            "bank-vaults",
-				Command:         unsealCommand,
-				Args:            append(v.Spec.UnsealConfig.Options.ToArgs(), v.Spec.UnsealConfig.ToArgs(v)...),
-				Env: withSecretEnv(v, withTLSEnv(v, true, withCredentialsEnv(v, []corev1.EnvVar{
-					{
-						Name:  k8s.EnvK8SOwnerReference,
-						Value: string(ownerJSON),
-					},
-				}))),
-				Ports: []corev1.ContainerPort{{
-					Name:          "metrics",
-					ContainerPort: 9091,
-					Protocol:      "TCP",
-				}},
-				VolumeMounts: withTLSVolumeMount(v, withCredentialsVolumeMount(v, []corev1.VolumeMount{})),
-				Resources:    *getBankVaultsResource(v),
-			},
-		})),
+		}))),
 		Volumes:         withVaultVolumes(v, volumes),
-		SecurityContext: withSecurityContext(v),
+		SecurityContext: securityContext,
 		NodeSelector:    v.Spec.NodeSelector,
 		Tolerations:     v.Spec.Tolerations,
 	}
@@ -1241,6 +1363,7 @@ func statefulSetForVault(v *vaultv1alpha1.Vault, externalSecretsToWatchItems []c
 				},
 				Spec: podSpec,
 			},
+			VolumeClaimTemplates: volumeClaimTemplates,
 		},
 	}
 	return dep, nil
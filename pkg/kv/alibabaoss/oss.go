@@ -17,6 +17,7 @@ package alibabaoss
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
@@ -54,6 +55,22 @@ func (o *ossStorage) Set(key string, val []byte) error {
 	return nil
 }
 
+// SetStream uploads the value while it is read
+func (o *ossStorage) SetStream(key string, val io.Reader) error {
+	objectKey := objectNameWithPrefix(o.prefix, key)
+
+	bucket, err := o.client.Bucket(o.bucket)
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.PutObject(objectKey, val); err != nil {
+		return fmt.Errorf("error writing key '%s' to OSS bucket '%s': '%s'", objectKey, o.bucket, err.Error())
+	}
+
+	return nil
+}
+
 func (o *ossStorage) Get(key string) ([]byte, error) {
 	objectKey := objectNameWithPrefix(o.prefix, key)
 
@@ -84,6 +101,21 @@ func (o *ossStorage) Get(key string) ([]byte, error) {
 	return b, nil
 }
 
+func (o *ossStorage) Delete(key string) error {
+	objectKey := objectNameWithPrefix(o.prefix, key)
+
+	bucket, err := o.client.Bucket(o.bucket)
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.DeleteObject(objectKey); err != nil {
+		return fmt.Errorf("error deleting key '%s' from OSS bucket '%s': '%s'", objectKey, o.bucket, err.Error())
+	}
+
+	return nil
+}
+
 func objectNameWithPrefix(prefix, key string) string {
 	return fmt.Sprintf("%s%s", prefix, key)
 }
@@ -0,0 +1,211 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+)
+
+const (
+	dataKeySuffix = ".key"
+
+	// The values are encrypted in chunks, so they can be streamed, the nonce of a chunk is a random prefix
+	// stored in front of the first chunk, the counter of the chunk, and a flag marking the last one, so the
+	// chunks can't be reordered or truncated
+	chunkSize       = 64 * 1024
+	noncePrefixSize = 7
+)
+
+type envelope struct {
+	store kv.Service
+	kms   kv.Service
+}
+
+var _ kv.Service = &envelope{}
+var _ kv.StreamSetter = &envelope{}
+
+// New creates a new kv.Service which encrypts the values with a random data key (AES-256-GCM), and stores the
+// data key encrypted by a KMS kv.Service under the "<key>.key" key. This allows storing values larger than
+// the plaintext limit of the KMS services. The kms kv.Service has to be a wrapper around store. The values
+// are streamed into the store if it is a kv.StreamSetter.
+func New(store kv.Service, kms kv.Service) kv.Service {
+	return &envelope{store: store, kms: kms}
+}
+
+func (e *envelope) Set(key string, val []byte) error {
+	return e.SetStream(key, bytes.NewReader(val))
+}
+
+// SetStream encrypts the value while it is read, and streams it into the store if it is a kv.StreamSetter
+func (e *envelope) SetStream(key string, val io.Reader) error {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return fmt.Errorf("error generating data key: %s", err.Error())
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return fmt.Errorf("error generating nonce: %s", err.Error())
+	}
+
+	if err := e.kms.Set(key+dataKeySuffix, dataKey); err != nil {
+		return fmt.Errorf("error storing data key of '%s': %s", key, err.Error())
+	}
+
+	return kv.SetStream(e.store, key, func(w io.Writer) error {
+		return encrypt(gcm, noncePrefix, key, w, val)
+	})
+}
+
+func (e *envelope) Get(key string) ([]byte, error) {
+	cipherText, err := e.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := e.kms.Get(key + dataKeySuffix)
+	if err != nil {
+		return nil, fmt.Errorf("error getting data key of '%s': %s", key, err.Error())
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plainText, err := decrypt(gcm, key, cipherText)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting '%s': %s", key, err.Error())
+	}
+
+	return plainText, nil
+}
+
+// Delete deletes both the value and its data key, if the underlying store is a kv.Deleter
+func (e *envelope) Delete(key string) error {
+	deleter, ok := e.store.(kv.Deleter)
+	if !ok {
+		return fmt.Errorf("the underlying kv store doesn't support deleting keys")
+	}
+
+	if err := deleter.Delete(key); err != nil {
+		return err
+	}
+
+	return deleter.Delete(key + dataKeySuffix)
+}
+
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM: %s", err.Error())
+	}
+
+	return gcm, nil
+}
+
+// chunkNonce returns the nonce of the chunk, the counter is 4 bytes, so a value can have 2^32 chunks
+func chunkNonce(noncePrefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encrypt writes the nonce prefix and the encrypted chunks of the value to w, the last chunk is shorter than
+// the others, or empty if the length of the value is a multiple of the chunk size
+func encrypt(gcm cipher.AEAD, noncePrefix []byte, key string, w io.Writer, val io.Reader) error {
+	if _, err := w.Write(noncePrefix); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(val)
+	chunk := make([]byte, chunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(gcm.Seal(nil, chunkNonce(noncePrefix, counter, last), chunk[:n], []byte(key))); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// decrypt returns the value from the nonce prefix and the encrypted chunks written by encrypt
+func decrypt(gcm cipher.AEAD, key string, cipherText []byte) ([]byte, error) {
+	if len(cipherText) < noncePrefixSize+gcm.Overhead() {
+		return nil, fmt.Errorf("value is too short")
+	}
+
+	noncePrefix, cipherText := cipherText[:noncePrefixSize], cipherText[noncePrefixSize:]
+	sealedChunkSize := chunkSize + gcm.Overhead()
+
+	var plainText []byte
+	for counter := uint32(0); ; counter++ {
+		n := len(cipherText)
+		last := n <= sealedChunkSize
+		if !last {
+			n = sealedChunkSize
+		}
+
+		chunk, err := gcm.Open(nil, chunkNonce(noncePrefix, counter, last), cipherText[:n], []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		plainText = append(plainText, chunk...)
+		cipherText = cipherText[n:]
+
+		if last {
+			return plainText, nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+)
+
+type memoryStore map[string][]byte
+
+func (m memoryStore) Set(key string, val []byte) error {
+	m[key] = val
+	return nil
+}
+
+func (m memoryStore) Get(key string) ([]byte, error) {
+	val, ok := m[key]
+	if !ok {
+		return nil, kv.NewNotFoundError("key '%s' is not present", key)
+	}
+	return val, nil
+}
+
+type memoryStreamStore struct {
+	memoryStore
+}
+
+func (m memoryStreamStore) SetStream(key string, val io.Reader) error {
+	b, err := ioutil.ReadAll(val)
+	if err != nil {
+		return err
+	}
+	return m.Set(key, b)
+}
+
+func TestEnvelope(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize}
+
+	stores := map[string]kv.Service{
+		"buffered": memoryStore{},
+		"streamed": memoryStreamStore{memoryStore{}},
+	}
+
+	for name, store := range stores {
+		e := New(store, store)
+
+		for _, size := range sizes {
+			val := bytes.Repeat([]byte("v"), size)
+
+			if err := e.Set("snapshot", val); err != nil {
+				t.Fatalf("%s store, %d bytes: %s", name, size, err.Error())
+			}
+
+			got, err := e.Get("snapshot")
+			if err != nil {
+				t.Fatalf("%s store, %d bytes: %s", name, size, err.Error())
+			}
+			if !bytes.Equal(got, val) {
+				t.Errorf("%s store, %d bytes: got %d different bytes", name, size, len(got))
+			}
+		}
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	store := memoryStore{}
+	e := New(store, store)
+
+	if err := e.Set("snapshot", bytes.Repeat([]byte("v"), 2*chunkSize+1)); err != nil {
+		t.Fatal(err.Error())
+	}
+	cipherText := store["snapshot"]
+
+	tests := map[string][]byte{
+		// the value ends with a complete chunk, but it isn't flagged as the last one
+		"truncated": cipherText[:noncePrefixSize+2*(chunkSize+16)],
+		"reordered": append(append(append([]byte{}, cipherText[:noncePrefixSize]...),
+			cipherText[noncePrefixSize+chunkSize+16:noncePrefixSize+2*(chunkSize+16)]...),
+			append(cipherText[noncePrefixSize:noncePrefixSize+chunkSize+16], cipherText[noncePrefixSize+2*(chunkSize+16):]...)...),
+		"another key": cipherText,
+	}
+
+	for name, tampered := range tests {
+		key := "snapshot"
+		if name == "another key" {
+			key = "another"
+			store[key+dataKeySuffix] = store["snapshot"+dataKeySuffix]
+		}
+		store[key] = tampered
+
+		if _, err := e.Get(key); err == nil {
+			t.Errorf("Decrypting the %s value should fail", name)
+		}
+	}
+}
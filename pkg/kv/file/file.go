@@ -15,6 +15,7 @@
 package file
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -38,6 +39,24 @@ func (f *file) Set(key string, val []byte) error {
 	return ioutil.WriteFile(path.Join(f.path, key), val, 0600)
 }
 
+// SetStream writes the value into the file while it is read, the file is removed if reading fails
+func (f *file) SetStream(key string, val io.Reader) error {
+	name := path.Join(f.path, key)
+
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, val); err != nil {
+		out.Close()
+		os.Remove(name)
+		return err
+	}
+
+	return out.Close()
+}
+
 func (f *file) Get(key string) ([]byte, error) {
 	val, err := ioutil.ReadFile(path.Join(f.path, key))
 	if os.IsNotExist(err) {
@@ -46,3 +65,12 @@ func (f *file) Get(key string) ([]byte, error) {
 
 	return val, err
 }
+
+func (f *file) Delete(key string) error {
+	err := os.Remove(path.Join(f.path, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -17,6 +17,7 @@ package gcs
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 
 	"cloud.google.com/go/storage"
@@ -51,6 +52,22 @@ func (g *gcsStorage) Set(key string, val []byte) error {
 	return w.Close()
 }
 
+// SetStream writes the value into the object while it is read, the object isn't created if reading fails
+func (g *gcsStorage) SetStream(key string, val io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := objectNameWithPrefix(g.prefix, key)
+	w := g.cl.Bucket(g.bucket).Object(n).NewWriter(ctx)
+	if _, err := io.Copy(w, val); err != nil {
+		cancel()
+		w.Close()
+		return fmt.Errorf("error writing key '%s' to gcs bucket '%s': %s", n, g.bucket, err.Error())
+	}
+
+	return w.Close()
+}
+
 func (g *gcsStorage) Get(key string) ([]byte, error) {
 	ctx := context.Background()
 	n := objectNameWithPrefix(g.prefix, key)
@@ -74,6 +91,18 @@ func (g *gcsStorage) Get(key string) ([]byte, error) {
 	return b, nil
 }
 
+func (g *gcsStorage) Delete(key string) error {
+	ctx := context.Background()
+	n := objectNameWithPrefix(g.prefix, key)
+
+	err := g.cl.Bucket(g.bucket).Object(n).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("error deleting key '%s' from gcs bucket '%s': %s", n, g.bucket, err.Error())
+	}
+
+	return nil
+}
+
 func objectNameWithPrefix(prefix, key string) string {
 	return fmt.Sprintf("%s%s", prefix, key)
 }
@@ -119,3 +119,26 @@ func (k *k8sStorage) Get(key string) ([]byte, error) {
 
 	return val, nil
 }
+
+// Delete removes the key from the secret, the secret itself is kept
+func (k *k8sStorage) Delete(key string) error {
+	secret, err := k.cl.CoreV1().Secrets(k.namespace).Get(k.secret, metav1.GetOptions{})
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting secret for key '%s': %s", key, err.Error())
+	}
+
+	if _, ok := secret.Data[key]; !ok {
+		return nil
+	}
+
+	delete(secret.Data, key)
+	_, err = k.cl.CoreV1().Secrets(k.namespace).Update(secret)
+	if err != nil {
+		return fmt.Errorf("error deleting secret key '%s' from secret '%s': '%s'", key, k.secret, err.Error())
+	}
+	return nil
+}
@@ -14,7 +14,11 @@
 
 package kv
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
 
 // NotFoundError represents an error when a key is not found
 type NotFoundError struct {
@@ -37,6 +41,51 @@ type Service interface {
 	Get(key string) ([]byte, error)
 }
 
+// Deleter is implemented by the key-value stores which are able to delete keys,
+// like the object storage based ones.
+type Deleter interface {
+	Delete(key string) error
+}
+
+// StreamSetter is implemented by the key-value stores which are able to store a value
+// from a reader without holding it in memory, like the object storage based ones.
+type StreamSetter interface {
+	SetStream(key string, val io.Reader) error
+}
+
+// SetStream stores the value written by write under the key, it is streamed into the
+// store if it is a StreamSetter, and buffered in memory otherwise. If write fails, the
+// store fails reading the value, and is expected to drop what it has read.
+func SetStream(store Service, key string, write func(w io.Writer) error) error {
+	streamer, ok := store.(StreamSetter)
+	if !ok {
+		var buffer bytes.Buffer
+		if err := write(&buffer); err != nil {
+			return err
+		}
+		return store.Set(key, buffer.Bytes())
+	}
+
+	reader, writer := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(writer)
+		writer.CloseWithError(err)
+		written <- err
+	}()
+
+	err := streamer.SetStream(key, reader)
+	// unblocks write if the store has failed before reading the whole value
+	reader.CloseWithError(err)
+	writeErr := <-written
+
+	// the error of the store holds the error of write if that was the cause
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
 type Tester struct {
 	Service Service
 }
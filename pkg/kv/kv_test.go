@@ -0,0 +1,86 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type streamStore struct {
+	values map[string][]byte
+	err    error
+}
+
+func (s *streamStore) Set(key string, val []byte) error {
+	s.values[key] = val
+	return nil
+}
+
+func (s *streamStore) Get(key string) ([]byte, error) {
+	return s.values[key], nil
+}
+
+func (s *streamStore) SetStream(key string, val io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	b, err := ioutil.ReadAll(val)
+	if err != nil {
+		return err
+	}
+	return s.Set(key, b)
+}
+
+func TestSetStream(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 1024*1024)
+	writeErr := errors.New("write failed")
+	storeErr := errors.New("store failed")
+
+	tests := []struct {
+		name     string
+		storeErr error
+		writeErr error
+		expected error
+	}{
+		{name: "streamed"},
+		{name: "write failed", writeErr: writeErr, expected: writeErr},
+		{name: "store failed", storeErr: storeErr, expected: storeErr},
+		{name: "both failed", storeErr: storeErr, writeErr: writeErr, expected: storeErr},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &streamStore{values: map[string][]byte{}, err: test.storeErr}
+
+			err := SetStream(store, "key", func(w io.Writer) error {
+				if _, err := w.Write(value); err != nil {
+					return err
+				}
+				return test.writeErr
+			})
+
+			if err != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, err)
+			}
+			if err == nil && !bytes.Equal(store.values["key"], value) {
+				t.Fatalf("The value is not stored properly")
+			}
+		})
+	}
+}
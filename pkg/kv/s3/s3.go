@@ -17,12 +17,14 @@ package s3
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/banzaicloud/bank-vaults/pkg/kv"
 )
@@ -65,6 +67,22 @@ func (s3 *s3Storage) Set(key string, val []byte) error {
 	return nil
 }
 
+// SetStream uploads the value in parts while it is read, so only a few parts are held in memory
+func (s3 *s3Storage) SetStream(key string, val io.Reader) error {
+	n := objectNameWithPrefix(s3.prefix, key)
+	input := s3manager.UploadInput{
+		Bucket: aws.String(s3.bucket),
+		Key:    aws.String(n),
+		Body:   val,
+	}
+
+	if _, err := s3manager.NewUploaderWithClient(s3.client).Upload(&input); err != nil {
+		return fmt.Errorf("error writing key '%s' to s3 bucket '%s': '%s'", n, s3.bucket, err.Error())
+	}
+
+	return nil
+}
+
 func (s3 *s3Storage) Get(key string) ([]byte, error) {
 	n := objectNameWithPrefix(s3.prefix, key)
 
@@ -92,6 +110,21 @@ func (s3 *s3Storage) Get(key string) ([]byte, error) {
 	return b, nil
 }
 
+func (s3 *s3Storage) Delete(key string) error {
+	n := objectNameWithPrefix(s3.prefix, key)
+
+	input := awss3.DeleteObjectInput{
+		Bucket: aws.String(s3.bucket),
+		Key:    aws.String(n),
+	}
+
+	if _, err := s3.client.DeleteObject(&input); err != nil {
+		return fmt.Errorf("error deleting key '%s' from s3 bucket '%s': '%s'", n, s3.bucket, err.Error())
+	}
+
+	return nil
+}
+
 func objectNameWithPrefix(prefix, key string) string {
 	return fmt.Sprintf("%s%s", prefix, key)
 }
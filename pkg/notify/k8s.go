@@ -0,0 +1,123 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+type kubernetesSink struct {
+	cl     *kubernetes.Clientset
+	object v1.ObjectReference
+	host   string
+}
+
+// NewKubernetesSink creates a Sink which records the events as Kubernetes Events on the Vault custom resource
+// (given in the K8S_OWNER_REFERENCE environment variable, like for the K8S key store), or on the Pod of bank-vaults
+func NewKubernetesSink() (Sink, error) {
+	kubeconfig := os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+	var config *rest.Config
+	var err error
+
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating k8s config: %s", err.Error())
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating k8s client: %s", err.Error())
+	}
+
+	namespace, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading namespace of the Pod: %s", err.Error())
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %s", err.Error())
+	}
+
+	object := v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  strings.TrimSpace(string(namespace)),
+		Name:       hostname,
+	}
+
+	if ownerReference := os.Getenv(k8s.EnvK8SOwnerReference); ownerReference != "" {
+		owner := metav1.OwnerReference{}
+		if err := json.Unmarshal([]byte(ownerReference), &owner); err != nil {
+			return nil, fmt.Errorf("error parsing owner reference: %s", err.Error())
+		}
+		object.APIVersion = owner.APIVersion
+		object.Kind = owner.Kind
+		object.Name = owner.Name
+		object.UID = owner.UID
+	}
+
+	return &kubernetesSink{cl: client, object: object, host: hostname}, nil
+}
+
+func (s *kubernetesSink) Send(event Event, message string) error {
+	eventType := v1.EventTypeNormal
+	if event.Severity == SeverityWarning {
+		eventType = v1.EventTypeWarning
+	}
+
+	timestamp := metav1.NewTime(event.Time)
+
+	_, err := s.cl.CoreV1().Events(s.object.Namespace).Create(&v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: s.object.Name + "-",
+			Namespace:    s.object.Namespace,
+		},
+		InvolvedObject: s.object,
+		Reason:         event.Type.Reason(),
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+		Source: v1.EventSource{
+			Component: "bank-vaults",
+			Host:      s.host,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating kubernetes event: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventType is the type of the events bank-vaults notifies about
+type EventType string
+
+const (
+	// EventSealed is fired when Vault is found sealed
+	EventSealed EventType = "sealed"
+	// EventUnsealed is fired when Vault has been unsealed
+	EventUnsealed EventType = "unsealed"
+	// EventUnsealFailed is fired when Vault could not be unsealed
+	EventUnsealFailed EventType = "unseal-failed"
+	// EventInitialized is fired when Vault has been initialized
+	EventInitialized EventType = "initialized"
+	// EventConfigureFailed is fired when a configuration could not be applied
+	EventConfigureFailed EventType = "configure-failed"
+	// EventConfigureRecovered is fired when a configuration has been applied after failing
+	EventConfigureRecovered EventType = "configure-recovered"
+	// EventKVError is fired when the key store could not be accessed
+	EventKVError EventType = "kv-error"
+)
+
+// Severity is the severity of an event
+type Severity string
+
+const (
+	// SeverityInfo is the severity of the events which need no action
+	SeverityInfo Severity = "info"
+	// SeverityWarning is the severity of the events which may need an action
+	SeverityWarning Severity = "warning"
+)
+
+var eventReasons = map[EventType]string{
+	EventSealed:             "VaultSealed",
+	EventUnsealed:           "VaultUnsealed",
+	EventUnsealFailed:       "VaultUnsealFailed",
+	EventInitialized:        "VaultInitialized",
+	EventConfigureFailed:    "VaultConfigureFailed",
+	EventConfigureRecovered: "VaultConfigureRecovered",
+	EventKVError:            "KeyStoreError",
+}
+
+// Severity returns the severity of the events of this type
+func (t EventType) Severity() Severity {
+	switch t {
+	case EventSealed, EventUnsealFailed, EventConfigureFailed, EventKVError:
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// recovery returns true if the events of this type end a failure of their source
+func (t EventType) recovery() bool {
+	return t == EventUnsealed || t == EventConfigureRecovered
+}
+
+// Reason returns the CamelCase form of the event type, e.g. for Kubernetes Events
+func (t EventType) Reason() string {
+	return eventReasons[t]
+}
+
+// Event is something bank-vaults notifies about
+type Event struct {
+	Type     EventType `json:"type"`
+	Severity Severity  `json:"severity"`
+	// Source is what the event is about: a Vault address, a configuration file or a key store
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// NewEvent creates an event of the type, with the error of err if it is not nil
+func NewEvent(eventType EventType, source, message string, err error) Event {
+	event := Event{
+		Type:     eventType,
+		Severity: eventType.Severity(),
+		Source:   source,
+		Message:  message,
+		Time:     time.Now(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// Sink delivers the notifications, message is the event rendered with the message template
+type Sink interface {
+	Send(event Event, message string) error
+}
+
+// DefaultTemplate is the default message template, it is executed with the Event
+const DefaultTemplate = `[{{ .Severity }}] {{ .Type }} {{ .Source }}: {{ .Message }}{{ if .Error }}: {{ .Error }}{{ end }}`
+
+// Config holds the configuration of the Notifier
+type Config struct {
+	// Template is the text/template of the messages, DefaultTemplate if empty
+	Template string
+	// DedupWindow is how long the same event (type and error) of a source is not sent again
+	DedupWindow time.Duration
+	// RateLimit is the maximum number of notifications sent per minute, 0 means no limit
+	RateLimit int
+}
+
+// Notifier sends the events to every sink, the same event of a source is sent only once
+// in the dedup window (until the source recovers), and at most RateLimit events are sent
+// per minute. A nil Notifier doesn't send anything.
+type Notifier struct {
+	sinks       []Sink
+	template    *template.Template
+	dedupWindow time.Duration
+	rateLimit   int
+
+	mu sync.Mutex
+	// last is the time the events were sent at, by source and fingerprint (type and error)
+	last map[string]map[string]time.Time
+	sent []time.Time
+}
+
+// New creates a Notifier, it returns nil if there are no sinks
+func New(sinks []Sink, config Config) (*Notifier, error) {
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	text := config.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing notification template: %s", err.Error())
+	}
+
+	return &Notifier{
+		sinks:       sinks,
+		template:    tmpl,
+		dedupWindow: config.DedupWindow,
+		rateLimit:   config.RateLimit,
+		last:        map[string]map[string]time.Time{},
+	}, nil
+}
+
+// Notify sends the event to the sinks in the background, unless it is a duplicate or the rate limit is exceeded
+func (n *Notifier) Notify(event Event) {
+	if n == nil || !n.allow(event) {
+		return
+	}
+
+	var message bytes.Buffer
+	if err := n.template.Execute(&message, event); err != nil {
+		logrus.Errorf("error rendering notification: %s", err.Error())
+		return
+	}
+
+	for _, sink := range n.sinks {
+		go func(sink Sink) {
+			if err := sink.Send(event, message.String()); err != nil {
+				logrus.Errorf("error sending notification: %s", err.Error())
+			}
+		}(sink)
+	}
+}
+
+// allow returns false if the same event has been sent for the source in the dedup window, so alternating
+// events of a failing source (e.g. sealed, unseal-failed, sealed) are sent once. A recovery of the source
+// (unsealed, configure-recovered) forgets its events, so the next failure is always sent, and a failure
+// forgets the recoveries of the source, so the next recovery is always sent too.
+func (n *Notifier) allow(event Event) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fingerprint := eventFingerprint(event.Type, event.Error)
+	sent, ok := n.last[event.Source]
+	if !ok {
+		sent = map[string]time.Time{}
+		n.last[event.Source] = sent
+	}
+	for f, t := range sent {
+		if event.Time.Sub(t) >= n.dedupWindow {
+			delete(sent, f)
+		}
+	}
+	if _, ok := sent[fingerprint]; ok {
+		logrus.Debugf("suppressing duplicate notification: %s %s", event.Type, event.Source)
+		return false
+	}
+
+	if n.rateLimit > 0 {
+		sent := n.sent[:0]
+		for _, t := range n.sent {
+			if event.Time.Sub(t) < time.Minute {
+				sent = append(sent, t)
+			}
+		}
+		n.sent = sent
+
+		if len(n.sent) >= n.rateLimit {
+			logrus.Warnf("notification rate limit exceeded, dropping notification: %s %s", event.Type, event.Source)
+			return false
+		}
+		n.sent = append(n.sent, event.Time)
+	}
+
+	if event.Type.recovery() {
+		sent = map[string]time.Time{}
+		n.last[event.Source] = sent
+	} else if event.Type.Severity() == SeverityWarning {
+		for _, eventType := range []EventType{EventUnsealed, EventConfigureRecovered} {
+			delete(sent, eventFingerprint(eventType, ""))
+		}
+	}
+	sent[fingerprint] = event.Time
+
+	return true
+}
+
+func eventFingerprint(eventType EventType, err string) string {
+	return string(eventType) + "\x00" + err
+}
@@ -0,0 +1,115 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		eventType EventType
+		source    string
+		err       string
+		// after is the time of the event since the first one
+		after   time.Duration
+		allowed bool
+	}
+
+	tests := []struct {
+		name      string
+		rateLimit int
+		steps     []step
+	}{
+		{
+			name: "duplicate in the window",
+			steps: []step{
+				{eventType: EventSealed, source: "vault-0", allowed: true},
+				{eventType: EventSealed, source: "vault-0", after: time.Minute},
+				{eventType: EventSealed, source: "vault-0", after: 11 * time.Minute, allowed: true},
+			},
+		},
+		{
+			name: "alternating failures",
+			steps: []step{
+				{eventType: EventSealed, source: "vault-0", allowed: true},
+				{eventType: EventUnsealFailed, source: "vault-0", err: "no keys", after: time.Second, allowed: true},
+				{eventType: EventSealed, source: "vault-0", after: 2 * time.Second},
+				{eventType: EventUnsealFailed, source: "vault-0", err: "no keys", after: 3 * time.Second},
+				{eventType: EventUnsealFailed, source: "vault-0", err: "other error", after: 4 * time.Second, allowed: true},
+			},
+		},
+		{
+			name: "failures and recoveries",
+			steps: []step{
+				{eventType: EventUnsealed, source: "vault-0", allowed: true},
+				{eventType: EventSealed, source: "vault-0", after: time.Minute, allowed: true},
+				{eventType: EventUnsealed, source: "vault-0", after: 2 * time.Minute, allowed: true},
+				{eventType: EventSealed, source: "vault-0", after: 3 * time.Minute, allowed: true},
+				{eventType: EventUnsealed, source: "vault-0", after: 4 * time.Minute, allowed: true},
+			},
+		},
+		{
+			name: "repeated recovery",
+			steps: []step{
+				{eventType: EventConfigureFailed, source: "vault-config.yml", err: "bad policy", allowed: true},
+				{eventType: EventConfigureRecovered, source: "vault-config.yml", after: time.Minute, allowed: true},
+				{eventType: EventConfigureRecovered, source: "vault-config.yml", after: 2 * time.Minute},
+			},
+		},
+		{
+			name: "sources",
+			steps: []step{
+				{eventType: EventSealed, source: "vault-0", allowed: true},
+				{eventType: EventSealed, source: "vault-1", allowed: true},
+				{eventType: EventUnsealed, source: "vault-0", after: time.Second, allowed: true},
+				{eventType: EventSealed, source: "vault-1", after: 2 * time.Second},
+			},
+		},
+		{
+			name:      "rate limit",
+			rateLimit: 2,
+			steps: []step{
+				{eventType: EventSealed, source: "vault-0", allowed: true},
+				{eventType: EventSealed, source: "vault-1", allowed: true},
+				{eventType: EventSealed, source: "vault-2"},
+				{eventType: EventSealed, source: "vault-2", after: time.Minute, allowed: true},
+			},
+		},
+	}
+
+	start := time.Now()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &Notifier{dedupWindow: 10 * time.Minute, rateLimit: test.rateLimit, last: map[string]map[string]time.Time{}}
+
+			for i, step := range test.steps {
+				var err error
+				if step.err != "" {
+					err = errors.New(step.err)
+				}
+				event := NewEvent(step.eventType, step.source, "message", err)
+				event.Time = start.Add(step.after)
+
+				if allowed := n.allow(event); allowed != step.allowed {
+					t.Errorf("expected allowed %t for event %d (%s %s), got %t", step.allowed, i, step.eventType, step.source, allowed)
+				}
+			}
+		})
+	}
+}
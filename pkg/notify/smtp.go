@@ -0,0 +1,73 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPConfig holds the configuration of the SMTP sink
+type SMTPConfig struct {
+	// Address of the SMTP server in host:port form
+	Address  string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+type smtpSink struct {
+	config SMTPConfig
+	auth   smtp.Auth
+}
+
+// NewSMTPSink creates a Sink which sends the events in e-mails, with PLAIN authentication if a username is set
+func NewSMTPSink(config SMTPConfig) (Sink, error) {
+	if config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("the SMTP notification sink requires a sender and at least one recipient")
+	}
+
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SMTP server address: %s", err.Error())
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+
+	return &smtpSink{config: config, auth: auth}, nil
+}
+
+func (s *smtpSink) Send(event Event, message string) error {
+	var mail strings.Builder
+	fmt.Fprintf(&mail, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&mail, "To: %s\r\n", strings.Join(s.config.To, ", "))
+	fmt.Fprintf(&mail, "Subject: [bank-vaults] %s %s\r\n", event.Type, event.Source)
+	fmt.Fprintf(&mail, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&mail, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&mail, "\r\n%s\r\n", message)
+
+	if err := smtp.SendMail(s.config.Address, s.auth, s.config.From, s.config.To, []byte(mail.String())); err != nil {
+		return fmt.Errorf("error sending e-mail notification: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	Event
+	Text string `json:"text"`
+}
+
+// NewWebhookSink creates a Sink which POSTs the events as JSON to the URL, with the rendered
+// message in the text field (which is understood by Slack and Mattermost incoming webhooks)
+func NewWebhookSink(url string) Sink {
+	return &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *webhookSink) Send(event Event, message string) error {
+	body, err := json.Marshal(webhookPayload{Event: event, Text: message})
+	if err != nil {
+		return fmt.Errorf("error marshaling webhook notification: %s", err.Error())
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error sending webhook notification: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error sending webhook notification: unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
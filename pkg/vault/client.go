@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,10 +45,21 @@ func NewData(cas int, data map[string]interface{}) map[string]interface{} {
 	}
 }
 
+// The auth methods the client can log in with, if it has no token
+const (
+	AuthMethodKubernetes = "kubernetes"
+	AuthMethodJWT        = "jwt"
+	AuthMethodAppRole    = "approle"
+)
+
 type clientOptions struct {
-	role      string
-	authPath  string
-	tokenPath string
+	role          string
+	authPath      string
+	tokenPath     string
+	authMethod    string
+	jwtPath       string
+	appRoleID     string
+	appRoleSecret string
 }
 
 // ClientOption configures a Vault client using the functional options paradigm popularized by Rob Pike and Dave Cheney.
@@ -79,14 +91,85 @@ func (co ClientTokenPath) apply(o *clientOptions) {
 	o.tokenPath = string(co)
 }
 
+// ClientAuthMethod is the auth method the client logs in with if it has no token: kubernetes (the default),
+// jwt or approle. The default is taken from the VAULT_AUTH_METHOD environment variable.
+type ClientAuthMethod string
+
+func (co ClientAuthMethod) apply(o *clientOptions) {
+	o.authMethod = string(co)
+}
+
+// ClientJWTPath file where the JWT for the jwt auth method can be found.
+// The default is taken from the VAULT_JWT_PATH environment variable.
+type ClientJWTPath string
+
+func (co ClientJWTPath) apply(o *clientOptions) {
+	o.jwtPath = string(co)
+}
+
+// ClientAppRole is the role ID and the secret ID for the approle auth method.
+// The defaults are taken from the VAULT_ROLE_ID and VAULT_SECRET_ID environment variables.
+type ClientAppRole struct {
+	RoleID   string
+	SecretID string
+}
+
+func (co ClientAppRole) apply(o *clientOptions) {
+	o.appRoleID = co.RoleID
+	o.appRoleSecret = co.SecretID
+}
+
+// loginData returns the body of the login request of the auth method
+func (o *clientOptions) loginData() (map[string]interface{}, error) {
+	switch o.authMethod {
+	case AuthMethodKubernetes:
+		// Check that we are in Kubernetes
+		_, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		jwt, err := ioutil.ReadFile(serviceAccountFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"jwt": string(jwt), "role": o.role}, nil
+
+	case AuthMethodJWT:
+		if o.jwtPath == "" {
+			return nil, fmt.Errorf("the jwt auth method requires a JWT file")
+		}
+
+		jwt, err := ioutil.ReadFile(o.jwtPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"jwt": strings.TrimSpace(string(jwt)), "role": o.role}, nil
+
+	case AuthMethodAppRole:
+		if o.appRoleID == "" {
+			return nil, fmt.Errorf("the approle auth method requires a role ID")
+		}
+
+		return map[string]interface{}{"role_id": o.appRoleID, "secret_id": o.appRoleSecret}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth method: %s", o.authMethod)
+	}
+}
+
 // Client is a Vault client with Kubernetes support and token automatic renewing
 type Client struct {
 	client       *vaultapi.Client
 	logical      *vaultapi.Logical
 	tokenRenewer *vaultapi.Renewer
-	closed       bool
-	watch        *fsnotify.Watcher
-	mu           sync.Mutex
+	// renewing is set if the token is renewed already, by the login loop or by RenewToken
+	renewing bool
+	closed   bool
+	watch    *fsnotify.Watcher
+	mu       sync.Mutex
 }
 
 // NewClient creates a new Vault client.
@@ -181,9 +264,26 @@ func NewClientFromRawClient(rawClient *vaultapi.Client, opts ...ClientOption) (*
 		o.role = "default"
 	}
 
+	// Default auth method
+	if o.authMethod == "" {
+		o.authMethod = AuthMethodKubernetes
+		if env, ok := os.LookupEnv("VAULT_AUTH_METHOD"); ok && env != "" {
+			o.authMethod = env
+		}
+	}
+
 	// Default auth path
 	if o.authPath == "" {
-		o.authPath = "kubernetes"
+		o.authPath = o.authMethod
+	}
+
+	if o.jwtPath == "" {
+		o.jwtPath = os.Getenv("VAULT_JWT_PATH")
+	}
+
+	if o.appRoleID == "" {
+		o.appRoleID = os.Getenv("VAULT_ROLE_ID")
+		o.appRoleSecret = os.Getenv("VAULT_SECRET_ID")
 	}
 
 	// Default token path
@@ -202,15 +302,9 @@ func NewClientFromRawClient(rawClient *vaultapi.Client, opts ...ClientOption) (*
 			rawClient.SetToken(string(token))
 		} else {
 			// If VAULT_TOKEN, VAULT_TOKEN_PATH or ~/.vault-token wasn't provided let's
-			// suppose we are in Kubernetes and try to get one with the ServiceAccount token.
-
-			// Check that we are in Kubernetes
-			_, err := rest.InClusterConfig()
-			if err != nil {
-				return nil, err
-			}
-
-			jwt, err := ioutil.ReadFile(serviceAccountFile)
+			// log in with the auth method, by default we suppose we are in Kubernetes and
+			// try to get one with the ServiceAccount token.
+			data, err := o.loginData()
 			if err != nil {
 				return nil, err
 			}
@@ -218,6 +312,9 @@ func NewClientFromRawClient(rawClient *vaultapi.Client, opts ...ClientOption) (*
 			initialTokenArrived := make(chan string, 1)
 			initialTokenSent := false
 
+			// The login loop renews the tokens it receives
+			client.renewing = true
+
 			go func() {
 				for {
 					client.mu.Lock()
@@ -227,8 +324,6 @@ func NewClientFromRawClient(rawClient *vaultapi.Client, opts ...ClientOption) (*
 					}
 					client.mu.Unlock()
 
-					data := map[string]interface{}{"jwt": string(jwt), "role": o.role}
-
 					secret, err := logical.Write(fmt.Sprintf("auth/%s/login", o.authPath), data)
 					if err != nil {
 						log.Println("Failed to request new Vault token", err.Error())
@@ -298,6 +393,76 @@ func runRenewChecker(tokenRenewer *vaultapi.Renewer) {
 	}
 }
 
+// RenewToken starts renewing the token of the client in the background, if the token is renewable
+// and it is not renewed already (because it was given in VAULT_TOKEN or in a token file)
+func (client *Client) RenewToken() error {
+	client.mu.Lock()
+	if client.renewing || client.closed {
+		client.mu.Unlock()
+		return nil
+	}
+	client.renewing = true
+	client.mu.Unlock()
+
+	// The lookup is done without holding the lock, the renewal is claimed above and given up on failure
+	renewing := false
+	defer func() {
+		if !renewing {
+			client.mu.Lock()
+			client.renewing = false
+			client.mu.Unlock()
+		}
+	}()
+
+	secret, err := client.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return fmt.Errorf("error looking up Vault token: %s", err.Error())
+	}
+
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return fmt.Errorf("error looking up Vault token: %s", err.Error())
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("error looking up Vault token: %s", err.Error())
+	}
+
+	if !renewable || ttl == 0 {
+		log.Println("Vault token is not renewable")
+		return nil
+	}
+
+	tokenRenewer, err := client.client.NewRenewer(&vaultapi.RenewerInput{
+		Secret: &vaultapi.Secret{
+			Auth: &vaultapi.SecretAuth{
+				ClientToken:   client.client.Token(),
+				Renewable:     renewable,
+				LeaseDuration: int(ttl.Seconds()),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating Vault token renewer: %s", err.Error())
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return nil
+	}
+
+	client.tokenRenewer = tokenRenewer
+	renewing = true
+
+	go tokenRenewer.Renew()
+	go runRenewChecker(tokenRenewer)
+
+	return nil
+}
+
 // Vault returns the underlying hashicorp Vault client.
 // Deprecated: use RawClient instead.
 func (client *Client) Vault() *vaultapi.Client {
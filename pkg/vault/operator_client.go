@@ -16,16 +16,23 @@ package vault
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/banzaicloud/bank-vaults/pkg/kv/k8s"
 	hclPrinter "github.com/hashicorp/hcl/hcl/printer"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/helper/consts"
@@ -34,6 +41,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // DefaultConfigFile is the name of the default config file
@@ -64,6 +73,17 @@ type Config struct {
 
 	// should the KV backend be tested first to validate access rights
 	PreFlightChecks bool
+
+	// the last len(PGPKeys) unseal (or recovery) keys are encrypted with these PGP public keys for offline custody
+	// instead of being stored in the keyStore, the rest (at least SecretThreshold) is stored for automatic unsealing
+	PGPKeys []string
+	// if set, the root token is encrypted with this PGP public key too
+	RootTokenPGPKey string
+	// the directory where the PGP encrypted keys are written to, or the standard output if empty
+	PGPKeysOutput string
+
+	// if set, it is called by Configure after applying each section of the external configuration
+	ConfigureSectionHook func(section string, duration time.Duration, err error)
 }
 
 // vault is an implementation of the Vault interface that will perform actions
@@ -82,9 +102,12 @@ var _ Vault = &vault{}
 // a Vault server.
 type Vault interface {
 	Init() error
+	Initialized() (bool, error)
 	Sealed() (bool, error)
 	Active() (bool, error)
-	Unseal() error
+	Unseal() (*UnsealReport, error)
+	SealMigration() (bool, error)
+	MigrateSeal() error
 	Leader() (bool, error)
 	Configure(config *viper.Viper) error
 	StepDownActive(string) error
@@ -97,6 +120,11 @@ func New(k kv.Service, cl *api.Client, config Config) (Vault, error) {
 		return nil, errors.New("the secret threshold can't be bigger than the shares")
 	}
 
+	if config.SecretShares-len(config.PGPKeys) < config.SecretThreshold {
+		return nil, fmt.Errorf("at least %d (the secret threshold) keys have to be stored, only %d of %d are not PGP encrypted",
+			config.SecretThreshold, config.SecretShares-len(config.PGPKeys), config.SecretShares)
+	}
+
 	return &vault{
 		keyStore:    k,
 		cl:          cl,
@@ -105,6 +133,14 @@ func New(k kv.Service, cl *api.Client, config Config) (Vault, error) {
 	}, nil
 }
 
+func (v *vault) Initialized() (bool, error) {
+	initialized, err := v.cl.Sys().InitStatus()
+	if err != nil {
+		return false, fmt.Errorf("error testing if vault is initialized: %s", err.Error())
+	}
+	return initialized, nil
+}
+
 func (v *vault) Sealed() (bool, error) {
 	resp, err := v.cl.Sys().SealStatus()
 	if err != nil {
@@ -136,38 +172,105 @@ func (v *vault) Leader() (bool, error) {
 	return resp.IsSelf, nil
 }
 
-// Unseal will attempt to unseal vault by retrieving keys from the kms service
-// and sending unseal requests to vault. It will return an error if retrieving
-// a key fails, or if the unseal progress is reset to 0 (indicating that a key)
-// was invalid.
-func (v *vault) Unseal() error {
+// SealMigration returns true if Vault has been started with a seal migration pending
+func (v *vault) SealMigration() (bool, error) {
+	resp, err := v.cl.Sys().SealStatus()
+	if err != nil {
+		return false, fmt.Errorf("error checking status: %s", err.Error())
+	}
+	return resp.Sealed && resp.Migration, nil
+}
+
+// MigrateSeal migrates Vault between Shamir and auto-unseal seals, by sending the stored keys
+// with migrate=true: the unseal keys if Vault is migrated to auto-unseal (they become the recovery keys),
+// or the recovery keys if Vault is migrated to Shamir (they become the unseal keys). After the migration
+// the keys are stored again according to their new role.
+// The keys are read from their new ID if the old one doesn't exist, so the instances migrated after the
+// first one, which has already moved the keys, find them as well. This also covers the migration between
+// two auto-unseal seals, where the recovery keys are sent and keep their role.
+func (v *vault) MigrateSeal() error {
 	defer runtime.GC()
-	for i := 0; ; i++ {
-		keyID := v.unsealKeyForID(i)
 
-		logrus.Debugf("retrieving key from kms service...")
-		k, err := v.keyStore.Get(keyID)
+	status, err := v.cl.Sys().SealStatus()
+	if err != nil {
+		return fmt.Errorf("error checking status: %s", err.Error())
+	}
+	if !status.Migration {
+		return fmt.Errorf("vault is not in seal migration mode")
+	}
 
+	// The seal status reports the new seal, which has recovery keys if it is an auto-unseal one
+	keyForID, newKeyForID := v.unsealKeyForID, v.recoveryKeyForID
+	if !status.RecoverySeal {
+		keyForID, newKeyForID = v.recoveryKeyForID, v.unsealKeyForID
+	}
+
+	for i := 0; ; i++ {
+		logrus.Debugf("retrieving key from kms service...")
+		k, err := v.migrationKey(i, keyForID, newKeyForID)
 		if err != nil {
-			return fmt.Errorf("unable to get key '%s': %s", keyID, err.Error())
+			return err
 		}
 
-		logrus.Debugf("sending unseal request to vault...")
-		resp, err := v.cl.Sys().Unseal(string(k))
-
+		logrus.Debugf("sending unseal request with migrate to vault...")
+		resp, err := v.cl.Sys().UnsealWithOptions(&api.UnsealOpts{Key: string(k), Migrate: true})
 		if err != nil {
 			return fmt.Errorf("fail to send unseal request to vault: %s", err.Error())
 		}
 
-		logrus.Debugf("got unseal response: %+v", *resp)
-
 		if !resp.Sealed {
-			return nil
+			break
 		}
 
 		// if progress is 0, we failed to unseal vault.
 		if resp.Progress == 0 {
-			return fmt.Errorf("failed to unseal vault. progress reset to 0")
+			return fmt.Errorf("failed to migrate vault seal. progress reset to 0")
+		}
+	}
+
+	return v.moveKeys(keyForID, newKeyForID)
+}
+
+// migrationKey returns the i-th key of the migration, stored under its old ID, or under its new ID
+// if it has been moved already
+func (v *vault) migrationKey(i int, keyForID, newKeyForID func(int) string) ([]byte, error) {
+	keyID := keyForID(i)
+	k, err := v.keyStore.Get(keyID)
+	if _, notFound := err.(*kv.NotFoundError); notFound {
+		keyID = newKeyForID(i)
+		k, err = v.keyStore.Get(keyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get key '%s': %s", keyID, err.Error())
+	}
+	return k, nil
+}
+
+// moveKeys stores every key found under the old IDs under the new IDs, and removes the old ones
+// if the key store supports it
+func (v *vault) moveKeys(keyForID, newKeyForID func(int) string) error {
+	deleter, canDelete := v.keyStore.(kv.Deleter)
+
+	for i := 0; ; i++ {
+		keyID := keyForID(i)
+		k, err := v.keyStore.Get(keyID)
+		if _, notFound := err.(*kv.NotFoundError); notFound {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to get key '%s': %s", keyID, err.Error())
+		}
+
+		newKeyID := newKeyForID(i)
+		if err := v.keyStore.Set(newKeyID, k); err != nil {
+			return fmt.Errorf("error storing key '%s': %s", newKeyID, err.Error())
+		}
+		logrus.WithField("key", newKeyID).Info("migrated key stored in key store")
+
+		if !canDelete {
+			continue
+		}
+		if err := deleter.Delete(keyID); err != nil {
+			return fmt.Errorf("error deleting key '%s': %s", keyID, err.Error())
 		}
 	}
 }
@@ -204,6 +307,19 @@ func (v *vault) Init() error {
 
 	logrus.Info("initializing vault")
 
+	// parse the PGP keys before init, the keys encrypted with them would be lost otherwise
+	pgpKeys, err := pgpEntities(v.config.PGPKeys)
+	if err != nil {
+		return fmt.Errorf("error parsing PGP keys: %s", err.Error())
+	}
+	var rootTokenPGPKey *openpgp.Entity
+	if v.config.RootTokenPGPKey != "" {
+		rootTokenPGPKey, err = pgpEntity(v.config.RootTokenPGPKey)
+		if err != nil {
+			return fmt.Errorf("error parsing root token PGP key: %s", err.Error())
+		}
+	}
+
 	// test backend first
 	if v.config.PreFlightChecks {
 		tester := kv.Tester{Service: v.keyStore}
@@ -244,26 +360,12 @@ func (v *vault) Init() error {
 		return fmt.Errorf("error initializing vault: %s", err.Error())
 	}
 
-	for i, k := range resp.Keys {
-		keyID := v.unsealKeyForID(i)
-		err := v.keyStoreSet(keyID, []byte(k))
-
-		if err != nil {
-			return fmt.Errorf("error storing unseal key '%s': %s", keyID, err.Error())
-		}
-
-		logrus.WithField("key", keyID).Info("unseal key stored in key store")
+	if err := v.storeKeys(resp.Keys, v.unsealKeyForID, "unseal", pgpKeys); err != nil {
+		return err
 	}
 
-	for i, k := range resp.RecoveryKeys {
-		keyID := v.recoveryKeyForID(i)
-		err := v.keyStoreSet(keyID, []byte(k))
-
-		if err != nil {
-			return fmt.Errorf("error storing recovery key '%s': %s", keyID, err.Error())
-		}
-
-		logrus.WithField("key", keyID).Info("recovery key stored in key store")
+	if err := v.storeKeys(resp.RecoveryKeys, v.recoveryKeyForID, "recovery", pgpKeys); err != nil {
+		return err
 	}
 
 	rootToken := resp.RootToken
@@ -312,19 +414,52 @@ func (v *vault) Init() error {
 		rootToken = v.config.InitRootToken
 	}
 
+	if rootTokenPGPKey != nil {
+		if err := writePGPEncrypted(v.config.PGPKeysOutput, rootTokenPGPKey, v.rootTokenKey(), []byte(rootToken)); err != nil {
+			return fmt.Errorf("error writing PGP encrypted root token: %s", err.Error())
+		}
+	}
+
 	if v.config.StoreRootToken {
 		rootTokenKey := v.rootTokenKey()
 		if err = v.keyStoreSet(rootTokenKey, []byte(resp.RootToken)); err != nil {
 			return fmt.Errorf("error storing root token '%s' in key'%s'", rootToken, rootTokenKey)
 		}
 		logrus.WithField("key", rootTokenKey).Info("root token stored in key store")
-	} else if v.config.InitRootToken == "" {
+	} else if v.config.InitRootToken == "" && rootTokenPGPKey == nil {
 		logrus.WithField("root-token", resp.RootToken).Warnf("won't store root token in key store, this token grants full privileges to vault, so keep this secret")
 	}
 
 	return nil
 }
 
+// storeKeys stores the keys in the keyStore, except the last len(pgpKeys) ones, which are written out
+// encrypted with the PGP keys
+func (v *vault) storeKeys(keys []string, keyForID func(int) string, kind string, pgpKeys []*openpgp.Entity) error {
+	stored := len(keys) - len(pgpKeys)
+
+	for i, k := range keys {
+		keyID := keyForID(i)
+
+		if i >= stored {
+			if err := writePGPEncrypted(v.config.PGPKeysOutput, pgpKeys[i-stored], keyID, []byte(k)); err != nil {
+				return fmt.Errorf("error writing PGP encrypted %s key '%s': %s", kind, keyID, err.Error())
+			}
+			continue
+		}
+
+		err := v.keyStoreSet(keyID, []byte(k))
+
+		if err != nil {
+			return fmt.Errorf("error storing %s key '%s': %s", kind, keyID, err.Error())
+		}
+
+		logrus.WithField("key", keyID).Infof("%s key stored in key store", kind)
+	}
+
+	return nil
+}
+
 func (v *vault) StepDownActive(address string) error {
 	logrus.Debugf("retrieving key from kms service...")
 
@@ -363,54 +498,78 @@ func (v *vault) Configure(config *viper.Viper) error {
 	defer v.cl.SetToken("")
 	defer func() { rootToken = nil }()
 
-	err = v.configureAuthMethods(config)
-	if err != nil {
-		return fmt.Errorf("error configuring auth methods for vault: %s", err.Error())
+	for _, section := range v.configurationSections() {
+		start := time.Now()
+		err = section.configure(config)
+		if v.config.ConfigureSectionHook != nil {
+			v.config.ConfigureSectionHook(section.name, time.Since(start), err)
+		}
+		if err != nil {
+			return &ConfigurationError{Section: section.name, message: section.errorMessage, err: err}
+		}
 	}
 
-	err = v.configurePolicies(config)
-	if err != nil {
-		return fmt.Errorf("error configuring policies for vault: %s", err.Error())
-	}
+	return nil
+}
 
-	err = v.configurePlugins(config)
-	if err != nil {
-		return fmt.Errorf("error configuring plugins for vault: %s", err.Error())
-	}
+// ConfigurationSections are the sections of the external configuration in the order Configure applies them
+var ConfigurationSections = []string{"auth", "policies", "plugins", "secrets", "audit", "startupSecrets", "groups"}
 
-	err = v.configureSecretEngines(config)
-	if err != nil {
-		return fmt.Errorf("error configuring secret engines for vault: %s", err.Error())
-	}
+// ConfigurationError is returned by Configure if applying a section of the external configuration failed,
+// the sections after the failed one are not applied.
+type ConfigurationError struct {
+	// Section is the failed section of the external configuration, see ConfigurationSections
+	Section string
 
-	err = v.configureAuditDevices(config)
-	if err != nil {
-		return fmt.Errorf("error configuring audit devices for vault: %s", err.Error())
-	}
+	message string
+	err     error
+}
 
-	err = v.configureStartupSecrets(config)
-	if err != nil {
-		return fmt.Errorf("error writing startup secrets tor vault: %s", err.Error())
-	}
+func (e *ConfigurationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.message, e.err.Error())
+}
 
-	err = v.configureIdentityGroups(config)
-	if err != nil {
-		return fmt.Errorf("error writing groups configurations for vault: %s", err.Error())
-	}
+type configurationSection struct {
+	name         string
+	errorMessage string
+	configure    func(config *viper.Viper) error
+}
 
-	return err
+func (v *vault) configurationSections() []configurationSection {
+	return []configurationSection{
+		{"auth", "error configuring auth methods for vault", v.configureAuthMethods},
+		{"policies", "error configuring policies for vault", v.configurePolicies},
+		{"plugins", "error configuring plugins for vault", v.configurePlugins},
+		{"secrets", "error configuring secret engines for vault", v.configureSecretEngines},
+		{"audit", "error configuring audit devices for vault", v.configureAuditDevices},
+		{"startupSecrets", "error writing startup secrets tor vault", v.configureStartupSecrets},
+		{"groups", "error writing groups configurations for vault", v.configureIdentityGroups},
+	}
 }
 
 func (*vault) unsealKeyForID(i int) string {
-	return fmt.Sprint("vault-unseal-", i)
+	return UnsealKeyID(i)
 }
 
 func (*vault) recoveryKeyForID(i int) string {
-	return fmt.Sprint("vault-recovery-", i)
+	return RecoveryKeyID(i)
 }
 
 func (*vault) rootTokenKey() string {
-	return fmt.Sprint("vault-root")
+	return RootTokenKeyID
+}
+
+// RootTokenKeyID is the key of the root token in the key store
+const RootTokenKeyID = "vault-root"
+
+// UnsealKeyID returns the key of the i-th unseal key in the key store
+func UnsealKeyID(i int) string {
+	return fmt.Sprint("vault-unseal-", i)
+}
+
+// RecoveryKeyID returns the key of the i-th recovery key in the key store
+func RecoveryKeyID(i int) string {
+	return fmt.Sprint("vault-recovery-", i)
 }
 
 func (*vault) testKey() string {
@@ -434,6 +593,106 @@ func (v *vault) kubernetesAuthConfigDefault() (map[string]interface{}, error) {
 	return config, err
 }
 
+// kubernetesAuthConfigFromKubeconfig derives the Kubernetes auth method config of a remote cluster
+// from a kubeconfig, which is read either from a file or from a Kubernetes Secret. The token of the
+// kubeconfig user is used as token_reviewer_jwt, so it needs the system:auth-delegator role there.
+func kubernetesAuthConfigFromKubeconfig(kubeconfig map[string]interface{}) (map[string]interface{}, error) {
+	var data []byte
+	if _, ok := kubeconfig["file"]; ok {
+		file, err := getOrError(kubeconfig, "file")
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig file: %s", err.Error())
+		}
+	} else if _, ok := kubeconfig["secret"]; ok {
+		secret, err := getOrDefaultStringMap(kubeconfig, "secret")
+		if err != nil {
+			return nil, fmt.Errorf("error finding secret block of kubeconfig: %s", err.Error())
+		}
+		namespace, err := getOrError(secret, "namespace")
+		if err != nil {
+			return nil, err
+		}
+		name, err := getOrError(secret, "name")
+		if err != nil {
+			return nil, err
+		}
+		key, err := getOrDefaultString(secret, "key")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			key = "kubeconfig"
+		}
+		store, err := k8s.New(namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kubeconfig secret store: %s", err.Error())
+		}
+		data, err = store.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig secret: %s", err.Error())
+		}
+	} else {
+		return nil, errors.New("kubeconfig needs either a file or a secret")
+	}
+
+	apiConfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig: %s", err.Error())
+	}
+
+	contextName, err := getOrDefaultString(kubeconfig, "context")
+	if err != nil {
+		return nil, err
+	}
+	if contextName == "" {
+		contextName = apiConfig.CurrentContext
+	}
+
+	kubeContext, ok := apiConfig.Contexts[contextName]
+	if !ok {
+		return nil, fmt.Errorf("context '%s' not found in kubeconfig", contextName)
+	}
+	cluster, ok := apiConfig.Clusters[kubeContext.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster '%s' not found in kubeconfig", kubeContext.Cluster)
+	}
+	authInfo, ok := apiConfig.AuthInfos[kubeContext.AuthInfo]
+	if !ok {
+		return nil, fmt.Errorf("user '%s' not found in kubeconfig", kubeContext.AuthInfo)
+	}
+
+	caCert := cluster.CertificateAuthorityData
+	if len(caCert) == 0 && cluster.CertificateAuthority != "" {
+		caCert, err = ioutil.ReadFile(cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate authority of cluster: %s", err.Error())
+		}
+	}
+
+	token := authInfo.Token
+	if token == "" && authInfo.TokenFile != "" {
+		tokenFile, err := ioutil.ReadFile(authInfo.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file of user: %s", err.Error())
+		}
+		token = strings.TrimSpace(string(tokenFile))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("user '%s' in kubeconfig has no token to be used as token_reviewer_jwt", kubeContext.AuthInfo)
+	}
+
+	config := map[string]interface{}{
+		"kubernetes_host":    cluster.Server,
+		"kubernetes_ca_cert": string(caCert),
+		"token_reviewer_jwt": token,
+	}
+	return config, nil
+}
+
 func (v *vault) configureAuthMethods(config *viper.Viper) error {
 	authMethods := []map[string]interface{}{}
 	err := config.UnmarshalKey("auth", &authMethods)
@@ -501,8 +760,23 @@ func (v *vault) configureAuthMethods(config *viper.Viper) error {
 			if err != nil {
 				return fmt.Errorf("error finding config block for kubernetes: %s", err.Error())
 			}
-			// If kubernetes_host is defined we are probably out of cluster, so don't read the default config
-			if _, ok := config["kubernetes_host"]; !ok {
+			if kubeconfigRaw, ok := authMethod["kubeconfig"]; ok {
+				// The auth method is for a remote cluster, derive the config from its kubeconfig
+				kubeconfig, err := cast.ToStringMapE(kubeconfigRaw)
+				if err != nil {
+					return fmt.Errorf("error finding kubeconfig block for kubernetes: %s", err.Error())
+				}
+				kubeconfigConfig, err := kubernetesAuthConfigFromKubeconfig(kubeconfig)
+				if err != nil {
+					return fmt.Errorf("error getting kubernetes auth config from kubeconfig for %s: %s", path, err.Error())
+				}
+				// merge the config blocks
+				for k, v := range config {
+					kubeconfigConfig[k] = v
+				}
+				config = kubeconfigConfig
+			} else if _, ok := config["kubernetes_host"]; !ok {
+				// If kubernetes_host is defined we are probably out of cluster, so don't read the default config
 				defaultConfig, err := v.kubernetesAuthConfigDefault()
 				if err != nil {
 					return fmt.Errorf("error getting default kubernetes auth config for vault: %s", err.Error())
@@ -591,10 +865,19 @@ func (v *vault) configureAuthMethods(config *viper.Viper) error {
 			if err != nil {
 				return fmt.Errorf("error finding role block for approle: %s", err.Error())
 			}
-			err = v.configureGenericAuthRoles(authMethodType, path, "role", roles)
+			err = v.configureApproleRoles(path, roles)
 			if err != nil {
 				return fmt.Errorf("error configuring approle auth for vault: %s", err.Error())
 			}
+		case "userpass":
+			users, err := getOrDefaultStringMap(authMethod, "users")
+			if err != nil {
+				return fmt.Errorf("error finding users block for userpass: %s", err.Error())
+			}
+			err = v.configureUserpassUsers(path, users)
+			if err != nil {
+				return fmt.Errorf("error configuring userpass users for vault: %s", err.Error())
+			}
 		case "jwt", "oidc":
 			config, err := cast.ToStringMapE(authMethod["config"])
 			if err != nil {
@@ -797,6 +1080,215 @@ func (v *vault) configureJwtRoles(path string, roles []interface{}) error {
 	return nil
 }
 
+// configureApproleRoles configures AppRole roles like configureGenericAuthRoles, but it also handles
+// the bank-vaults specific exportCredentials block, which delivers the role_id and a pinned secret_id
+// of the role into a Kubernetes Secret and/or into the bank-vaults key store.
+// https://www.vaultproject.io/api/auth/approle/index.html
+func (v *vault) configureApproleRoles(path string, roles []interface{}) error {
+	for _, roleInterface := range roles {
+		role, err := cast.ToStringMapE(roleInterface)
+		if err != nil {
+			return fmt.Errorf("error converting roles for approle: %s", err.Error())
+		}
+
+		roleName, err := cast.ToStringE(role["name"])
+		if err != nil {
+			return fmt.Errorf("error converting name for approle role: %s", err.Error())
+		}
+
+		exportCredentials, err := getOrDefaultStringMap(role, "exportCredentials")
+		if err != nil {
+			return fmt.Errorf("error getting exportCredentials for approle role %s: %s", roleName, err.Error())
+		}
+		// Delete the exportCredentials key from the map, so we don't push it to vault
+		delete(role, "exportCredentials")
+
+		_, err = v.cl.Logical().Write(fmt.Sprintf("auth/%s/role/%s", path, roleName), role)
+		if err != nil {
+			return fmt.Errorf("error putting %s approle role into vault: %s", roleName, err.Error())
+		}
+
+		if len(exportCredentials) > 0 {
+			err = v.exportApproleCredentials(path, roleName, exportCredentials)
+			if err != nil {
+				return fmt.Errorf("error exporting credentials of %s approle role: %s", roleName, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// approleCredentialsTarget is a place where the role_id and secret_id of an AppRole role are delivered to
+type approleCredentialsTarget struct {
+	store       kv.Service
+	roleIDKey   string
+	secretIDKey string
+}
+
+func (v *vault) approleCredentialsTargets(path, roleName string, exportCredentials map[string]interface{}) ([]approleCredentialsTarget, error) {
+	var targets []approleCredentialsTarget
+
+	kubernetesSecret, err := getOrDefaultStringMap(exportCredentials, "kubernetesSecret")
+	if err != nil {
+		return nil, fmt.Errorf("error getting kubernetesSecret: %s", err.Error())
+	}
+	if len(kubernetesSecret) > 0 {
+		namespace, err := getOrError(kubernetesSecret, "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("error getting namespace of kubernetesSecret: %s", err.Error())
+		}
+		name, err := getOrError(kubernetesSecret, "name")
+		if err != nil {
+			return nil, fmt.Errorf("error getting name of kubernetesSecret: %s", err.Error())
+		}
+		store, err := k8s.New(namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kubernetesSecret store: %s", err.Error())
+		}
+		targets = append(targets, approleCredentialsTarget{store: store, roleIDKey: "role_id", secretIDKey: "secret_id"})
+	}
+
+	if _, ok := exportCredentials["kvKey"]; ok {
+		kvKey, err := getOrError(exportCredentials, "kvKey")
+		if err != nil {
+			return nil, fmt.Errorf("error getting kvKey: %s", err.Error())
+		}
+		if kvKey == "" {
+			kvKey = fmt.Sprintf("vault-approle-%s-%s", keyStorePath(path), roleName)
+		}
+		targets = append(targets, approleCredentialsTarget{store: v.keyStore, roleIDKey: kvKey + "-role-id", secretIDKey: kvKey + "-secret-id"})
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("exportCredentials needs at least one of kubernetesSecret or kvKey")
+	}
+
+	return targets, nil
+}
+
+// exportApproleCredentials writes the role_id and a secret_id of an AppRole role to the configured targets.
+// If any of the targets already holds a secret_id which is still valid in Vault it is reused (pinned),
+// otherwise a new secret_id is generated, so re-applying the configuration doesn't rotate it.
+func (v *vault) exportApproleCredentials(path, roleName string, exportCredentials map[string]interface{}) error {
+	targets, err := v.approleCredentialsTargets(path, roleName, exportCredentials)
+	if err != nil {
+		return err
+	}
+
+	roleIDSecret, err := v.cl.Logical().Read(fmt.Sprintf("auth/%s/role/%s/role-id", path, roleName))
+	if err != nil {
+		return fmt.Errorf("error reading role_id: %s", err.Error())
+	}
+	if roleIDSecret == nil {
+		return fmt.Errorf("role_id of %s approle role not found", roleName)
+	}
+	roleID := cast.ToString(roleIDSecret.Data["role_id"])
+
+	var secretID string
+	for _, target := range targets {
+		existingSecretID, err := target.store.Get(target.secretIDKey)
+		if _, ok := err.(*kv.NotFoundError); ok {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading existing secret_id: %s", err.Error())
+		}
+
+		lookup, err := v.cl.Logical().Write(
+			fmt.Sprintf("auth/%s/role/%s/secret-id/lookup", path, roleName),
+			map[string]interface{}{"secret_id": string(existingSecretID)},
+		)
+		if err == nil && lookup != nil {
+			secretID = string(existingSecretID)
+			break
+		}
+	}
+
+	if secretID == "" {
+		logrus.Infof("generating new secret_id for %s approle role", roleName)
+		secretIDSecret, err := v.cl.Logical().Write(fmt.Sprintf("auth/%s/role/%s/secret-id", path, roleName), nil)
+		if err != nil {
+			return fmt.Errorf("error generating secret_id: %s", err.Error())
+		}
+		secretID = cast.ToString(secretIDSecret.Data["secret_id"])
+	}
+
+	for _, target := range targets {
+		if err := target.store.Set(target.roleIDKey, []byte(roleID)); err != nil {
+			return fmt.Errorf("error storing role_id: %s", err.Error())
+		}
+		if err := target.store.Set(target.secretIDKey, []byte(secretID)); err != nil {
+			return fmt.Errorf("error storing secret_id: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// configureUserpassUsers creates userpass users, their passwords are taken from the password field,
+// or from the bank-vaults key store, where a random one is generated and stored if it doesn't exist yet.
+// https://www.vaultproject.io/api/auth/userpass/index.html
+func (v *vault) configureUserpassUsers(path string, users map[string]interface{}) error {
+	for username, userRaw := range users {
+		user, err := cast.ToStringMapE(userRaw)
+		if err != nil {
+			return fmt.Errorf("error converting user %s for userpass: %s", username, err.Error())
+		}
+
+		passwordKey, err := getOrDefaultString(user, "passwordKey")
+		if err != nil {
+			return fmt.Errorf("error getting passwordKey for user %s: %s", username, err.Error())
+		}
+		delete(user, "passwordKey")
+
+		if _, ok := user["password"]; !ok {
+			if passwordKey == "" {
+				passwordKey = fmt.Sprintf("vault-userpass-%s-%s", keyStorePath(path), username)
+			}
+			password, err := v.keyStoreGetOrGenerate(passwordKey)
+			if err != nil {
+				return fmt.Errorf("error getting password for user %s: %s", username, err.Error())
+			}
+			user["password"] = password
+		}
+
+		_, err = v.cl.Logical().Write(fmt.Sprintf("auth/%s/users/%s", path, username), user)
+		if err != nil {
+			return fmt.Errorf("error putting %s userpass user into vault: %s", username, err.Error())
+		}
+	}
+	return nil
+}
+
+// keyStoreGetOrGenerate returns the value for key from the key store,
+// if it doesn't exist a random value is generated and stored under key
+func (v *vault) keyStoreGetOrGenerate(key string) (string, error) {
+	value, err := v.keyStore.Get(key)
+	if err == nil {
+		return string(value), nil
+	} else if _, ok := err.(*kv.NotFoundError); !ok {
+		return "", err
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("error generating random value: %s", err.Error())
+	}
+
+	generated := base64.RawURLEncoding.EncodeToString(random)
+	if err := v.keyStore.Set(key, []byte(generated)); err != nil {
+		return "", err
+	}
+
+	logrus.WithField("key", key).Info("generated value stored in key store")
+
+	return generated, nil
+}
+
+// keyStorePath converts a Vault mount path into a form which is usable in key store keys
+func keyStorePath(path string) string {
+	return strings.Replace(strings.Trim(path, "/"), "/", "-", -1)
+}
+
 func (v *vault) configureGenericUserAndGroupMappings(method, path string, mappingType string, mappings map[string]interface{}) error {
 	for userOrGroup, policy := range mappings {
 		mapping, err := cast.ToStringMapE(policy)
@@ -818,6 +1310,11 @@ func (v *vault) configurePlugins(config *viper.Viper) error {
 		return fmt.Errorf("error unmarshalling vault plugins config: %s", err.Error())
 	}
 
+	// If the plugin directory of Vault is available for bank-vaults as well (for example on a shared volume)
+	// the plugins found there are registered, and the checksums of the plugins which don't have an explicit
+	// sha256 set are computed from the binaries
+	pluginDirectory := config.GetString("pluginDirectory")
+
 	listPlugins, err := v.cl.Sys().ListPlugins(&api.ListPluginsInput{})
 	if err != nil {
 		return fmt.Errorf("failed to retrieve list of plugins: %s", err.Error())
@@ -825,6 +1322,9 @@ func (v *vault) configurePlugins(config *viper.Viper) error {
 
 	logrus.Debugf("already registered plugins: %#v", listPlugins.Names)
 
+	registrations := []api.RegisterPluginInput{}
+	listedBinaries := map[string]bool{}
+
 	for _, plugin := range plugins {
 		command, err := getOrError(plugin, "command")
 		if err != nil {
@@ -834,10 +1334,19 @@ func (v *vault) configurePlugins(config *viper.Viper) error {
 		if err != nil {
 			return fmt.Errorf("error getting plugin_name for plugin: %s", err.Error())
 		}
-		sha256, err := getOrError(plugin, "sha256")
+		sha256, err := getOrDefaultString(plugin, "sha256")
 		if err != nil {
 			return fmt.Errorf("error getting sha256 for plugin: %s", err.Error())
 		}
+		if sha256 == "" {
+			if pluginDirectory == "" {
+				return fmt.Errorf("error getting sha256 for plugin: value for sha256 is not set and pluginDirectory is not configured")
+			}
+			sha256, err = pluginBinarySHA256(pluginDirectory, command)
+			if err != nil {
+				return fmt.Errorf("error computing sha256 for plugin %s: %s", pluginName, err.Error())
+			}
+		}
 		typeRaw, err := getOrError(plugin, "type")
 		if err != nil {
 			return fmt.Errorf("error getting type for plugin: %s", err.Error())
@@ -847,25 +1356,141 @@ func (v *vault) configurePlugins(config *viper.Viper) error {
 			return fmt.Errorf("error parsing type for plugin: %s", err.Error())
 		}
 
-		input := api.RegisterPluginInput{
+		if fields := strings.Fields(command); len(fields) > 0 {
+			listedBinaries[filepath.Base(fields[0])] = true
+		}
+
+		registrations = append(registrations, api.RegisterPluginInput{
 			Name:    pluginName,
 			Command: command,
 			SHA256:  sha256,
 			Type:    pluginType,
+		})
+	}
+
+	if pluginDirectory != "" {
+		scanned, err := scanPluginDirectory(pluginDirectory, listedBinaries)
+		if err != nil {
+			return fmt.Errorf("error scanning plugin directory %s: %s", pluginDirectory, err.Error())
+		}
+		registrations = append(registrations, scanned...)
+	}
+
+	for _, input := range registrations {
+		registeredSHA256, err := v.registeredPluginSHA256(input.Type, input.Name)
+		if err != nil {
+			return fmt.Errorf("error getting registered plugin %s: %s", input.Name, err.Error())
 		}
+
+		// The plugin is registered every time, so a changed command is applied even if the binary is the same
 		logrus.Infof("registering plugin with input: %#v", input)
 
 		err = v.cl.Sys().RegisterPlugin(&input)
 		if err != nil {
-			return fmt.Errorf("error registering plugin %s in vault", err.Error())
+			return fmt.Errorf("error registering plugin %s in vault: %s", input.Name, err.Error())
 		}
 
-		logrus.Infoln("registered plugin", plugin)
+		logrus.Infoln("registered plugin", input.Name)
+
+		// The already running plugin processes have to be reloaded to pick up the new binary
+		if registeredSHA256 != "" && registeredSHA256 != input.SHA256 {
+			logrus.Infof("plugin %s has changed, reloading the mounts using it", input.Name)
+			_, err = v.cl.Logical().Write("sys/plugins/reload/backend", map[string]interface{}{"plugin": input.Name})
+			if err != nil {
+				return fmt.Errorf("error reloading plugin %s in vault: %s", input.Name, err.Error())
+			}
+		}
 	}
 
 	return nil
 }
 
+// scanPluginDirectory returns the registrations of the executables in the plugin directory which are not listed
+// in the plugins configuration. The binary name is the plugin name and the command, and the type comes from the
+// naming convention of the plugins: vault-plugin-auth-*, vault-plugin-database-* or vault-plugin-secrets-*.
+func scanPluginDirectory(pluginDirectory string, listedBinaries map[string]bool) ([]api.RegisterPluginInput, error) {
+	files, err := ioutil.ReadDir(pluginDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := []api.RegisterPluginInput{}
+
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() || file.Mode()&0111 == 0 || listedBinaries[name] {
+			continue
+		}
+
+		pluginType, ok := pluginTypeFromName(name)
+		if !ok {
+			logrus.Warnf("skipping plugin %s, its type is unknown, add it to the plugins with its type to register it", name)
+			continue
+		}
+
+		sha256, err := pluginBinarySHA256(pluginDirectory, name)
+		if err != nil {
+			return nil, fmt.Errorf("error computing sha256 for plugin %s: %s", name, err.Error())
+		}
+
+		registrations = append(registrations, api.RegisterPluginInput{
+			Name:    name,
+			Command: name,
+			SHA256:  sha256,
+			Type:    pluginType,
+		})
+	}
+
+	return registrations, nil
+}
+
+func pluginTypeFromName(name string) (consts.PluginType, bool) {
+	switch {
+	case strings.HasPrefix(name, "vault-plugin-auth-"):
+		return consts.PluginTypeCredential, true
+	case strings.HasPrefix(name, "vault-plugin-database-"):
+		return consts.PluginTypeDatabase, true
+	case strings.HasPrefix(name, "vault-plugin-secrets-"):
+		return consts.PluginTypeSecrets, true
+	default:
+		return consts.PluginTypeUnknown, false
+	}
+}
+
+// registeredPluginSHA256 returns the sha256 of the plugin registered in the catalog of Vault,
+// or an empty string if it is not registered yet
+func (v *vault) registeredPluginSHA256(pluginType consts.PluginType, pluginName string) (string, error) {
+	plugin, err := v.cl.Logical().Read(fmt.Sprintf("sys/plugins/catalog/%s/%s", pluginType.String(), pluginName))
+	if err != nil {
+		return "", err
+	}
+	if plugin == nil {
+		return "", nil
+	}
+	return cast.ToString(plugin.Data["sha256"]), nil
+}
+
+// pluginBinarySHA256 computes the checksum of the binary of a plugin command in the plugin directory
+func pluginBinarySHA256(pluginDirectory, command string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", errors.New("plugin command is empty")
+	}
+
+	binary, err := os.Open(filepath.Join(pluginDirectory, filepath.Base(fields[0])))
+	if err != nil {
+		return "", err
+	}
+	defer binary.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, binary); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func (v *vault) mountExists(path string) (bool, error) {
 	mounts, err := v.cl.Sys().ListMounts()
 	if err != nil {
@@ -0,0 +1,116 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// pgpEntity parses a PGP public key, which may be ASCII armored, base64 encoded (like the keys of
+// `vault operator init -pgp-keys`) or binary
+func pgpEntity(publicKey string) (*openpgp.Entity, error) {
+	var reader io.Reader
+	if strings.HasPrefix(strings.TrimSpace(publicKey), "-----BEGIN") {
+		block, err := armor.Decode(strings.NewReader(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding armored PGP key: %s", err.Error())
+		}
+		reader = block.Body
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey)); err == nil {
+		reader = bytes.NewReader(decoded)
+	} else {
+		reader = strings.NewReader(publicKey)
+	}
+
+	entity, err := openpgp.ReadEntity(packet.NewReader(reader))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PGP key: %s", err.Error())
+	}
+
+	return entity, nil
+}
+
+func pgpEntities(publicKeys []string) ([]*openpgp.Entity, error) {
+	entities := make([]*openpgp.Entity, 0, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		entity, err := pgpEntity(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("PGP key #%d: %s", i, err.Error())
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+func pgpFingerprint(entity *openpgp.Entity) string {
+	return hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])
+}
+
+// pgpEncrypt encrypts the value for the PGP key, the result is base64 encoded like the keys returned by Vault
+// if it is initialized with PGP keys, so it can be decrypted with `base64 -d | gpg -dq`
+func pgpEncrypt(entity *openpgp.Entity, value []byte) (string, error) {
+	var encrypted bytes.Buffer
+
+	w, err := openpgp.Encrypt(&encrypted, []*openpgp.Entity{entity}, nil, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting for PGP key %s: %s", pgpFingerprint(entity), err.Error())
+	}
+	if _, err := w.Write(value); err != nil {
+		return "", fmt.Errorf("error encrypting for PGP key %s: %s", pgpFingerprint(entity), err.Error())
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("error encrypting for PGP key %s: %s", pgpFingerprint(entity), err.Error())
+	}
+
+	return base64.StdEncoding.EncodeToString(encrypted.Bytes()), nil
+}
+
+// writePGPEncrypted encrypts the value for the PGP key, and writes it to <output>/<key>.b64, or to the
+// standard output if output is empty
+func writePGPEncrypted(output string, entity *openpgp.Entity, key string, value []byte) error {
+	encrypted, err := pgpEncrypt(entity, value)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := pgpFingerprint(entity)
+
+	if output == "" {
+		fmt.Fprintf(os.Stdout, "%s (PGP key %s): %s\n", key, fingerprint, encrypted)
+		return nil
+	}
+
+	file := filepath.Join(output, key+".b64")
+	if err := ioutil.WriteFile(file, []byte(encrypted+"\n"), 0600); err != nil {
+		return fmt.Errorf("error writing PGP encrypted '%s': %s", key, err.Error())
+	}
+
+	logrus.WithFields(logrus.Fields{"key": key, "pgp-key": fingerprint, "file": file}).Info("PGP encrypted key written")
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// RaftSnapshot streams a snapshot of Vault's Raft storage into w
+func RaftSnapshot(cl *api.Client, w io.Writer) error {
+	req := cl.NewRequest("GET", "/v1/sys/storage/raft/snapshot")
+
+	resp, err := cl.RawRequest(req)
+	if err != nil {
+		return fmt.Errorf("error taking raft snapshot: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("error reading raft snapshot: %s", err.Error())
+	}
+
+	return nil
+}
+
+// RaftSnapshotRestore restores Vault's Raft storage from a snapshot, force is needed if the snapshot was taken
+// from a different cluster (with different unseal keys)
+func RaftSnapshotRestore(cl *api.Client, snapshot io.Reader, force bool) error {
+	path := "/v1/sys/storage/raft/snapshot"
+	if force {
+		path = "/v1/sys/storage/raft/snapshot-force"
+	}
+
+	req := cl.NewRequest("POST", path)
+	req.Body = snapshot
+
+	resp, err := cl.RawRequest(req)
+	if err != nil {
+		return fmt.Errorf("error restoring raft snapshot: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ParseReference splits a vault:path#key#version reference, the version is -1 (the latest) if not given
+func ParseReference(reference string) (path, key, version string) {
+	split := strings.SplitN(strings.TrimPrefix(reference, "vault:"), "#", 3)
+	path = split[0]
+
+	if len(split) > 1 {
+		key = split[1]
+	}
+
+	version = "-1"
+	if len(split) == 3 {
+		version = split[2]
+	}
+
+	return path, key, version
+}
+
+// SplitParams splits the query-style parameters from the path, e.g. pki/issue/web?common_name=app.svc&ttl=24h
+func SplitParams(path string) (string, url.Values, error) {
+	split := strings.SplitN(path, "?", 2)
+	if len(split) == 1 {
+		return path, url.Values{}, nil
+	}
+
+	params := url.Values{}
+	for _, param := range strings.Split(split[1], "&") {
+		if param == "" {
+			continue
+		}
+
+		// the parameters are unescaped like paths, and not like query strings, so the + of base64 values is kept
+		keyValue := strings.SplitN(param, "=", 2)
+		key, err := url.PathUnescape(keyValue[0])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid parameters of path %s: %s", split[0], err.Error())
+		}
+
+		value := ""
+		if len(keyValue) == 2 {
+			value, err = url.PathUnescape(keyValue[1])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid parameters of path %s: %s", split[0], err.Error())
+			}
+		}
+
+		params.Add(key, value)
+	}
+
+	return split[0], params, nil
+}
@@ -0,0 +1,86 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSplitParams(t *testing.T) {
+	tests := []struct {
+		path     string
+		plain    string
+		params   url.Values
+		hasError bool
+	}{
+		{path: "secret/data/app", plain: "secret/data/app", params: url.Values{}},
+		{
+			path:   "pki/issue/web?common_name=app.svc&ttl=24h",
+			plain:  "pki/issue/web",
+			params: url.Values{"common_name": {"app.svc"}, "ttl": {"24h"}},
+		},
+		{
+			path:   "transit/decrypt/app?ciphertext=vault:v1:8SDd+3WH/OQ==",
+			plain:  "transit/decrypt/app",
+			params: url.Values{"ciphertext": {"vault:v1:8SDd+3WH/OQ=="}},
+		},
+		{
+			path:   "pki/issue/web?alt_names=a.svc&alt_names=b.svc&common_name=a%26b%20c&exclude_cn_from_sans",
+			plain:  "pki/issue/web",
+			params: url.Values{"alt_names": {"a.svc", "b.svc"}, "common_name": {"a&b c"}, "exclude_cn_from_sans": {""}},
+		},
+		{path: "pki/issue/web?common_name=%zz", hasError: true},
+	}
+
+	for _, test := range tests {
+		plain, params, err := SplitParams(test.path)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("expected error for %s", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.path, err)
+			continue
+		}
+		if plain != test.plain || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("expected %s %v for %s, got %s %v", test.plain, test.params, test.path, plain, params)
+		}
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		path      string
+		key       string
+		version   string
+	}{
+		{reference: "vault:secret/data/db", path: "secret/data/db", version: "-1"},
+		{reference: "vault:secret/data/db#password", path: "secret/data/db", key: "password", version: "-1"},
+		{reference: "vault:secret/data/db#password#2", path: "secret/data/db", key: "password", version: "2"},
+		{reference: "vault:pki/issue/web?common_name=app.svc#certificate", path: "pki/issue/web?common_name=app.svc", key: "certificate", version: "-1"},
+	}
+
+	for _, test := range tests {
+		path, key, version := ParseReference(test.reference)
+		if path != test.path || key != test.key || version != test.version {
+			t.Errorf("expected %s %s %s for %s, got %s %s %s", test.path, test.key, test.version, test.reference, path, key, version)
+		}
+	}
+}
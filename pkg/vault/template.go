@@ -0,0 +1,101 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+)
+
+// TemplatePrefix is the prefix of the values which are Go templates rendered with secrets from Vault
+const TemplatePrefix = "vault:template:"
+
+// templateBindings matches the name=path[#version] bindings before the first ; of a template value
+var templateBindings = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=[^;,{}]+(,[A-Za-z_][A-Za-z0-9_]*=[^;,{}]+)*;`)
+
+// SecretReader reads the data of the version of a path, for KV version 2 paths it is the data of the version,
+// it returns nil if the path is not found
+type SecretReader func(path, version string) (map[string]interface{}, error)
+
+// templateFuncs returns the sprig functions except the ones reading the environment (env and expandenv),
+// since the environment of vault-env and of the webhook holds credentials the templates must not expose
+func templateFuncs() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+	return funcs
+}
+
+// IsTemplate returns true if the value is a vault:template: value
+func IsTemplate(value string) bool {
+	return strings.HasPrefix(value, TemplatePrefix)
+}
+
+// RenderTemplate renders a value in the vault:template:name=path[#version],...;template form, e.g.:
+//
+//	vault:template:db=secret/data/db;postgres://{{ .db.username }}:{{ .db.password }}@host/db
+//
+// The paths are read with read, and their data is available under their names in the template, which can
+// use the sprig functions too, except env and expandenv. The bindings are optional, a value without them is
+// rendered with no data.
+func RenderTemplate(value string, read SecretReader) (string, error) {
+	text := strings.TrimPrefix(value, TemplatePrefix)
+	data := map[string]interface{}{}
+
+	if bindings := templateBindings.FindString(text); bindings != "" {
+		text = strings.TrimPrefix(text, bindings)
+
+		for _, binding := range strings.Split(strings.TrimSuffix(bindings, ";"), ",") {
+			split := strings.SplitN(binding, "=", 2)
+			name, reference := split[0], strings.TrimSpace(split[1])
+
+			if _, ok := data[name]; ok {
+				return "", fmt.Errorf("duplicate template binding: %s", name)
+			}
+
+			path, version := reference, "-1"
+			if i := strings.Index(reference, "#"); i >= 0 {
+				path, version = reference[:i], reference[i+1:]
+			}
+
+			secret, err := read(path, version)
+			if err != nil {
+				return "", fmt.Errorf("error reading secret %s for template: %s", path, err.Error())
+			}
+			if secret == nil {
+				return "", fmt.Errorf("path not found for template: %s", path)
+			}
+
+			data[name] = secret
+		}
+	}
+
+	tmpl, err := template.New("value").Funcs(templateFuncs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template: %s", err.Error())
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("error executing template: %s", err.Error())
+	}
+
+	return buffer.String(), nil
+}
@@ -0,0 +1,386 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// UnsealReport describes the outcome of an unseal attempt
+type UnsealReport struct {
+	// Sealed is false if Vault has been unsealed (or was not sealed at all)
+	Sealed bool
+	// Threshold and Shares are the number of keys needed and the number of keys existing, as reported by Vault
+	Threshold int
+	Shares    int
+	// StaleProgress is the unseal progress left behind by someone else, which has been reset
+	StaleProgress int
+	// Attempts is the number of times the keys had to be combined
+	Attempts int
+	// Used are the keys which unsealed Vault
+	Used []string
+	// Missing are the keys not found in the key store, e.g. the PGP encrypted ones
+	Missing []string
+	// Invalid are the keys rejected by Vault, or which failed to be combined with valid keys
+	Invalid []string
+	// Duplicate are the keys with the same value as another key, which don't advance the unseal progress
+	Duplicate []string
+	// Interrupted is the number of times the unseal process has been reset by someone else during the attempts
+	Interrupted int
+}
+
+func (r *UnsealReport) String() string {
+	return fmt.Sprintf("sealed: %t, threshold: %d/%d, attempts: %d, used: %v, missing: %v, invalid: %v, duplicate: %v, stale progress: %d, interrupted: %d",
+		r.Sealed, r.Threshold, r.Shares, r.Attempts, r.Used, r.Missing, r.Invalid, r.Duplicate, r.StaleProgress, r.Interrupted)
+}
+
+// unsealResult is the outcome of submitting a set of keys to Vault
+type unsealResult int
+
+const (
+	unsealSucceeded unsealResult = iota
+	// the submitted keys could not be combined, at least one of them is invalid
+	unsealCombineFailed
+	// someone else reset the unseal process, or started a new one
+	unsealInterrupted
+	// there were not enough usable keys to reach the threshold
+	unsealExhausted
+)
+
+// unsealSys is the part of the Vault sys API used for unsealing, implemented by *api.Sys
+type unsealSys interface {
+	SealStatus() (*api.SealStatusResponse, error)
+	Unseal(shard string) (*api.SealStatusResponse, error)
+	ResetUnsealProcess() (*api.SealStatusResponse, error)
+}
+
+// Unseal will attempt to unseal vault by retrieving keys from the kms service and sending unseal requests to vault.
+// The threshold and the number of keys are read from the seal status, any progress left behind by someone else is
+// reset, and every threshold sized combination of the stored keys is submitted, in an order randomized on every
+// run, until one unseals Vault. Missing
+// keys are skipped, keys rejected by Vault or failing to be combined with valid keys are reported as invalid, so a
+// leftover key of a previous initialization doesn't prevent unsealing with the rest.
+func (v *vault) Unseal() (*UnsealReport, error) {
+	return v.unseal(v.cl.Sys(), rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+// unseal unseals Vault through sys, random shuffles the order in which the keys are submitted
+func (v *vault) unseal(sys unsealSys, random *rand.Rand) (*UnsealReport, error) {
+	defer runtime.GC()
+
+	status, err := sys.SealStatus()
+	if err != nil {
+		return nil, fmt.Errorf("error checking status: %s", err.Error())
+	}
+
+	report := &UnsealReport{
+		Sealed:    status.Sealed,
+		Threshold: status.T,
+		Shares:    status.N,
+	}
+
+	if !status.Sealed {
+		return report, nil
+	}
+
+	if report.Shares == 0 {
+		report.Shares = v.config.SecretShares
+	}
+	if report.Threshold == 0 {
+		report.Threshold = v.config.SecretThreshold
+	}
+
+	if status.Progress > 0 {
+		logrus.Warnf("resetting stale unseal progress %d/%d", status.Progress, status.T)
+		if err := resetUnsealProcess(sys); err != nil {
+			return report, err
+		}
+		report.StaleProgress = status.Progress
+	}
+
+	logrus.Debugf("retrieving keys from kms service...")
+	keys, err := v.storedUnsealKeys(report)
+	if err != nil {
+		return report, err
+	}
+
+	// the combinations are enumerated in the order of the shuffled keys, so the keys are submitted in a random
+	// order, while every combination is still tried at most once
+	order := make([]string, 0, len(keys))
+	for keyID := range keys {
+		order = append(order, keyID)
+	}
+	sort.Strings(order)
+	random.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	// Every attempt either unseals Vault, or rules out a combination of keys (and maybe some keys as invalid or
+	// duplicate), or was interrupted by someone else. There is a finite number of combinations, and the number
+	// of interruptions tolerated is bounded, so the number of attempts is bounded too.
+	tried := map[string]bool{}
+	failed := [][]string{}
+	for attempt := 1; report.Interrupted <= report.Shares; attempt++ {
+		candidates := untriedUnsealKeys(usableUnsealKeys(order, report), report.Threshold, tried)
+		if candidates == nil {
+			break
+		}
+
+		report.Attempts = attempt
+
+		submitted, result, err := submitUnsealKeys(sys, keys, candidates, report)
+		if err != nil {
+			return report, err
+		}
+
+		switch result {
+		case unsealSucceeded:
+			report.Sealed = false
+			report.Used = submitted
+			report.Invalid = append(report.Invalid, invalidUnsealKeys(failed, submitted)...)
+			sort.Strings(report.Invalid)
+			return report, nil
+		case unsealCombineFailed:
+			logrus.Warnf("unseal keys %v could not be combined, trying other ones", submitted)
+			tried[combinationID(candidates)] = true
+			failed = append(failed, submitted)
+		case unsealInterrupted:
+			logrus.Warn("the unseal process has been reset by someone else, starting over")
+			report.Interrupted++
+			if err := resetUnsealProcess(sys); err != nil {
+				return report, err
+			}
+		case unsealExhausted:
+			// Some of the keys turned out to be invalid or duplicate, the progress of the rest is dropped
+			tried[combinationID(candidates)] = true
+			if len(submitted) > 0 {
+				if err := resetUnsealProcess(sys); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		report.Invalid = append(report.Invalid, invalidUnsealKeys(failed, nil)...)
+		sort.Strings(report.Invalid)
+	}
+
+	return report, fmt.Errorf("vault is still sealed, %d of the %d keys needed could be used (%s)",
+		len(usableUnsealKeys(order, report)), report.Threshold, report)
+}
+
+// untriedUnsealKeys returns the first combination of threshold keys (in the order of the candidates) which has
+// not been tried yet, or nil if there is none
+func untriedUnsealKeys(candidates []string, threshold int, tried map[string]bool) []string {
+	if threshold <= 0 || len(candidates) < threshold {
+		return nil
+	}
+
+	// indexes is the current combination, advanced like an odometer
+	indexes := make([]int, threshold)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	for {
+		combination := make([]string, threshold)
+		for i, index := range indexes {
+			combination[i] = candidates[index]
+		}
+		if !tried[combinationID(combination)] {
+			return combination
+		}
+
+		i := threshold - 1
+		for i >= 0 && indexes[i] == len(candidates)-threshold+i {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		indexes[i]++
+		for j := i + 1; j < threshold; j++ {
+			indexes[j] = indexes[j-1] + 1
+		}
+	}
+}
+
+func combinationID(keyIDs []string) string {
+	sorted := append([]string{}, keyIDs...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func resetUnsealProcess(sys unsealSys) error {
+	if _, err := sys.ResetUnsealProcess(); err != nil {
+		return fmt.Errorf("error resetting unseal progress: %s", err.Error())
+	}
+	return nil
+}
+
+// storedUnsealKeys returns the unseal keys found in the key store, up to the number of keys existing,
+// the missing and duplicate ones are added to the report
+func (v *vault) storedUnsealKeys(report *UnsealReport) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for i := 0; i < report.Shares; i++ {
+		keyID := v.unsealKeyForID(i)
+
+		k, err := v.keyStore.Get(keyID)
+		if _, notFound := err.(*kv.NotFoundError); notFound {
+			report.Missing = append(report.Missing, keyID)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to get key '%s': %s", keyID, err.Error())
+		}
+
+		duplicate := false
+		for _, other := range keys {
+			if bytes.Equal(k, other) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			report.Duplicate = append(report.Duplicate, keyID)
+			continue
+		}
+
+		keys[keyID] = k
+	}
+	return keys, nil
+}
+
+// usableUnsealKeys returns the IDs of the keys not known to be invalid or duplicate, in the order of the keys
+func usableUnsealKeys(order []string, report *UnsealReport) []string {
+	excluded := map[string]bool{}
+	for _, keyID := range append(report.Invalid, report.Duplicate...) {
+		excluded[keyID] = true
+	}
+
+	candidates := []string{}
+	for _, keyID := range order {
+		if !excluded[keyID] {
+			candidates = append(candidates, keyID)
+		}
+	}
+	return candidates
+}
+
+// submitUnsealKeys sends the keys to Vault one by one, until Vault is unsealed or the unseal process fails.
+// The seal status is checked after every key: if the progress doesn't advance with the same nonce the key is
+// a duplicate, if Vault returns an error before reaching the threshold the key itself is rejected, if it does
+// at the threshold one of the submitted keys is invalid, and if the nonce changes someone else has reset the
+// unseal process.
+func submitUnsealKeys(sys unsealSys, keys map[string][]byte, candidates []string, report *UnsealReport) ([]string, unsealResult, error) {
+	submitted := []string{}
+	progress, nonce := 0, ""
+
+	for _, keyID := range candidates {
+		logrus.Debugf("sending unseal request to vault...")
+		resp, unsealErr := sys.Unseal(string(keys[keyID]))
+
+		if unsealErr == nil {
+			logrus.Debugf("got unseal response: %+v", *resp)
+		} else {
+			logrus.Debugf("got unseal error: %s", unsealErr.Error())
+
+			// The response doesn't tell why the key failed, so the seal status has to be checked
+			var err error
+			resp, err = sys.SealStatus()
+			if err != nil {
+				return submitted, 0, fmt.Errorf("fail to send unseal request to vault: %s, error checking status: %s", unsealErr.Error(), err.Error())
+			}
+		}
+
+		if !resp.Sealed {
+			return append(submitted, keyID), unsealSucceeded, nil
+		}
+
+		if (nonce != "" && resp.Nonce != "" && resp.Nonce != nonce) || resp.Progress < progress {
+			if unsealErr != nil && progress == report.Threshold-1 {
+				// The keys are combined at the threshold, which resets the unseal process if any of them is invalid
+				return append(submitted, keyID), unsealCombineFailed, nil
+			}
+			return submitted, unsealInterrupted, nil
+		}
+
+		switch {
+		case unsealErr != nil:
+			logrus.Warnf("key '%s' is rejected by vault: %s", keyID, unsealErr.Error())
+			report.Invalid = append(report.Invalid, keyID)
+		case resp.Progress == progress:
+			logrus.Warnf("key '%s' didn't advance the unseal progress", keyID)
+			report.Duplicate = append(report.Duplicate, keyID)
+		default:
+			submitted = append(submitted, keyID)
+			progress, nonce = resp.Progress, resp.Nonce
+		}
+	}
+
+	return submitted, unsealExhausted, nil
+}
+
+// invalidUnsealKeys returns the keys which must be invalid: the keys of a failed combination are valid if they
+// unsealed Vault, so if only one key of a failed combination didn't unseal Vault, that one is invalid. If Vault
+// could not be unsealed (used is empty), only the keys present in every failed combination are suspicious.
+func invalidUnsealKeys(failed [][]string, used []string) []string {
+	valid := map[string]bool{}
+	for _, keyID := range used {
+		valid[keyID] = true
+	}
+
+	invalid := map[string]bool{}
+	if len(used) > 0 {
+		for _, combination := range failed {
+			unknown := []string{}
+			for _, keyID := range combination {
+				if !valid[keyID] {
+					unknown = append(unknown, keyID)
+				}
+			}
+			if len(unknown) == 1 {
+				invalid[unknown[0]] = true
+			}
+		}
+	} else if len(failed) > 1 {
+		count := map[string]int{}
+		for _, combination := range failed {
+			for _, keyID := range combination {
+				count[keyID]++
+			}
+		}
+		for keyID, c := range count {
+			if c == len(failed) {
+				invalid[keyID] = true
+			}
+		}
+	}
+
+	keyIDs := []string{}
+	for keyID := range invalid {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return keyIDs
+}
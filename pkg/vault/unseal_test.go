@@ -0,0 +1,268 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/banzaicloud/bank-vaults/pkg/kv"
+	"github.com/hashicorp/vault/api"
+)
+
+type fakeKeyStore map[string][]byte
+
+func (s fakeKeyStore) Set(key string, value []byte) error {
+	s[key] = value
+	return nil
+}
+
+func (s fakeKeyStore) Get(key string) ([]byte, error) {
+	value, ok := s[key]
+	if !ok {
+		return nil, kv.NewNotFoundError("key not found: %s", key)
+	}
+	return value, nil
+}
+
+// fakeUnsealSys is a sealed Shamir Vault: the keys starting with "share-" are its shares, the other keys
+// are well formed but fail to be combined with them, except the ones starting with "malformed-" which are
+// rejected right away
+type fakeUnsealSys struct {
+	threshold int
+	shares    int
+
+	sealed    bool
+	submitted []string
+	nonce     string
+	calls     int
+	// first is the first key submitted
+	first string
+	// interruptAt is the Unseal call before which someone else resets the unseal process
+	interruptAt int
+}
+
+func (s *fakeUnsealSys) status() *api.SealStatusResponse {
+	return &api.SealStatusResponse{Sealed: s.sealed, T: s.threshold, N: s.shares, Progress: len(s.submitted), Nonce: s.nonce}
+}
+
+func (s *fakeUnsealSys) SealStatus() (*api.SealStatusResponse, error) {
+	return s.status(), nil
+}
+
+func (s *fakeUnsealSys) ResetUnsealProcess() (*api.SealStatusResponse, error) {
+	s.submitted, s.nonce = nil, ""
+	return s.status(), nil
+}
+
+func (s *fakeUnsealSys) Unseal(shard string) (*api.SealStatusResponse, error) {
+	s.calls++
+	if s.calls == 1 {
+		s.first = shard
+	}
+	if s.calls == s.interruptAt {
+		s.submitted, s.nonce = nil, "someone-else"
+	}
+
+	if strings.HasPrefix(shard, "malformed-") {
+		return nil, errors.New("invalid key")
+	}
+	for _, submitted := range s.submitted {
+		if submitted == shard {
+			return s.status(), nil
+		}
+	}
+
+	if s.nonce == "" {
+		s.nonce = fmt.Sprintf("nonce-%d", s.calls)
+	}
+	s.submitted = append(s.submitted, shard)
+
+	if len(s.submitted) == s.threshold {
+		for _, submitted := range s.submitted {
+			if !strings.HasPrefix(submitted, "share-") {
+				s.submitted, s.nonce = nil, ""
+				return nil, errors.New("failed to combine keys")
+			}
+		}
+		s.sealed, s.submitted, s.nonce = false, nil, ""
+	}
+
+	return s.status(), nil
+}
+
+func TestUnseal(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        []string
+		interruptAt int
+		sealed      bool
+		// valid are the keys which can unseal Vault, the used ones depend on the order of the keys
+		valid []string
+		// invalid are the keys which may be reported as invalid, depending on the order of the keys
+		invalid     []string
+		duplicate   []string
+		missing     []string
+		interrupted int
+	}{
+		{
+			name:  "valid keys",
+			keys:  []string{"share-0", "share-1", "share-2"},
+			valid: []string{"vault-unseal-0", "vault-unseal-1", "vault-unseal-2"},
+		},
+		{
+			name:    "key of a previous initialization",
+			keys:    []string{"old-0", "share-1", "share-2"},
+			valid:   []string{"vault-unseal-1", "vault-unseal-2"},
+			invalid: []string{"vault-unseal-0"},
+		},
+		{
+			name:    "rejected key",
+			keys:    []string{"malformed-0", "share-1", "share-2"},
+			valid:   []string{"vault-unseal-1", "vault-unseal-2"},
+			invalid: []string{"vault-unseal-0"},
+		},
+		{
+			name:      "duplicate key",
+			keys:      []string{"share-0", "share-0", "share-2"},
+			valid:     []string{"vault-unseal-0", "vault-unseal-2"},
+			duplicate: []string{"vault-unseal-1"},
+		},
+		{
+			name:        "interrupted reset",
+			keys:        []string{"share-0", "share-1", "share-2"},
+			interruptAt: 2,
+			valid:       []string{"vault-unseal-0", "vault-unseal-1", "vault-unseal-2"},
+			interrupted: 1,
+		},
+		{
+			name:    "missing keys",
+			keys:    []string{"share-0", "", ""},
+			sealed:  true,
+			missing: []string{"vault-unseal-1", "vault-unseal-2"},
+		},
+		{
+			name:   "not enough valid keys",
+			keys:   []string{"old-0", "old-1", "share-2"},
+			sealed: true,
+		},
+	}
+
+	for _, test := range tests {
+		for seed := int64(0); seed < 10; seed++ {
+			t.Run(fmt.Sprintf("%s/%d", test.name, seed), func(t *testing.T) {
+				store := fakeKeyStore{}
+				for i, key := range test.keys {
+					if key != "" {
+						store[UnsealKeyID(i)] = []byte(key)
+					}
+				}
+
+				v := &vault{keyStore: store, config: &Config{SecretShares: 3, SecretThreshold: 2}}
+				sys := &fakeUnsealSys{threshold: 2, shares: 3, sealed: true, interruptAt: test.interruptAt}
+
+				report, err := v.unseal(sys, rand.New(rand.NewSource(seed)))
+				if test.sealed != (err != nil) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if report.Sealed != test.sealed || sys.sealed != test.sealed {
+					t.Fatalf("expected sealed %t, got %t (vault %t)", test.sealed, report.Sealed, sys.sealed)
+				}
+				if !test.sealed && (len(report.Used) != 2 || !subset(report.Used, test.valid)) {
+					t.Errorf("expected 2 used keys of %v, got %v", test.valid, report.Used)
+				}
+				if !subset(report.Invalid, test.invalid) {
+					t.Errorf("expected invalid keys of %v, got %v", test.invalid, report.Invalid)
+				}
+				if len(report.Duplicate) > 0 || len(test.duplicate) > 0 {
+					if !reflect.DeepEqual(report.Duplicate, test.duplicate) {
+						t.Errorf("expected duplicate keys %v, got %v", test.duplicate, report.Duplicate)
+					}
+				}
+				if len(report.Missing) > 0 || len(test.missing) > 0 {
+					if !reflect.DeepEqual(report.Missing, test.missing) {
+						t.Errorf("expected missing keys %v, got %v", test.missing, report.Missing)
+					}
+				}
+				if report.Interrupted != test.interrupted {
+					t.Errorf("expected %d interruptions, got %d", test.interrupted, report.Interrupted)
+				}
+			})
+		}
+	}
+}
+
+// TestUnsealOrder checks that the keys are submitted in a different order depending on the random source
+func TestUnsealOrder(t *testing.T) {
+	first := map[string]bool{}
+	for seed := int64(0); seed < 10; seed++ {
+		store := fakeKeyStore{}
+		for i := 0; i < 5; i++ {
+			store[UnsealKeyID(i)] = []byte(fmt.Sprintf("share-%d", i))
+		}
+
+		v := &vault{keyStore: store, config: &Config{SecretShares: 5, SecretThreshold: 3}}
+		sys := &fakeUnsealSys{threshold: 3, shares: 5, sealed: true}
+
+		if _, err := v.unseal(sys, rand.New(rand.NewSource(seed))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		first[sys.first] = true
+	}
+
+	if len(first) < 2 {
+		t.Errorf("expected the keys to be submitted in random order, the first key was always %v", first)
+	}
+}
+
+func subset(keys, of []string) bool {
+	for _, key := range keys {
+		found := false
+		for _, other := range of {
+			if key == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUntriedUnsealKeys(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+	tried := map[string]bool{}
+
+	var combinations []string
+	for {
+		combination := untriedUnsealKeys(candidates, 2, tried)
+		if combination == nil {
+			break
+		}
+		tried[combinationID(combination)] = true
+		combinations = append(combinations, combinationID(combination))
+	}
+
+	expected := []string{"a,b", "a,c", "a,d", "b,c", "b,d", "c,d"}
+	if !reflect.DeepEqual(combinations, expected) {
+		t.Errorf("expected combinations %v, got %v", expected, combinations)
+	}
+}